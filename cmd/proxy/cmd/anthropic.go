@@ -0,0 +1,697 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/maxneuvians/go-copilot-proxy/pkg/tokenizer"
+	"github.com/rs/zerolog/log"
+)
+
+// Anthropic stop reasons.
+const (
+	stopReasonEndTurn   = "end_turn"
+	stopReasonMaxTokens = "max_tokens"
+	stopReasonRefusal   = "refusal"
+	stopReasonToolUse   = "tool_use"
+)
+
+// AnthropicRequest is the body of an Anthropic Messages API request.
+type AnthropicRequest struct {
+	Model     *string `json:"model,omitempty"`
+	MaxTokens *int64  `json:"max_tokens,omitempty"`
+	// System is a string or an array of text blocks.
+	System        AnthropicContent     `json:"system,omitempty"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *AnthropicMetadata   `json:"metadata,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent is a list of content blocks. A plain string is accepted
+// as a single text block.
+type AnthropicContent []AnthropicContentBlock
+
+// AnthropicContentBlock is a text, image, tool_use or tool_result block.
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// image
+	Source *AnthropicImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   AnthropicContent `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type AnthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type AnthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      AnthropicContent `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// MarshalJSON emits the fields of the block's type, including an empty text
+// or input, as Anthropic does.
+func (b AnthropicContentBlock) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case "text":
+		return json.Marshal(struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{b.Type, b.Text})
+	case "tool_use":
+		input := b.Input
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		return json.Marshal(struct {
+			Type  string          `json:"type"`
+			ID    string          `json:"id"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		}{b.Type, b.ID, b.Name, input})
+	}
+
+	type block AnthropicContentBlock
+	return json.Marshal(block(b))
+}
+
+// text joins the text blocks of the content.
+func (c AnthropicContent) text() string {
+	var texts []string
+	for _, block := range c {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// completionRequest translates an Anthropic request into a Copilot chat
+// completion request.
+func (r AnthropicRequest) completionRequest() (pkg.CompletionRequest, error) {
+	model := Model
+	if r.Model != nil {
+		model = *r.Model
+	}
+
+	temperature := Completion_temperature
+	if r.Temperature != nil {
+		temperature = *r.Temperature
+	}
+
+	topP := Completion_top_p
+	if r.TopP != nil {
+		topP = *r.TopP
+	}
+
+	request := pkg.CompletionRequest{
+		Model:       model,
+		Temperature: temperature,
+		TopP:        topP,
+		N:           1,
+		Stream:      r.Stream,
+		MaxTokens:   r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		request.Stop = r.StopSequences
+	}
+	if r.Metadata != nil {
+		request.User = r.Metadata.UserID
+	}
+
+	if system := r.System.text(); system != "" {
+		request.Messages = append(request.Messages, pkg.Message{Role: "system", Content: system})
+	}
+
+	for i, message := range r.Messages {
+		messages, err := anthropicMessages(message)
+		if err != nil {
+			return request, fmt.Errorf("messages.%d: %w", i, err)
+		}
+		request.Messages = append(request.Messages, messages...)
+	}
+
+	for _, tool := range r.Tools {
+		request.Tools = append(request.Tools, pkg.Tool{
+			Type: "function",
+			Function: pkg.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if choice := r.ToolChoice; choice != nil {
+		switch choice.Type {
+		case "auto", "none":
+			request.ToolChoice = choice.Type
+		case "any":
+			request.ToolChoice = "required"
+		case "tool":
+			request.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]string{"name": choice.Name},
+			}
+		default:
+			return request, fmt.Errorf("tool_choice: unsupported type %q", choice.Type)
+		}
+
+		if choice.DisableParallelToolUse && len(request.Tools) > 0 {
+			parallel := false
+			request.ParallelToolCalls = &parallel
+		}
+	}
+
+	return request, nil
+}
+
+// anthropicMessages translates one Anthropic message into chat messages. The
+// tool results of a user message become tool messages, followed by a user
+// message with the remaining content.
+func anthropicMessages(message AnthropicMessage) ([]pkg.Message, error) {
+	var messages []pkg.Message
+	var parts []pkg.ContentPart
+	var toolCalls []pkg.ToolCall
+	hasImages := false
+
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			parts = append(parts, pkg.ContentPart{Type: "text", Text: block.Text})
+		case "image":
+			imageURL, err := anthropicImageURL(block.Source)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, pkg.ContentPart{Type: "image_url", ImageURL: &pkg.ImageURL{URL: imageURL}})
+			hasImages = true
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			toolCalls = append(toolCalls, pkg.ToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: pkg.FunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		case "tool_result":
+			messages = append(messages, pkg.Message{
+				Role:       "tool",
+				ToolCallID: block.ToolUseID,
+				Content:    block.Content.text(),
+			})
+			// Tool messages only carry text, so images produced by a tool
+			// are passed on in the user message
+			for _, result := range block.Content {
+				if result.Type == "image" {
+					imageURL, err := anthropicImageURL(result.Source)
+					if err != nil {
+						return nil, err
+					}
+					parts = append(parts, pkg.ContentPart{Type: "image_url", ImageURL: &pkg.ImageURL{URL: imageURL}})
+					hasImages = true
+				}
+			}
+		case "thinking", "redacted_thinking":
+			// Thinking from earlier turns cannot be replayed to Copilot
+		default:
+			return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+
+	chatMessage := pkg.Message{Role: message.Role, ToolCalls: toolCalls}
+	if hasImages {
+		chatMessage.MultiContent = parts
+	} else {
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			texts = append(texts, part.Text)
+		}
+		chatMessage.Content = strings.Join(texts, "\n\n")
+	}
+
+	return append(messages, chatMessage), nil
+}
+
+func anthropicImageURL(source *AnthropicImageSource) (string, error) {
+	if source == nil {
+		return "", fmt.Errorf("image block without source")
+	}
+
+	switch source.Type {
+	case "base64":
+		return "data:" + source.MediaType + ";base64," + source.Data, nil
+	case "url":
+		return source.URL, nil
+	}
+
+	return "", fmt.Errorf("unsupported image source type %q", source.Type)
+}
+
+// anthropicStopReason maps an OpenAI finish reason onto an Anthropic stop
+// reason.
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case pkg.FinishReasonLength:
+		return stopReasonMaxTokens
+	case pkg.FinishReasonToolCalls, pkg.FinishReasonFunctionCall:
+		return stopReasonToolUse
+	case pkg.FinishReasonContentFilter:
+		return stopReasonRefusal
+	}
+	return stopReasonEndTurn
+}
+
+// toolCallInput returns tool call arguments as a JSON object, or an empty
+// object when they are missing or malformed.
+func toolCallInput(arguments string) json.RawMessage {
+	if arguments == "" || !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+func newAnthropicMessageID() string {
+	return "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func messagesHandler(c *fiber.Ctx) error {
+	var payload AnthropicRequest
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/v1/messages").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(anthropicErrorObject(anthropicErrorType(fiber.StatusBadRequest), "Invalid request payload"))
+	}
+
+	if len(payload.Messages) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(anthropicErrorObject(anthropicErrorType(fiber.StatusBadRequest), "messages: at least one message is required"))
+	}
+
+	request, err := payload.completionRequest()
+	if err == nil {
+		err = resolveImages(request.Messages)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(anthropicErrorObject(anthropicErrorType(fiber.StatusBadRequest), err.Error()))
+	}
+
+	log.Debug().
+		Int("message_count", len(request.Messages)).
+		Str("model", request.Model).
+		Bool("stream", request.Stream).
+		Msg("Processing messages request")
+
+	if request.Stream {
+		err := streamResponse(c, request, func(w *bufio.Writer, chatStream *pkg.ChatStream) {
+			if err := writeAnthropicStream(w, chatStream, request); err != nil {
+				log.Debug().
+					Err(err).
+					Str("model", request.Model).
+					Msg("Client disconnected, aborted streaming messages request")
+			}
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", request.Model).
+				Msg("Failed to get streaming messages response")
+			return sendAnthropicError(c, err)
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+
+		return nil
+	}
+
+	completionResp, err := completeChat(c.UserContext(), request)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Msg("Failed to get messages response")
+		return sendAnthropicError(c, err)
+	}
+
+	return c.JSON(anthropicResponse(completionResp, request))
+}
+
+// anthropicResponse translates a chat completion into an Anthropic message.
+// Copilot may split text and tool calls over several choices, so the
+// content of all choices is merged.
+func anthropicResponse(completionResp pkg.CompletionResponse, request pkg.CompletionRequest) AnthropicResponse {
+	response := AnthropicResponse{
+		ID:      newAnthropicMessageID(),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   completionResp.Model,
+		Content: AnthropicContent{},
+	}
+	if response.Model == "" {
+		response.Model = request.Model
+	}
+
+	var completion strings.Builder
+	finishReason := ""
+
+	for _, choice := range completionResp.Choices {
+		message := choice.Message
+		if message == nil {
+			message = choice.Delta
+		}
+		if message == nil {
+			continue
+		}
+
+		if message.Content != "" {
+			response.Content = append(response.Content, AnthropicContentBlock{Type: "text", Text: message.Content})
+		}
+		for _, toolCall := range message.ToolCalls {
+			response.Content = append(response.Content, AnthropicContentBlock{
+				Type:  "tool_use",
+				ID:    toolCall.ID,
+				Name:  toolCall.Function.Name,
+				Input: toolCallInput(toolCall.Function.Arguments),
+			})
+		}
+		writeCompletion(&completion, message)
+
+		// A tool call wins over the end of the turn reported by another choice
+		if finishReason == "" || choice.FinishReason == pkg.FinishReasonToolCalls {
+			finishReason = choice.FinishReason
+		}
+	}
+
+	if finishReason == "" {
+		finishReason = pkg.FinishReasonStop
+		for _, block := range response.Content {
+			if block.Type == "tool_use" {
+				finishReason = pkg.FinishReasonToolCalls
+			}
+		}
+	}
+	stopReason := anthropicStopReason(finishReason)
+	response.StopReason = &stopReason
+
+	usage := completionResp.Usage
+	if usage == (pkg.Usage{}) {
+		usage = estimateUsage(request.Model, request.Messages, completion.String())
+	}
+	response.Usage = AnthropicUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}
+
+	return response
+}
+
+// writeAnthropicStream translates the chunks of chatStream into the named
+// events of an Anthropic message stream. It returns an error only when
+// writing to the client fails.
+func writeAnthropicStream(w *bufio.Writer, chatStream *pkg.ChatStream, request pkg.CompletionRequest) error {
+	inputTokens := int64(0)
+	if t, err := tokenizer.ForModel(request.Model); err == nil {
+		inputTokens = int64(t.CountMessages(request.Messages))
+	}
+
+	err := writeNamedEvent(w, "message_start", fiber.Map{
+		"type": "message_start",
+		"message": AnthropicResponse{
+			ID:      newAnthropicMessageID(),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   request.Model,
+			Content: AnthropicContent{},
+			Usage:   AnthropicUsage{InputTokens: inputTokens},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeNamedEvent(w, "ping", fiber.Map{"type": "ping"}); err != nil {
+		return err
+	}
+
+	// Content blocks are sent one after another: a block is stopped as soon
+	// as content for another block arrives
+	blockIndex := -1
+	blockType := ""
+	toolBlocks := map[int64]int{}
+
+	stopBlock := func() error {
+		if blockIndex < 0 || blockType == "" {
+			return nil
+		}
+		blockType = ""
+		return writeNamedEvent(w, "content_block_stop", fiber.Map{"type": "content_block_stop", "index": blockIndex})
+	}
+	startBlock := func(block AnthropicContentBlock) error {
+		if err := stopBlock(); err != nil {
+			return err
+		}
+		blockIndex++
+		blockType = block.Type
+		return writeNamedEvent(w, "content_block_start", fiber.Map{"type": "content_block_start", "index": blockIndex, "content_block": block})
+	}
+
+	var completion strings.Builder
+	finishReason := ""
+
+	for chatStream.Next() {
+		for _, choice := range chatStream.Current().Choices {
+			if choice.FinishReason != "" && (finishReason == "" || choice.FinishReason == pkg.FinishReasonToolCalls) {
+				finishReason = choice.FinishReason
+			}
+
+			delta := choice.Delta
+			if delta == nil {
+				continue
+			}
+			writeCompletion(&completion, delta)
+
+			if delta.Content != "" {
+				if blockType != "text" {
+					if err := startBlock(AnthropicContentBlock{Type: "text"}); err != nil {
+						return err
+					}
+				}
+				err := writeNamedEvent(w, "content_block_delta", fiber.Map{
+					"type":  "content_block_delta",
+					"index": blockIndex,
+					"delta": fiber.Map{"type": "text_delta", "text": delta.Content},
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			for i, toolCall := range delta.ToolCalls {
+				key := int64(i)
+				if toolCall.Index != nil {
+					key = *toolCall.Index
+				}
+
+				index, ok := toolBlocks[key]
+				if !ok {
+					err := startBlock(AnthropicContentBlock{
+						Type:  "tool_use",
+						ID:    toolCall.ID,
+						Name:  toolCall.Function.Name,
+						Input: json.RawMessage("{}"),
+					})
+					if err != nil {
+						return err
+					}
+					index = blockIndex
+					toolBlocks[key] = index
+				}
+
+				if toolCall.Function.Arguments != "" {
+					err := writeNamedEvent(w, "content_block_delta", fiber.Map{
+						"type":  "content_block_delta",
+						"index": index,
+						"delta": fiber.Map{"type": "input_json_delta", "partial_json": toolCall.Function.Arguments},
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	if err := chatStream.Err(); err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Msg("Streaming messages response failed")
+		status, message := upstreamErrorMessage(err)
+		return writeNamedEvent(w, "error", anthropicErrorObject(anthropicErrorType(status), message))
+	}
+
+	if err := stopBlock(); err != nil {
+		return err
+	}
+
+	if finishReason == "" {
+		finishReason = pkg.FinishReasonStop
+	}
+
+	outputTokens := chatStream.Usage().CompletionTokens
+	if chatStream.Usage() == (pkg.Usage{}) {
+		outputTokens = estimateUsage(request.Model, nil, completion.String()).CompletionTokens
+	}
+
+	err = writeNamedEvent(w, "message_delta", fiber.Map{
+		"type":  "message_delta",
+		"delta": fiber.Map{"stop_reason": anthropicStopReason(finishReason), "stop_sequence": nil},
+		"usage": fiber.Map{"output_tokens": outputTokens},
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeNamedEvent(w, "message_stop", fiber.Map{"type": "message_stop"})
+}
+
+// writeNamedEvent writes v as an SSE event of the given type and flushes it
+// to the client.
+func writeNamedEvent(w *bufio.Writer, event string, v interface{}) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n", event, data.Bytes()); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// anthropicErrorType maps an HTTP status onto an Anthropic error type.
+func anthropicErrorType(status int) string {
+	switch {
+	case status == fiber.StatusUnauthorized:
+		return "authentication_error"
+	case status == fiber.StatusForbidden:
+		return "permission_error"
+	case status == fiber.StatusNotFound:
+		return "not_found_error"
+	case status == fiber.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == fiber.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == fiber.StatusServiceUnavailable || status == 529:
+		return "overloaded_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	}
+	return "api_error"
+}
+
+// anthropicErrorObject builds an Anthropic style error body.
+func anthropicErrorObject(errorType, message string) fiber.Map {
+	return fiber.Map{
+		"type": "error",
+		"error": fiber.Map{
+			"type":    errorType,
+			"message": message,
+		},
+	}
+}
+
+// sendAnthropicError writes an upstream error in the Anthropic format with
+// the same status and Retry-After hint as the OpenAI routes.
+func sendAnthropicError(c *fiber.Ctx, err error) error {
+	setRetryAfter(c, err)
+
+	status, message := upstreamErrorMessage(err)
+	return c.Status(status).JSON(anthropicErrorObject(anthropicErrorType(status), message))
+}
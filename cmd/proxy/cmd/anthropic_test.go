@@ -0,0 +1,429 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+func TestAnthropicCompletionRequest(t *testing.T) {
+	body := `{
+		"model": "claude-3.7-sonnet",
+		"max_tokens": 256,
+		"system": [{"type":"text","text":"Be brief."},{"type":"text","text":"Be kind."}],
+		"stop_sequences": ["END"],
+		"temperature": 0.2,
+		"metadata": {"user_id": "user-1"},
+		"tools": [{"name":"get_weather","description":"Weather","input_schema":{"type":"object"}}],
+		"tool_choice": {"type":"any","disable_parallel_tool_use":true},
+		"messages": [
+			{"role":"user","content":"What is the weather?"},
+			{"role":"assistant","content":[
+				{"type":"thinking","thinking":"Let me check."},
+				{"type":"text","text":"Checking."},
+				{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Ottawa"}}
+			]},
+			{"role":"user","content":[
+				{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"Sunny"}]},
+				{"type":"text","text":"And tomorrow?"},
+				{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}}
+			]}
+		]
+	}`
+
+	var payload AnthropicRequest
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	request, err := payload.completionRequest()
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	if request.Model != "claude-3.7-sonnet" || request.Temperature != 0.2 || request.N != 1 {
+		t.Errorf("Unexpected model, temperature or n: %s %v %d", request.Model, request.Temperature, request.N)
+	}
+	if request.MaxTokens == nil || *request.MaxTokens != 256 {
+		t.Errorf("Expected max_tokens 256, got %v", request.MaxTokens)
+	}
+	if stop, ok := request.Stop.([]string); !ok || len(stop) != 1 || stop[0] != "END" {
+		t.Errorf("Expected stop [END], got %v", request.Stop)
+	}
+	if request.User != "user-1" {
+		t.Errorf("Expected user user-1, got %q", request.User)
+	}
+	if request.ToolChoice != "required" {
+		t.Errorf("Expected tool_choice required, got %v", request.ToolChoice)
+	}
+	if request.ParallelToolCalls == nil || *request.ParallelToolCalls {
+		t.Errorf("Expected parallel_tool_calls false, got %v", request.ParallelToolCalls)
+	}
+	if len(request.Tools) != 1 || request.Tools[0].Function.Name != "get_weather" || string(request.Tools[0].Function.Parameters) != `{"type":"object"}` {
+		t.Errorf("Unexpected tools: %+v", request.Tools)
+	}
+
+	roles := []string{}
+	for _, message := range request.Messages {
+		roles = append(roles, message.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,tool,user" {
+		t.Fatalf("Expected roles system,user,assistant,tool,user, got %v", roles)
+	}
+
+	if request.Messages[0].Content != "Be brief.\n\nBe kind." {
+		t.Errorf("Unexpected system message: %q", request.Messages[0].Content)
+	}
+	if request.Messages[1].Content != "What is the weather?" {
+		t.Errorf("Unexpected user message: %q", request.Messages[1].Content)
+	}
+
+	assistant := request.Messages[2]
+	if assistant.Content != "Checking." {
+		t.Errorf("Expected thinking to be dropped, got %q", assistant.Content)
+	}
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID != "toolu_1" || assistant.ToolCalls[0].Function.Arguments != `{"city":"Ottawa"}` {
+		t.Errorf("Unexpected tool calls: %+v", assistant.ToolCalls)
+	}
+
+	tool := request.Messages[3]
+	if tool.ToolCallID != "toolu_1" || tool.Content != "Sunny" {
+		t.Errorf("Unexpected tool message: %+v", tool)
+	}
+
+	user := request.Messages[4]
+	if len(user.MultiContent) != 2 || user.MultiContent[0].Text != "And tomorrow?" {
+		t.Fatalf("Unexpected user parts: %+v", user.MultiContent)
+	}
+	if image := user.MultiContent[1].ImageURL; image == nil || image.URL != "data:image/png;base64,iVBORw0KGgo=" {
+		t.Errorf("Unexpected image part: %+v", user.MultiContent[1])
+	}
+}
+
+func TestAnthropicCompletionRequestToolChoice(t *testing.T) {
+	tests := []struct {
+		choice string
+		want   string
+	}{
+		{`{"type":"auto"}`, `"auto"`},
+		{`{"type":"none"}`, `"none"`},
+		{`{"type":"tool","name":"get_weather"}`, `{"function":{"name":"get_weather"},"type":"function"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.choice, func(t *testing.T) {
+			var payload AnthropicRequest
+			body := `{"messages":[{"role":"user","content":"Hi"}],"tool_choice":` + tt.choice + `}`
+			if err := json.Unmarshal([]byte(body), &payload); err != nil {
+				t.Fatalf("Failed to decode request: %v", err)
+			}
+
+			request, err := payload.completionRequest()
+			if err != nil {
+				t.Fatalf("Failed to translate request: %v", err)
+			}
+
+			got, _ := json.Marshal(request.ToolChoice)
+			if string(got) != tt.want {
+				t.Errorf("Expected tool_choice %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func postMessages(t *testing.T, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func TestMessagesEndpoint(t *testing.T) {
+	var upstreamRequest pkg.CompletionRequest
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		// Copilot returns the text and the tool call of Claude models as
+		// separate choices
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"model":"claude-3.7-sonnet","choices":[
+			{"message":{"role":"assistant","content":"Let me check."},"finish_reason":"stop"},
+			{"message":{"role":"assistant","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Ottawa\"}"}}]},"finish_reason":"tool_calls"}
+		],"usage":{"prompt_tokens":12,"completion_tokens":7,"total_tokens":19}}`)
+	})
+
+	resp, data := postMessages(t, `{"model":"claude-3.7-sonnet","max_tokens":100,"messages":[{"role":"user","content":"Weather?"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	if upstreamRequest.Stream {
+		t.Error("Expected a non-streaming upstream request")
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", data, err)
+	}
+
+	if message["type"] != "message" || message["role"] != "assistant" || message["model"] != "claude-3.7-sonnet" {
+		t.Errorf("Unexpected message envelope: %s", data)
+	}
+	if id, _ := message["id"].(string); !strings.HasPrefix(id, "msg_") {
+		t.Errorf("Expected an msg_ id, got %q", id)
+	}
+	if message["stop_reason"] != "tool_use" {
+		t.Errorf("Expected stop_reason tool_use, got %v", message["stop_reason"])
+	}
+	if _, ok := message["stop_sequence"]; !ok {
+		t.Error("Expected stop_sequence to be present")
+	}
+
+	content, _ := message["content"].([]interface{})
+	if len(content) != 2 {
+		t.Fatalf("Expected 2 content blocks, got %s", data)
+	}
+	text := content[0].(map[string]interface{})
+	if text["type"] != "text" || text["text"] != "Let me check." {
+		t.Errorf("Unexpected text block: %v", text)
+	}
+	toolUse := content[1].(map[string]interface{})
+	input, _ := toolUse["input"].(map[string]interface{})
+	if toolUse["type"] != "tool_use" || toolUse["id"] != "toolu_1" || toolUse["name"] != "get_weather" || input["city"] != "Ottawa" {
+		t.Errorf("Unexpected tool_use block: %v", toolUse)
+	}
+
+	usage, _ := message["usage"].(map[string]interface{})
+	if usage["input_tokens"] != float64(12) || usage["output_tokens"] != float64(7) {
+		t.Errorf("Expected usage 12/7, got %v", usage)
+	}
+}
+
+func TestMessagesEndpointStopReasons(t *testing.T) {
+	tests := []struct {
+		finishReason string
+		want         string
+	}{
+		{"stop", "end_turn"},
+		{"length", "max_tokens"},
+		{"content_filter", "refusal"},
+		{"", "end_turn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want+"/"+tt.finishReason, func(t *testing.T) {
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":%q}]}`, tt.finishReason)
+			})
+
+			resp, data := postMessages(t, `{"messages":[{"role":"user","content":"Hi"}]}`)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+			}
+
+			var message AnthropicResponse
+			json.Unmarshal(data, &message)
+			if message.StopReason == nil || *message.StopReason != tt.want {
+				t.Errorf("Expected stop_reason %s, got %v", tt.want, message.StopReason)
+			}
+			if message.Usage.InputTokens == 0 || message.Usage.OutputTokens == 0 {
+				t.Errorf("Expected estimated usage, got %+v", message.Usage)
+			}
+		})
+	}
+}
+
+type namedEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+func readNamedEvents(t *testing.T, r io.Reader) []namedEvent {
+	t.Helper()
+
+	var events []namedEvent
+	var name string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatalf("Failed to decode event %q: %v", line, err)
+			}
+			if data["type"] != name {
+				t.Errorf("Event %s carries type %v", name, data["type"])
+			}
+			events = append(events, namedEvent{name, data})
+		}
+	}
+
+	return events
+}
+
+func TestMessagesEndpointStreaming(t *testing.T) {
+	var upstreamRequest pkg.CompletionRequest
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeUpstreamChunk(w, "Let me ", "")
+		writeUpstreamChunk(w, "check.", "")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Ottawa\"}"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"finish_reason":"tool_calls","delta":{}}]}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Weather?"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", ct)
+	}
+	if !upstreamRequest.Stream {
+		t.Error("Expected a streaming upstream request")
+	}
+
+	events := readNamedEvents(t, resp.Body)
+
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.name)
+	}
+	want := []string{
+		"message_start", "ping",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected events %v, got %v", want, names)
+	}
+
+	message := events[0].data["message"].(map[string]interface{})
+	if message["model"] != "gpt-4o" || message["stop_reason"] != nil {
+		t.Errorf("Unexpected message_start: %v", message)
+	}
+	if usage := message["usage"].(map[string]interface{}); usage["input_tokens"] == float64(0) {
+		t.Errorf("Expected estimated input tokens, got %v", usage)
+	}
+
+	text := ""
+	input := ""
+	for _, event := range events {
+		if event.name != "content_block_delta" {
+			continue
+		}
+		delta := event.data["delta"].(map[string]interface{})
+		switch delta["type"] {
+		case "text_delta":
+			if event.data["index"] != float64(0) {
+				t.Errorf("Expected text at index 0, got %v", event.data["index"])
+			}
+			text += delta["text"].(string)
+		case "input_json_delta":
+			if event.data["index"] != float64(1) {
+				t.Errorf("Expected tool input at index 1, got %v", event.data["index"])
+			}
+			input += delta["partial_json"].(string)
+		}
+	}
+	if text != "Let me check." {
+		t.Errorf("Expected text %q, got %q", "Let me check.", text)
+	}
+	if input != `{"city":"Ottawa"}` {
+		t.Errorf("Expected tool input %q, got %q", `{"city":"Ottawa"}`, input)
+	}
+
+	block := events[6].data["content_block"].(map[string]interface{})
+	if block["type"] != "tool_use" || block["id"] != "toolu_1" || block["name"] != "get_weather" {
+		t.Errorf("Unexpected tool_use block start: %v", block)
+	}
+
+	delta := events[10].data["delta"].(map[string]interface{})
+	if delta["stop_reason"] != "tool_use" {
+		t.Errorf("Expected stop_reason tool_use, got %v", delta["stop_reason"])
+	}
+	if usage := events[10].data["usage"].(map[string]interface{}); usage["output_tokens"] == float64(0) {
+		t.Errorf("Expected estimated output tokens, got %v", usage)
+	}
+}
+
+func TestMessagesEndpointErrors(t *testing.T) {
+	t.Run("invalid payload", func(t *testing.T) {
+		resp, data := postMessages(t, `{"messages":`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(string(data), `"type":"invalid_request_error"`) || !strings.Contains(string(data), `"type":"error"`) {
+			t.Errorf("Expected an Anthropic error body, got %s", data)
+		}
+	})
+
+	t.Run("no messages", func(t *testing.T) {
+		resp, _ := postMessages(t, `{"messages":[]}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("unsupported block", func(t *testing.T) {
+		resp, data := postMessages(t, `{"messages":[{"role":"user","content":[{"type":"document"}]}]}`)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "messages.0") {
+			t.Errorf("Expected status 400 naming the message, got %d: %s", resp.StatusCode, data)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"slow down"}}`)
+		})
+
+		resp, data := postMessages(t, `{"messages":[{"role":"user","content":"Hi"}]}`)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected status 429, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Retry-After") != "7" {
+			t.Errorf("Expected Retry-After 7, got %q", resp.Header.Get("Retry-After"))
+		}
+
+		var body map[string]map[string]string
+		json.Unmarshal(data, &body)
+		if body["error"]["type"] != "rate_limit_error" || body["error"]["message"] != "slow down" {
+			t.Errorf("Unexpected error body: %s", data)
+		}
+	})
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/maxneuvians/go-copilot-proxy/pkg/tokenizer"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Code_completion_model is reported as the model of code completions
+	// when the request does not name one; the Copilot engine is fixed.
+	Code_completion_model = "copilot-codex"
+	// Code_completion_max_tokens is OpenAI's default for legacy completions.
+	Code_completion_max_tokens = int64(16)
+)
+
+// CompletionsPayload is an OpenAI legacy completions request. The suffix
+// makes it a fill-in-the-middle request.
+type CompletionsPayload struct {
+	Model *string `json:"model,omitempty"`
+	// Prompt is a string or an array holding a single string.
+	Prompt      json.RawMessage `json:"prompt"`
+	Suffix      string          `json:"suffix,omitempty"`
+	MaxTokens   *int64          `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	N           *int64          `json:"n,omitempty"`
+	// Stop is a string or an array of strings.
+	Stop   json.RawMessage `json:"stop,omitempty"`
+	Stream *bool           `json:"stream,omitempty"`
+
+	StreamOptions *pkg.StreamOptions `json:"stream_options,omitempty"`
+}
+
+// TextCompletionChoice is a choice in the OpenAI legacy format, where
+// logprobs and an unfinished finish_reason are null.
+type TextCompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int64       `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type TextCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []TextCompletionChoice `json:"choices"`
+	Usage   *pkg.Usage             `json:"usage,omitempty"`
+}
+
+func completionsHandler(c *fiber.Ctx) error {
+	var payload CompletionsPayload
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/v1/completions").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("Invalid request payload", errorTypeInvalidRequest, ""))
+	}
+
+	request, err := payload.codeCompletionRequest()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject(err.Error(), errorTypeInvalidRequest, ""))
+	}
+
+	model := Code_completion_model
+	if payload.Model != nil {
+		model = *payload.Model
+	}
+
+	stream := payload.Stream != nil && *payload.Stream
+	startTime := time.Now()
+
+	// The upstream request is bound to ctx, which is cancelled as soon as a
+	// write to the downstream client fails, i.e. when it disconnects.
+	ctx, cancel := context.WithCancel(c.UserContext())
+
+	var completionStream *pkg.CodeCompletionStream
+	err = withSession(ctx, func(token string) (err error) {
+		completionStream, err = client.StreamCodeCompletion(ctx, token, request)
+		return err
+	})
+	if err != nil {
+		cancel()
+		log.Error().
+			Err(err).
+			Str("model", model).
+			Msg("Failed to get code completion")
+		return sendUpstreamError(c, err)
+	}
+
+	completionID := "cmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+
+	if !stream {
+		defer cancel()
+		defer completionStream.Close()
+
+		completionResp, err := completionStream.Collect()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", model).
+				Msg("Failed to get code completion")
+			return sendUpstreamError(c, err)
+		}
+
+		response := TextCompletion{
+			ID:      completionID,
+			Object:  "text_completion",
+			Created: created,
+			Model:   model,
+			Choices: make([]TextCompletionChoice, 0, len(completionResp.Choices)),
+		}
+
+		var completion strings.Builder
+		for _, choice := range completionResp.Choices {
+			completion.WriteString(choice.Text)
+
+			// Every choice ran to completion, so report a finish reason for all
+			finishReason := choice.FinishReason
+			if finishReason == "" {
+				finishReason = pkg.FinishReasonStop
+			}
+			response.Choices = append(response.Choices, TextCompletionChoice{
+				Text:         choice.Text,
+				Index:        choice.Index,
+				FinishReason: textFinishReason(finishReason),
+			})
+		}
+
+		usage := codeCompletionUsage(completionResp.Usage, model, request, completion.String())
+		response.Usage = &usage
+
+		log.Debug().
+			Str("model", model).
+			Int("response_length", completion.Len()).
+			Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
+			Msg("Code completion request completed successfully")
+
+		return c.JSON(response)
+	}
+
+	includeUsage := payload.StreamOptions != nil && payload.StreamOptions.IncludeUsage
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("Access-Control-Allow-Origin", "*")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		defer completionStream.Close()
+
+		newChunk := func(choices []TextCompletionChoice) TextCompletion {
+			return TextCompletion{
+				ID:      completionID,
+				Object:  "text_completion",
+				Created: created,
+				Model:   model,
+				Choices: choices,
+			}
+		}
+
+		var completion strings.Builder
+		for completionStream.Next() {
+			for _, choice := range completionStream.Current().Choices {
+				completion.WriteString(choice.Text)
+
+				chunk := newChunk([]TextCompletionChoice{{
+					Text:         choice.Text,
+					Index:        choice.Index,
+					FinishReason: textFinishReason(choice.FinishReason),
+				}})
+				if err := writeEvent(w, chunk); err != nil {
+					log.Debug().
+						Err(err).
+						Str("model", model).
+						Str("completion_id", completionID).
+						Msg("Client disconnected, aborted streaming code completion")
+					return
+				}
+			}
+		}
+
+		if err := completionStream.Err(); err != nil {
+			log.Error().
+				Err(err).
+				Str("model", model).
+				Str("completion_id", completionID).
+				Msg("Streaming code completion failed")
+			// Headers are already sent, so report the error in SSE format
+			_, body := upstreamError(err)
+			writeEvent(w, body)
+			return
+		}
+
+		if includeUsage {
+			usage := codeCompletionUsage(completionStream.Usage(), model, request, completion.String())
+			chunk := newChunk([]TextCompletionChoice{})
+			chunk.Usage = &usage
+			if err := writeEvent(w, chunk); err != nil {
+				return
+			}
+		}
+
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		w.Flush()
+
+		log.Debug().
+			Str("model", model).
+			Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
+			Str("completion_id", completionID).
+			Msg("Streaming code completion completed successfully")
+	})
+
+	return nil
+}
+
+// codeCompletionRequest builds the Copilot request for the payload. The
+// engine completes a single prompt, so an array must hold exactly one.
+func (p CompletionsPayload) codeCompletionRequest() (pkg.CodeCompletionRequest, error) {
+	var request pkg.CodeCompletionRequest
+
+	var prompt string
+	if err := json.Unmarshal(p.Prompt, &prompt); err != nil {
+		var prompts []string
+		if err := json.Unmarshal(p.Prompt, &prompts); err != nil || len(prompts) != 1 {
+			return request, fmt.Errorf("prompt must be a string or an array of one string")
+		}
+		prompt = prompts[0]
+	}
+
+	var stop []string
+	if len(p.Stop) > 0 && string(p.Stop) != "null" {
+		var single string
+		if err := json.Unmarshal(p.Stop, &single); err == nil {
+			stop = []string{single}
+		} else if err := json.Unmarshal(p.Stop, &stop); err != nil {
+			return request, fmt.Errorf("stop must be a string or an array of strings")
+		}
+	}
+
+	maxTokens := Code_completion_max_tokens
+	if p.MaxTokens != nil {
+		maxTokens = *p.MaxTokens
+	}
+
+	n := int64(1)
+	if p.N != nil {
+		n = *p.N
+	}
+
+	return pkg.CodeCompletionRequest{
+		Prompt:      prompt,
+		Suffix:      p.Suffix,
+		MaxTokens:   maxTokens,
+		Temperature: p.Temperature,
+		TopP:        p.TopP,
+		N:           n,
+		Stop:        stop,
+	}, nil
+}
+
+// textFinishReason returns nil for a choice that has not finished yet.
+func textFinishReason(finishReason string) *string {
+	if finishReason == "" {
+		return nil
+	}
+	return &finishReason
+}
+
+// codeCompletionUsage returns the usage reported by the upstream, estimating
+// it with the tokenizer of model when there is none.
+func codeCompletionUsage(usage pkg.Usage, model string, request pkg.CodeCompletionRequest, completion string) pkg.Usage {
+	if usage != (pkg.Usage{}) {
+		return usage
+	}
+
+	t, err := tokenizer.ForModel(model)
+	if err != nil {
+		log.Error().Err(err).Str("model", model).Msg("Failed to load tokenizer")
+		return pkg.Usage{}
+	}
+
+	promptTokens := int64(t.Count(request.Prompt) + t.Count(request.Suffix))
+	completionTokens := int64(t.Count(completion))
+	return pkg.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// useCodeCompletionUpstream streams "a + " and "b" for choice 0 and records
+// the decoded upstream request.
+func useCodeCompletionUpstream(t *testing.T, got *pkg.CodeCompletionRequest) {
+	t.Helper()
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/engines/copilot-codex/completions" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(got)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, choice := range []pkg.CodeCompletionChoice{
+			{Text: "a + ", Index: 0},
+			{Text: "b", Index: 0, FinishReason: "stop"},
+		} {
+			data, _ := json.Marshal(pkg.CodeCompletionResponse{ID: "upstream", Choices: []pkg.CodeCompletionChoice{choice}})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+}
+
+func postCompletions(t *testing.T, body string) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req, -1)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestCompletionsEndpoint(t *testing.T) {
+	var got pkg.CodeCompletionRequest
+	useCodeCompletionUpstream(t, &got)
+
+	resp := postCompletions(t, `{"model":"gpt-3.5-turbo-instruct","prompt":["func add(a, b int) int {\n\treturn "],"suffix":"\n}","max_tokens":32,"temperature":0.1,"stop":"\n"}`)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	if got.Prompt != "func add(a, b int) int {\n\treturn " || got.Suffix != "\n}" {
+		t.Errorf("Unexpected prompt and suffix: %q, %q", got.Prompt, got.Suffix)
+	}
+	if got.MaxTokens != 32 || got.N != 1 || got.Temperature == nil || *got.Temperature != 0.1 {
+		t.Errorf("Unexpected upstream request: %+v", got)
+	}
+	if len(got.Stop) != 1 || got.Stop[0] != "\n" {
+		t.Errorf("Expected stop [\"\\n\"], got %q", got.Stop)
+	}
+
+	var completion TextCompletion
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if !strings.HasPrefix(completion.ID, "cmpl-") || completion.Object != "text_completion" || completion.Model != "gpt-3.5-turbo-instruct" {
+		t.Errorf("Unexpected response: %+v", completion)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("Expected 1 choice, got %d", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	if choice.Text != "a + b" || choice.FinishReason == nil || *choice.FinishReason != "stop" {
+		t.Errorf("Unexpected choice: %+v", choice)
+	}
+	if completion.Usage == nil || completion.Usage.PromptTokens == 0 || completion.Usage.CompletionTokens == 0 {
+		t.Errorf("Expected estimated usage, got %+v", completion.Usage)
+	}
+}
+
+func TestCompletionsEndpointDefaults(t *testing.T) {
+	var got pkg.CodeCompletionRequest
+	useCodeCompletionUpstream(t, &got)
+
+	resp := postCompletions(t, `{"prompt":"x"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	if got.MaxTokens != Code_completion_max_tokens || got.Stop != nil || got.Temperature != nil {
+		t.Errorf("Unexpected upstream request: %+v", got)
+	}
+
+	var completion TextCompletion
+	json.NewDecoder(resp.Body).Decode(&completion)
+	if completion.Model != Code_completion_model {
+		t.Errorf("Expected model %s, got %s", Code_completion_model, completion.Model)
+	}
+}
+
+func TestCompletionsEndpointStreaming(t *testing.T) {
+	var got pkg.CodeCompletionRequest
+	useCodeCompletionUpstream(t, &got)
+
+	resp := postCompletions(t, `{"prompt":"x","stream":true,"stream_options":{"include_usage":true}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	var chunks []TextCompletion
+	var done bool
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+
+		var chunk TextCompletion
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk %s: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if !done {
+		t.Error("Expected the stream to end with [DONE]")
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 2 text chunks and a usage chunk, got %d: %+v", len(chunks), chunks)
+	}
+
+	first, last := chunks[0].Choices[0], chunks[1].Choices[0]
+	if first.Text != "a + " || first.FinishReason != nil {
+		t.Errorf("Unexpected first chunk: %+v", first)
+	}
+	if last.Text != "b" || last.FinishReason == nil || *last.FinishReason != "stop" {
+		t.Errorf("Unexpected last chunk: %+v", last)
+	}
+	if chunks[0].Object != "text_completion" || chunks[0].ID != chunks[1].ID {
+		t.Errorf("Expected text_completion chunks sharing an ID, got %+v", chunks[:2])
+	}
+	if len(chunks[2].Choices) != 0 || chunks[2].Usage == nil || chunks[2].Usage.TotalTokens == 0 {
+		t.Errorf("Unexpected usage chunk: %+v", chunks[2])
+	}
+}
+
+func TestCompletionsEndpointInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid json", `{`},
+		{"missing prompt", `{}`},
+		{"several prompts", `{"prompt":["a","b"]}`},
+		{"token prompt", `{"prompt":[1,2,3]}`},
+		{"invalid stop", `{"prompt":"x","stop":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postCompletions(t, tt.body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCompletionsEndpointUpstreamError(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"rate limited"}}`))
+	})
+
+	resp := postCompletions(t, `{"prompt":"x"}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("Expected Retry-After 3, got %q", resp.Header.Get("Retry-After"))
+	}
+}
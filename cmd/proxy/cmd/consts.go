@@ -1,3 +1,5 @@
 package cmd
 
+// TOKEN_FILE is where earlier versions stored the token, in the working
+// directory. It is moved to the config directory when found.
 const TOKEN_FILE = ".github_copilot_token"
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Config_dir overrides the directory credentials are stored in, which is
+// go-copilot-proxy in the user's config directory ($XDG_CONFIG_HOME or
+// ~/.config on Linux) by default.
+var Config_dir string
+
+// Passphrase_env is the environment variable that holds the passphrase for
+// encrypted credentials. Without it, the passphrase is asked for on the
+// terminal.
+const Passphrase_env = "GO_COPILOT_PROXY_PASSPHRASE"
+
+// token_file_name is the name of the credentials file in a profile
+// directory.
+const token_file_name = "token"
+
+// Key derivation parameters for new encrypted files. They are stored in the
+// file, so they can be raised without breaking existing files.
+const (
+	scrypt_n       = 1 << 15
+	scrypt_r       = 8
+	scrypt_p       = 1
+	scrypt_key_len = 32
+)
+
+// encryptedToken is the on-disk format of a passphrase-encrypted token: the
+// token sealed with AES-256-GCM under a key derived from the passphrase with
+// scrypt.
+type encryptedToken struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// configDir returns the directory credentials are stored in.
+func configDir() (string, error) {
+	if Config_dir != "" {
+		return Config_dir, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-copilot-proxy"), nil
+}
+
+// tokenPath returns the path of the credentials file of profile.
+func tokenPath(profile string) (string, error) {
+	dir, err := profileDir(profile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, token_file_name), nil
+}
+
+// readToken returns the GitHub token stored for profile, migrating a legacy
+// token file first and asking for the passphrase if the token is encrypted.
+// It returns an error satisfying errors.Is(err, os.ErrNotExist) when the
+// profile is not logged in.
+func readToken(profile string) (string, error) {
+	if err := migrateLegacyToken(); err != nil {
+		return "", err
+	}
+
+	path, err := tokenPath(profile)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	restrictPermissions(path)
+
+	if !isEncryptedToken(data) {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	passphrase, err := readPassphrase(false)
+	if err != nil {
+		return "", err
+	}
+	return decryptToken(data, passphrase)
+}
+
+// writeToken stores token for profile, readable only by the current user.
+// With encrypt set, the token is encrypted with a passphrase.
+func writeToken(profile string, token string, encrypt bool) error {
+	data := []byte(token)
+
+	if encrypt {
+		passphrase, err := readPassphrase(true)
+		if err != nil {
+			return err
+		}
+
+		if data, err = encryptToken(token, passphrase); err != nil {
+			return err
+		}
+	}
+
+	path, err := tokenPath(profile)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(path, data)
+}
+
+// tokenExists reports whether a token is stored for profile.
+func tokenExists(profile string) bool {
+	path, err := tokenPath(profile)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// migrateLegacyToken moves the token file left by earlier versions in the
+// working directory to the default profile. It is left alone when the default
+// profile already holds a token.
+func migrateLegacyToken() error {
+	data, err := os.ReadFile(TOKEN_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	path, err := tokenPath(default_profile)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		log.Warn().Msgf("Ignoring legacy token file %s, a token is already stored in %s", TOKEN_FILE, path)
+		return nil
+	}
+
+	if err := writePrivateFile(path, bytes.TrimSpace(data)); err != nil {
+		return err
+	}
+	if err := os.Remove(TOKEN_FILE); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Moved token file %s to %s", TOKEN_FILE, path)
+	return nil
+}
+
+// writePrivateFile atomically replaces path with data, creating its
+// directory if needed. Both are accessible by the current user only.
+func writePrivateFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// CreateTemp creates the file with mode 0600
+	file, err := os.CreateTemp(dir, ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// restrictPermissions tightens the mode of a credentials file that others
+// can access, e.g. after it was copied from another machine.
+func restrictPermissions(path string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm()&0077 == 0 {
+		return
+	}
+
+	log.Warn().Msgf("Token file %s was accessible by other users, restricting it to mode 0600", path)
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Error().Msgf("Error restricting token file permissions: %s", err)
+	}
+}
+
+// readPassphrase returns the passphrase from Passphrase_env or, failing that,
+// asks for it on the terminal, twice when confirm is set.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(Passphrase_env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("the token is encrypted, set %s to its passphrase", Passphrase_env)
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase must not be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, errors.New("the passphrases do not match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+// isEncryptedToken reports whether data is in the encrypted format rather
+// than a plain token.
+func isEncryptedToken(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func encryptToken(token string, passphrase []byte) ([]byte, error) {
+	encrypted := encryptedToken{
+		Version: 1,
+		KDF:     "scrypt",
+		N:       scrypt_n,
+		R:       scrypt_r,
+		P:       scrypt_p,
+		Salt:    make([]byte, 16),
+	}
+	if _, err := rand.Read(encrypted.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := encrypted.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return nil, err
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, []byte(token), nil)
+
+	return json.Marshal(encrypted)
+}
+
+func decryptToken(data []byte, passphrase []byte) (string, error) {
+	var encrypted encryptedToken
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return "", fmt.Errorf("invalid encrypted token file: %w", err)
+	}
+	if encrypted.Version != 1 || encrypted.KDF != "scrypt" {
+		return "", fmt.Errorf("unsupported encrypted token file version %d (%s)", encrypted.Version, encrypted.KDF)
+	}
+
+	aead, err := encrypted.aead(passphrase)
+	if err != nil {
+		return "", err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return "", errors.New("invalid encrypted token file: bad nonce")
+	}
+
+	token, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if err != nil {
+		return "", errors.New("wrong passphrase or corrupted token file")
+	}
+	return string(token), nil
+}
+
+// aead derives the key for the passphrase and returns the AES-GCM cipher.
+func (e encryptedToken) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, e.Salt, e.N, e.R, e.P, scrypt_key_len)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
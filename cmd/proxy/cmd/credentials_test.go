@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// useConfigDir stores credentials in a temporary directory and runs the test
+// from another one, where legacy token files are looked for.
+func useConfigDir(t *testing.T) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "config")
+	originalDir := Config_dir
+	Config_dir = dir
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+
+	t.Cleanup(func() {
+		Config_dir = originalDir
+		os.Chdir(wd)
+	})
+
+	return dir
+}
+
+func TestWriteTokenIsPrivate(t *testing.T) {
+	dir := useConfigDir(t)
+
+	if err := writeToken(default_profile, "gho_token", false); err != nil {
+		t.Fatalf("writeToken failed: %v", err)
+	}
+
+	token, err := readToken(default_profile)
+	if err != nil || token != "gho_token" {
+		t.Errorf("Expected gho_token, got %q, %v", token, err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	path, _ := tokenPath(default_profile)
+	for path, mode := range map[string]os.FileMode{dir: 0700, filepath.Dir(path): 0700, path: 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Expected %s to have mode %o, got %o", path, mode, info.Mode().Perm())
+		}
+	}
+}
+
+func TestReadTokenRestrictsPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on Windows")
+	}
+	useConfigDir(t)
+
+	path, _ := tokenPath(default_profile)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	os.WriteFile(path, []byte("gho_token\n"), 0644)
+	os.Chmod(path, 0644)
+
+	if token, err := readToken(default_profile); err != nil || token != "gho_token" {
+		t.Errorf("Expected gho_token, got %q, %v", token, err)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+}
+
+func TestEncryptedToken(t *testing.T) {
+	useConfigDir(t)
+	t.Setenv(Passphrase_env, "correct horse")
+
+	if err := writeToken(default_profile, "gho_secret", true); err != nil {
+		t.Fatalf("writeToken failed: %v", err)
+	}
+
+	path, _ := tokenPath(default_profile)
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "gho_secret") {
+		t.Error("Expected the token to be encrypted at rest")
+	}
+
+	if token, err := readToken(default_profile); err != nil || token != "gho_secret" {
+		t.Errorf("Expected gho_secret, got %q, %v", token, err)
+	}
+
+	t.Setenv(Passphrase_env, "wrong")
+	if _, err := readToken(default_profile); err == nil {
+		t.Error("Expected an error for the wrong passphrase")
+	}
+}
+
+func TestDecryptTokenRejectsTampering(t *testing.T) {
+	data, err := encryptToken("gho_secret", []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encryptToken failed: %v", err)
+	}
+
+	// Change a character of the base64 ciphertext
+	i := strings.Index(string(data), `"ciphertext":"`) + len(`"ciphertext":"`)
+	tampered := []byte(string(data))
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+
+	if _, err := decryptToken(tampered, []byte("passphrase")); err == nil {
+		t.Error("Expected an error for a tampered file")
+	}
+}
+
+func TestMigrateLegacyToken(t *testing.T) {
+	useConfigDir(t)
+
+	if err := os.WriteFile(TOKEN_FILE, []byte("gho_legacy\n"), 0644); err != nil {
+		t.Fatalf("Failed to write legacy token: %v", err)
+	}
+
+	token, err := readToken(default_profile)
+	if err != nil || token != "gho_legacy" {
+		t.Errorf("Expected gho_legacy, got %q, %v", token, err)
+	}
+
+	if _, err := os.Stat(TOKEN_FILE); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the legacy token file to be removed, got %v", err)
+	}
+
+	if err := removeProfile(default_profile); err != nil {
+		t.Errorf("removeProfile failed: %v", err)
+	}
+	if _, err := readToken(default_profile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not logged in after removing the token, got %v", err)
+	}
+}
+
+func TestMigrateLegacyTokenKeepsStoredToken(t *testing.T) {
+	useConfigDir(t)
+
+	writeToken(default_profile, "gho_current", false)
+	os.WriteFile(TOKEN_FILE, []byte("gho_legacy"), 0600)
+
+	if token, _ := readToken(default_profile); token != "gho_current" {
+		t.Errorf("Expected gho_current, got %q", token)
+	}
+	if _, err := os.Stat(TOKEN_FILE); err != nil {
+		t.Errorf("Expected the legacy token file to be left alone, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// Embeddings_model is used when an embeddings request does not name a model.
+var Embeddings_model = "text-embedding-3-small"
+
+type EmbeddingsPayload struct {
+	Model *string `json:"model,omitempty"`
+	// Input is a single string or an array of strings.
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format,omitempty"`
+	Dimensions     *int64          `json:"dimensions,omitempty"`
+	User           string          `json:"user,omitempty"`
+}
+
+// EmbeddingObject is an embedding in the OpenAI response format. Embedding
+// is a []float64, or a string with encoding_format base64.
+type EmbeddingObject struct {
+	Object    string      `json:"object"`
+	Embedding interface{} `json:"embedding"`
+	Index     int         `json:"index"`
+}
+
+type EmbeddingsResponse struct {
+	Object string             `json:"object"`
+	Data   []EmbeddingObject  `json:"data"`
+	Model  string             `json:"model"`
+	Usage  pkg.EmbeddingUsage `json:"usage"`
+}
+
+func embeddingsHandler(c *fiber.Ctx) error {
+	var payload EmbeddingsPayload
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/v1/embeddings").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("Invalid request payload", errorTypeInvalidRequest, ""))
+	}
+
+	input, ok := parseEmbeddingsInput(payload.Input)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("input must be a non-empty string or array of strings", errorTypeInvalidRequest, ""))
+	}
+
+	if payload.EncodingFormat != "" && payload.EncodingFormat != "float" && payload.EncodingFormat != "base64" {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("encoding_format must be float or base64", errorTypeInvalidRequest, ""))
+	}
+
+	model := Embeddings_model
+	if payload.Model != nil {
+		model = *payload.Model
+	}
+
+	request := pkg.EmbeddingRequest{
+		Model:      model,
+		Input:      input,
+		Dimensions: payload.Dimensions,
+		User:       payload.User,
+	}
+
+	ctx, cancel := context.WithCancel(c.UserContext())
+	defer cancel()
+
+	var embeddings pkg.EmbeddingResponse
+	err := withSession(ctx, func(token string) (err error) {
+		embeddings, err = client.EmbeddingsContext(ctx, token, request)
+		return err
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("model", model).
+			Int("inputs", len(input)).
+			Msg("Failed to get embeddings")
+		return sendUpstreamError(c, err)
+	}
+
+	response := EmbeddingsResponse{
+		Object: "list",
+		Data:   make([]EmbeddingObject, 0, len(embeddings.Data)),
+		Model:  embeddings.Model,
+		Usage:  embeddings.Usage,
+	}
+
+	for _, embedding := range embeddings.Data {
+		var vector interface{} = embedding.Embedding
+		if payload.EncodingFormat == "base64" {
+			vector = embedding.Base64()
+		}
+
+		response.Data = append(response.Data, EmbeddingObject{
+			Object:    "embedding",
+			Embedding: vector,
+			Index:     embedding.Index,
+		})
+	}
+
+	return c.JSON(response)
+}
+
+// parseEmbeddingsInput accepts a string or a non-empty array of strings.
+func parseEmbeddingsInput(raw json.RawMessage) ([]string, bool) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, single != ""
+	}
+
+	var batch []string
+	if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+		return nil, false
+	}
+
+	for _, input := range batch {
+		if input == "" {
+			return nil, false
+		}
+	}
+
+	return batch, true
+}
@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+func TestEmbeddingsEndpoint(t *testing.T) {
+	var upstreamRequest pkg.EmbeddingRequest
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		resp := pkg.EmbeddingResponse{Object: "list", Model: upstreamRequest.Model}
+		for i := range upstreamRequest.Input {
+			resp.Data = append(resp.Data, pkg.Embedding{Object: "embedding", Embedding: []float64{float64(i), 0.5}, Index: i})
+		}
+		resp.Usage = pkg.EmbeddingUsage{PromptTokens: 4, TotalTokens: 4}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	tests := []struct {
+		name      string
+		body      string
+		wantInput []string
+		model     string
+	}{
+		{"string", `{"input":"hello"}`, []string{"hello"}, Embeddings_model},
+		{"array", `{"model":"text-embedding-3-large","input":["hello","world"],"dimensions":256}`, []string{"hello", "world"}, "text-embedding-3-large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := newApp().Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+
+			if fmt.Sprint(upstreamRequest.Input) != fmt.Sprint(tt.wantInput) || upstreamRequest.Model != tt.model {
+				t.Errorf("Unexpected upstream request: %+v", upstreamRequest)
+			}
+
+			var embeddings struct {
+				Object string `json:"object"`
+				Data   []struct {
+					Object    string    `json:"object"`
+					Embedding []float64 `json:"embedding"`
+					Index     int       `json:"index"`
+				} `json:"data"`
+				Model string             `json:"model"`
+				Usage pkg.EmbeddingUsage `json:"usage"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			if embeddings.Object != "list" || embeddings.Model != tt.model || embeddings.Usage.TotalTokens != 4 {
+				t.Errorf("Unexpected response: %+v", embeddings)
+			}
+			if len(embeddings.Data) != len(tt.wantInput) {
+				t.Fatalf("Expected %d embeddings, got %d", len(tt.wantInput), len(embeddings.Data))
+			}
+			for i, embedding := range embeddings.Data {
+				if embedding.Object != "embedding" || embedding.Index != i || embedding.Embedding[1] != 0.5 {
+					t.Errorf("Unexpected embedding %d: %+v", i, embedding)
+				}
+			}
+		})
+	}
+
+	if upstreamRequest.Dimensions == nil || *upstreamRequest.Dimensions != 256 {
+		t.Errorf("Expected dimensions to be forwarded, got %v", upstreamRequest.Dimensions)
+	}
+}
+
+func TestEmbeddingsEndpointBase64(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object":"list","model":"text-embedding-3-small","data":[{"object":"embedding","index":0,"embedding":[0.5,-2]}],"usage":{"prompt_tokens":1,"total_tokens":1}}`)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(`{"input":"hello","encoding_format":"base64"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var embeddings struct {
+		Data []struct {
+			Embedding string `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(embeddings.Data) != 1 {
+		t.Fatalf("Expected 1 embedding, got %d", len(embeddings.Data))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(embeddings.Data[0].Embedding)
+	if err != nil || len(data) != 8 {
+		t.Fatalf("Expected 8 bytes of base64 data, got %d (%v)", len(data), err)
+	}
+	if math.Float32frombits(binary.LittleEndian.Uint32(data)) != 0.5 || math.Float32frombits(binary.LittleEndian.Uint32(data[4:])) != -2 {
+		t.Errorf("Unexpected vector %v", data)
+	}
+}
+
+func TestEmbeddingsEndpointValidation(t *testing.T) {
+	upstreamCalled := false
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+	})
+
+	for _, body := range []string{
+		`{}`,
+		`{"input":""}`,
+		`{"input":[]}`,
+		`{"input":["hello",""]}`,
+		`{"input":[1,2,3]}`,
+		`{"input":"hello","encoding_format":"int8"}`,
+		`{"input":`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := newApp().Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	if upstreamCalled {
+		t.Error("Expected invalid requests to be rejected before reaching upstream")
+	}
+}
+
+func TestEmbeddingsEndpointUpstreamError(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"Slow down","code":"rate_limited"}}`)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(`{"input":"hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", resp.StatusCode)
+	}
+}
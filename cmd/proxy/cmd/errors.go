@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// OpenAI error types returned to clients.
+const (
+	errorTypeAuthentication = "authentication_error"
+	errorTypeInvalidRequest = "invalid_request_error"
+	errorTypeNotFound       = "not_found_error"
+	errorTypePermission     = "permission_error"
+	errorTypeRateLimit      = "rate_limit_error"
+	errorTypeServer         = "server_error"
+)
+
+// errorObject builds an OpenAI style error body.
+func errorObject(message, errorType, code string) fiber.Map {
+	var errorCode interface{}
+	if code != "" {
+		errorCode = code
+	}
+
+	return fiber.Map{
+		"error": fiber.Map{
+			"message": message,
+			"type":    errorType,
+			"param":   nil,
+			"code":    errorCode,
+		},
+	}
+}
+
+// upstreamError maps an error returned by the Copilot client onto the HTTP
+// status and OpenAI style error object the proxy sends back.
+func upstreamError(err error) (int, fiber.Map) {
+	var apiErr *pkg.APIError
+	if !errors.As(err, &apiErr) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fiber.StatusGatewayTimeout, errorObject(fmt.Sprintf("Failed to process chat request: %v", err), errorTypeServer, "")
+		}
+		return fiber.StatusBadGateway, errorObject(fmt.Sprintf("Failed to process chat request: %v", err), errorTypeServer, "")
+	}
+
+	message := apiErr.Message
+	if message == "" {
+		message = apiErr.Error()
+	}
+
+	status := apiErr.StatusCode
+	var errorType string
+
+	switch {
+	case status == fiber.StatusUnauthorized:
+		errorType = errorTypeAuthentication
+	case status == fiber.StatusForbidden:
+		errorType = errorTypePermission
+	case status == fiber.StatusNotFound:
+		errorType = errorTypeNotFound
+	case status == fiber.StatusTooManyRequests:
+		errorType = errorTypeRateLimit
+	case status >= 400 && status < 500:
+		errorType = errorTypeInvalidRequest
+	case status >= 500 && status < 600:
+		errorType = errorTypeServer
+	default:
+		// Anything else is unexpected from an API that should answer 200
+		status = fiber.StatusBadGateway
+		errorType = errorTypeServer
+	}
+
+	return status, errorObject(message, errorType, apiErr.Code)
+}
+
+// upstreamErrorMessage returns the status and message of the mapped upstream
+// error, for routes that report errors in another format than OpenAI's.
+func upstreamErrorMessage(err error) (int, string) {
+	status, body := upstreamError(err)
+
+	if errorBody, ok := body["error"].(fiber.Map); ok {
+		if message, ok := errorBody["message"].(string); ok {
+			return status, message
+		}
+	}
+	return status, err.Error()
+}
+
+// sendUpstreamError writes the mapped upstream error to the client, passing
+// through any Retry-After hint.
+func sendUpstreamError(c *fiber.Ctx, err error) error {
+	setRetryAfter(c, err)
+
+	status, body := upstreamError(err)
+	return c.Status(status).JSON(body)
+}
+
+// setRetryAfter passes the Retry-After hint of an upstream error on to the
+// client.
+func setRetryAfter(c *fiber.Ctx, err error) {
+	var apiErr *pkg.APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+	}
+}
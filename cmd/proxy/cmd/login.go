@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
@@ -10,8 +13,29 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// Login_encrypt encrypts the stored token with a passphrase.
+var Login_encrypt bool
+
+// Timings of the device flow in seconds, for servers that do not send them
+// (RFC 8628, sections 3.2 and 3.5).
+const (
+	default_device_interval   = 5
+	default_device_expires_in = 900
+	slow_down_increment       = 5
+)
+
+// device_time_unit is the unit of the device flow timings. Tests shorten it.
+var device_time_unit = time.Second
+
+var (
+	errDeviceCodeExpired = errors.New("the device code expired")
+	errAccessDenied      = errors.New("authorization was denied")
+)
+
 func init() {
 	rootCmd.AddCommand(loginCmd)
+
+	loginCmd.Flags().BoolVar(&Login_encrypt, "encrypt", false, "encrypt the stored token with a passphrase (read from "+Passphrase_env+" or the terminal)")
 }
 
 var loginCmd = &cobra.Command{
@@ -20,58 +44,143 @@ var loginCmd = &cobra.Command{
 	Long:  `Login to GitHub Copilot using your GitHub account.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		client = pkg.NewClient(pkg.WithLogger(log.Logger))
+
 		log.Info().Msg("Authorizing user with Copilot")
 
-		if _, err := os.Stat(".github_copilot_token"); err == nil {
-			log.Error().Msg("You are already logged in.")
+		if err := migrateLegacyToken(); err != nil {
+			log.Error().Msgf("Error migrating token file: %s", err)
+			return
+		}
+
+		profile, err := activeProfile()
+		if err != nil {
+			log.Error().Msgf("Error selecting profile: %s", err)
+			return
+		}
+
+		if tokenExists(profile) {
+			log.Error().Msgf("You are already logged in with profile %s.", profile)
 			return
 		}
 
-		loginResponse, err := pkg.Login()
+		loginResponse, err := client.Login()
 		if err != nil {
 			log.Error().Msgf("Error logging in: %s", err)
 			return
 		}
 
 		log.Info().Msgf("Please visit %s to authenticate and enter the code: %s", loginResponse.VerificationURI, loginResponse.UserCode)
+		if loginResponse.ExpiresIn > 0 {
+			log.Info().Msgf("The code expires in %d minutes", loginResponse.ExpiresIn/60)
+		}
+
+		authResponse, err := awaitAuthorization(context.Background(), loginResponse)
+		switch {
+		case errors.Is(err, errDeviceCodeExpired):
+			log.Error().Msg("The code expired before it was entered, please run login again")
+			return
+		case errors.Is(err, errAccessDenied):
+			log.Error().Msg("Authorization was denied, no token was stored")
+			return
+		case err != nil:
+			log.Error().Msgf("Error authenticating: %s", err)
+			return
+		}
+
+		log.Info().Msg("Authenticated successfully!")
 
-		// Sleep for the interval time
-		time.Sleep(time.Duration(loginResponse.Interval+1) * time.Second)
+		// Store the token in the config directory
+		if err := writeToken(profile, authResponse.AccessToken, Login_encrypt); err != nil {
+			log.Error().Msgf("Error writing token to file: %s", err)
+			return
+		}
 
-		var authResponse pkg.AuthenticationResponse
+		// Remember who the token belongs to so that profiles can be told apart
+		var info profileInfo
+		if user, err := client.GetUser(authResponse.AccessToken); err != nil {
+			log.Warn().Msgf("Error looking up GitHub user: %s", err)
+		} else {
+			info.Username = user.Login
+		}
+		if err := writeProfileInfo(profile, info); err != nil {
+			log.Error().Msgf("Error writing profile: %s", err)
+			return
+		}
 
-		for {
-			authResponse, err = pkg.Authenticate(loginResponse)
-			if err != nil {
-				log.Error().Msgf("Error authenticating: %s", err)
+		// The first profile becomes the active one
+		if !hasCurrentProfile() {
+			if err := setCurrentProfile(profile); err != nil {
+				log.Error().Msgf("Error switching profile: %s", err)
 				return
 			}
+		}
 
-			if authResponse.AccessToken != "" {
-				log.Info().Msg("Authenticated successfully!")
-				break
-			}
+		path, _ := tokenPath(profile)
+		if info.Username != "" {
+			log.Info().Msgf("Logged in as %s, stored token for profile %s in %s", info.Username, profile, path)
+		} else {
+			log.Info().Msgf("Stored token for profile %s in %s", profile, path)
+		}
+	},
+}
 
-			// If the interval is 0, set it to 5
-			if authResponse.Interval == 0 {
-				authResponse.Interval = 5
-			}
+// awaitAuthorization polls for the access token of a device code until the
+// user authorizes or denies it, or the code expires. It waits the interval
+// asked for by the server between polls and slows down when told to.
+func awaitAuthorization(ctx context.Context, login pkg.LoginResponse) (pkg.AuthenticationResponse, error) {
+	interval := login.Interval
+	if interval <= 0 {
+		interval = default_device_interval
+	}
+
+	expiresIn := login.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = default_device_expires_in
+	}
+	expiresAt := time.Now().Add(time.Duration(expiresIn) * device_time_unit)
 
-			// Sleep for the interval time
-			time.Sleep(time.Duration(authResponse.Interval+1) * time.Second)
+	for {
+		wait := time.Duration(interval) * device_time_unit
+		if time.Now().Add(wait).After(expiresAt) {
+			return pkg.AuthenticationResponse{}, errDeviceCodeExpired
 		}
 
-		// Write the token to a file
-		file, err := os.Create(TOKEN_FILE)
-		if err != nil {
-			log.Error().Msgf("Error creating token file: %s", err)
-			return
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return pkg.AuthenticationResponse{}, ctx.Err()
+		case <-timer.C:
 		}
 
-		_, err = file.WriteString(authResponse.AccessToken)
+		authResponse, err := client.AuthenticateContext(ctx, login)
 		if err != nil {
-			log.Error().Msgf("Error writing token to file: %s", err)
-			return
+			return authResponse, err
 		}
-	},
+
+		switch authResponse.Error {
+		case "":
+			if authResponse.AccessToken == "" {
+				return authResponse, errors.New("no access token in response")
+			}
+			return authResponse, nil
+		case pkg.DeviceFlowAuthorizationPending:
+			log.Debug().Msg("Waiting for the code to be entered")
+		case pkg.DeviceFlowSlowDown:
+			// The increase applies to every later poll, and GitHub sends the
+			// new interval along
+			interval = max(interval+slow_down_increment, authResponse.Interval)
+			log.Warn().Msgf("Polling too fast, waiting %d seconds between attempts", interval)
+		case pkg.DeviceFlowExpiredToken:
+			return authResponse, errDeviceCodeExpired
+		case pkg.DeviceFlowAccessDenied:
+			return authResponse, errAccessDenied
+		default:
+			if authResponse.ErrorDescription != "" {
+				return authResponse, fmt.Errorf("%s: %s", authResponse.Error, authResponse.ErrorDescription)
+			}
+			return authResponse, errors.New(authResponse.Error)
+		}
+	}
 }
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// useDeviceFlow points the shared client at a mock OAuth server answering
+// polls with responses in turn, and counts device flow time in milliseconds.
+// The returned function reports the times of the polls so far.
+func useDeviceFlow(t *testing.T, responses ...pkg.AuthenticationResponse) func() []time.Time {
+	t.Helper()
+
+	var mu sync.Mutex
+	var polls []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login/oauth/access_token" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+
+		mu.Lock()
+		polls = append(polls, time.Now())
+		response := responses[min(len(polls), len(responses))-1]
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	originalClient, originalUnit := client, device_time_unit
+	client = pkg.NewClient(pkg.WithGitHubURL(server.URL))
+	device_time_unit = time.Millisecond
+
+	t.Cleanup(func() {
+		client, device_time_unit = originalClient, originalUnit
+		server.Close()
+	})
+
+	return func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]time.Time(nil), polls...)
+	}
+}
+
+func TestAwaitAuthorization(t *testing.T) {
+	pending := pkg.AuthenticationResponse{Error: pkg.DeviceFlowAuthorizationPending}
+	getPolls := useDeviceFlow(t, pending, pending, pkg.AuthenticationResponse{AccessToken: "access-token"})
+
+	start := time.Now()
+	authResponse, err := awaitAuthorization(context.Background(), pkg.LoginResponse{DeviceCode: "device-code", Interval: 20, ExpiresIn: 900})
+	if err != nil {
+		t.Fatalf("Expected authorization to succeed, got %v", err)
+	}
+
+	if authResponse.AccessToken != "access-token" {
+		t.Errorf("Expected access-token, got %q", authResponse.AccessToken)
+	}
+	if polls := getPolls(); len(polls) != 3 {
+		t.Errorf("Expected 3 polls, got %d", len(polls))
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected to wait the interval before every poll, took %s", elapsed)
+	}
+}
+
+func TestAwaitAuthorizationSlowsDown(t *testing.T) {
+	getPolls := useDeviceFlow(t,
+		pkg.AuthenticationResponse{Error: pkg.DeviceFlowSlowDown},
+		pkg.AuthenticationResponse{Error: pkg.DeviceFlowSlowDown, Interval: 40},
+		pkg.AuthenticationResponse{AccessToken: "access-token"},
+	)
+
+	if _, err := awaitAuthorization(context.Background(), pkg.LoginResponse{DeviceCode: "device-code", Interval: 10, ExpiresIn: 900}); err != nil {
+		t.Fatalf("Expected authorization to succeed, got %v", err)
+	}
+
+	polls := getPolls()
+	if len(polls) != 3 {
+		t.Fatalf("Expected 3 polls, got %d", len(polls))
+	}
+
+	// The interval grows by 5 after the first slow_down and follows the
+	// server's larger one after the second
+	if gap := polls[1].Sub(polls[0]); gap < 15*time.Millisecond {
+		t.Errorf("Expected at least 15ms between the first polls, got %s", gap)
+	}
+	if gap := polls[2].Sub(polls[1]); gap < 40*time.Millisecond {
+		t.Errorf("Expected at least 40ms between the last polls, got %s", gap)
+	}
+}
+
+func TestAwaitAuthorizationOutcomes(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    pkg.AuthenticationResponse
+		expiresIn   int
+		expectedErr error
+		expectedMsg string
+	}{
+		{
+			name:        "Expired token",
+			response:    pkg.AuthenticationResponse{Error: pkg.DeviceFlowExpiredToken},
+			expiresIn:   900,
+			expectedErr: errDeviceCodeExpired,
+		},
+		{
+			name:        "Access denied",
+			response:    pkg.AuthenticationResponse{Error: pkg.DeviceFlowAccessDenied},
+			expiresIn:   900,
+			expectedErr: errAccessDenied,
+		},
+		{
+			name:        "Code expires while pending",
+			response:    pkg.AuthenticationResponse{Error: pkg.DeviceFlowAuthorizationPending},
+			expiresIn:   50,
+			expectedErr: errDeviceCodeExpired,
+		},
+		{
+			name:        "Other error",
+			response:    pkg.AuthenticationResponse{Error: "incorrect_device_code", ErrorDescription: "The device_code provided is not valid."},
+			expiresIn:   900,
+			expectedMsg: "incorrect_device_code: The device_code provided is not valid.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useDeviceFlow(t, tt.response)
+
+			_, err := awaitAuthorization(context.Background(), pkg.LoginResponse{DeviceCode: "device-code", Interval: 10, ExpiresIn: tt.expiresIn})
+			if err == nil {
+				t.Fatal("Expected authorization to fail")
+			}
+
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Expected %v, got %v", tt.expectedErr, err)
+			}
+			if tt.expectedMsg != "" && err.Error() != tt.expectedMsg {
+				t.Errorf("Expected %q, got %q", tt.expectedMsg, err.Error())
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -15,19 +16,29 @@ func init() {
 var logoutCmd = &cobra.Command{
 	Use:   "logout",
 	Short: "Logout of GitHub Copilot",
-	Long:  `Logs you out of GitHub Copilot by deleting the token file.`,
+	Long:  `Logs you out of GitHub Copilot by deleting the stored token of the profile.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		log.Info().Msg("Logging out of GitHub Copilot")
 
-		if _, err := os.Stat(TOKEN_FILE); err != nil {
-			log.Error().Msg("You are not logged in.")
+		if err := migrateLegacyToken(); err != nil {
+			log.Error().Msgf("Error migrating token file: %s", err)
 			return
 		}
 
-		err := os.Remove(TOKEN_FILE)
+		profile, err := activeProfile()
 		if err != nil {
-			log.Error().Msg("Failed to log out.")
+			log.Error().Msgf("Error selecting profile: %s", err)
+			return
+		}
+
+		err = removeProfile(profile)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Error().Msgf("You are not logged in with profile %s.", profile)
+			return
+		}
+		if err != nil {
+			log.Error().Msgf("Failed to log out: %s", err)
 			return
 		}
 	},
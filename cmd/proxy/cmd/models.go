@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// Models_cache_ttl is how long the Copilot model catalog is served from
+// memory before it is fetched again.
+var Models_cache_ttl = 10 * time.Minute
+
+// modelCatalog is the cached Copilot model catalog shared by all handlers.
+var modelCatalog = newModelCache()
+
+// ModelObject is a model in the OpenAI list format, extended with the
+// capabilities Copilot reports.
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	Name            string             `json:"name,omitempty"`
+	Version         string             `json:"version,omitempty"`
+	Type            string             `json:"type,omitempty"`
+	ContextWindow   int64              `json:"context_window,omitempty"`
+	MaxPromptTokens int64              `json:"max_prompt_tokens,omitempty"`
+	MaxOutputTokens int64              `json:"max_output_tokens,omitempty"`
+	Capabilities    *pkg.ModelSupports `json:"capabilities,omitempty"`
+}
+
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+// models_fetch_timeout bounds a single catalog request.
+var models_fetch_timeout = 30 * time.Second
+
+// modelCache holds the model catalog for Models_cache_ttl. When a refresh
+// fails the previous catalog keeps being served.
+type modelCache struct {
+	mu        sync.Mutex
+	models    []pkg.Model
+	fetchedAt time.Time
+	inflight  *modelRefresh
+}
+
+// modelRefresh is a catalog request shared by every caller that needs the
+// catalog while it is in flight.
+type modelRefresh struct {
+	done   chan struct{}
+	models []pkg.Model
+	err    error
+}
+
+func newModelCache() *modelCache {
+	return &modelCache{}
+}
+
+// get returns the catalog, fetching it when it is missing or stale. The lock
+// is not held during the fetch, so that a slow upstream only delays the
+// callers that need the new catalog, and they share a single request.
+func (m *modelCache) get(ctx context.Context) ([]pkg.Model, error) {
+	m.mu.Lock()
+	if m.models != nil && time.Since(m.fetchedAt) < Models_cache_ttl {
+		models := m.models
+		m.mu.Unlock()
+		return models, nil
+	}
+
+	call := m.inflight
+	if call == nil {
+		call = &modelRefresh{done: make(chan struct{})}
+		m.inflight = call
+		go m.fetch(call)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.models, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch requests the catalog for call. The request is not bound to the
+// context of any caller, so that a caller giving up does not fail it for
+// everyone else.
+func (m *modelCache) fetch(call *modelRefresh) {
+	ctx, cancel := context.WithTimeout(context.Background(), models_fetch_timeout)
+	defer cancel()
+
+	var models []pkg.Model
+	err := withSession(ctx, func(token string) (err error) {
+		models, err = client.ListModelsContext(ctx, token)
+		return err
+	})
+
+	m.mu.Lock()
+	switch {
+	case err == nil:
+		m.models = models
+		m.fetchedAt = time.Now()
+	case m.models != nil:
+		log.Warn().Err(err).Msg("Failed to refresh models, serving cached catalog")
+		models, err = m.models, nil
+	}
+	m.inflight = nil
+	m.mu.Unlock()
+
+	call.models, call.err = models, err
+	close(call.done)
+}
+
+// find returns the catalog entry with the given ID.
+func (m *modelCache) find(ctx context.Context, id string) (pkg.Model, bool, error) {
+	models, err := m.get(ctx)
+	if err != nil {
+		return pkg.Model{}, false, err
+	}
+
+	for _, model := range models {
+		if model.ID == id {
+			return model, true, nil
+		}
+	}
+	return pkg.Model{}, false, nil
+}
+
+func modelsHandler(c *fiber.Ctx) error {
+	models, err := modelCatalog.get(c.UserContext())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list models")
+		return sendUpstreamError(c, err)
+	}
+
+	list := ModelList{Object: "list", Data: []ModelObject{}}
+	seen := map[string]bool{}
+	for _, model := range models {
+		// Copilot may list several versions under the same ID
+		if seen[model.ID] {
+			continue
+		}
+		seen[model.ID] = true
+		list.Data = append(list.Data, modelObject(model))
+	}
+
+	return c.JSON(list)
+}
+
+func modelHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	model, ok, err := modelCatalog.find(c.UserContext(), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list models")
+		return sendUpstreamError(c, err)
+	}
+	if ok {
+		return c.JSON(modelObject(model))
+	}
+
+	return c.Status(fiber.StatusNotFound).JSON(errorObject("The model '"+id+"' does not exist", errorTypeInvalidRequest, "model_not_found"))
+}
+
+func modelObject(model pkg.Model) ModelObject {
+	object := ModelObject{
+		ID:              model.ID,
+		Object:          "model",
+		OwnedBy:         model.Vendor,
+		Name:            model.Name,
+		Version:         model.Version,
+		Type:            model.Capabilities.Type,
+		ContextWindow:   model.Capabilities.Limits.MaxContextWindowTokens,
+		MaxPromptTokens: model.Capabilities.Limits.MaxPromptTokens,
+		MaxOutputTokens: model.Capabilities.Limits.MaxOutputTokens,
+	}
+
+	if object.OwnedBy == "" {
+		object.OwnedBy = "github-copilot"
+	}
+
+	if model.Capabilities.Supports != (pkg.ModelSupports{}) {
+		supports := model.Capabilities.Supports
+		object.Capabilities = &supports
+	}
+
+	return object
+}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+const testModelCatalog = `{"object":"list","data":[
+	{"id":"gpt-4o","name":"GPT-4o","object":"model","vendor":"Azure OpenAI","version":"gpt-4o-2024-11-20",
+	 "capabilities":{"family":"gpt-4o","type":"chat","limits":{"max_context_window_tokens":128000,"max_output_tokens":16384,"max_prompt_tokens":64000},
+	 "supports":{"streaming":true,"tool_calls":true,"vision":true}}},
+	{"id":"gpt-4o","name":"GPT-4o","object":"model","vendor":"Azure OpenAI","version":"gpt-4o-2024-05-13","capabilities":{"type":"chat"}},
+	{"id":"claude-3.7-sonnet","name":"Claude 3.7 Sonnet","object":"model","vendor":"Anthropic",
+	 "capabilities":{"family":"claude-3.7-sonnet","type":"chat","limits":{"max_context_window_tokens":200000},"supports":{"streaming":true,"tool_calls":true,"vision":false}}},
+	{"id":"text-embedding-3-small","object":"model","capabilities":{"type":"embeddings"}}
+]}`
+
+// useModelCatalog serves testModelCatalog from a mock Copilot API with an
+// empty model cache and returns a counter of upstream requests.
+func useModelCatalog(t *testing.T, status int) *int {
+	t.Helper()
+
+	requests := 0
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/models" {
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, testModelCatalog)
+		} else {
+			fmt.Fprint(w, `{"error":{"message":"upstream failure"}}`)
+		}
+	})
+
+	originalCatalog := modelCatalog
+	modelCatalog = newModelCache()
+	t.Cleanup(func() {
+		modelCatalog = originalCatalog
+	})
+
+	return &requests
+}
+
+func getJSON(t *testing.T, path string, v interface{}) int {
+	t.Helper()
+
+	resp, err := newApp().Test(httptest.NewRequest(http.MethodGet, path, nil))
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", string(body), err)
+	}
+
+	return resp.StatusCode
+}
+
+func TestModelsEndpoint(t *testing.T) {
+	useModelCatalog(t, http.StatusOK)
+
+	var list ModelList
+	if status := getJSON(t, "/v1/models", &list); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	if list.Object != "list" {
+		t.Errorf("Expected object list, got %s", list.Object)
+	}
+
+	// Duplicate IDs are listed once
+	if len(list.Data) != 3 {
+		t.Fatalf("Expected 3 models, got %d: %+v", len(list.Data), list.Data)
+	}
+
+	model := list.Data[0]
+	if model.ID != "gpt-4o" || model.Object != "model" || model.OwnedBy != "Azure OpenAI" || model.Version != "gpt-4o-2024-11-20" {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	if model.ContextWindow != 128000 || model.MaxOutputTokens != 16384 || model.MaxPromptTokens != 64000 {
+		t.Errorf("Unexpected limits: %+v", model)
+	}
+	if model.Capabilities == nil || !*model.Capabilities.Vision || !*model.Capabilities.ToolCalls {
+		t.Errorf("Expected vision and tool call support, got %+v", model.Capabilities)
+	}
+
+	if claude := list.Data[1]; claude.Capabilities == nil || *claude.Capabilities.Vision {
+		t.Errorf("Expected no vision support for claude, got %+v", claude.Capabilities)
+	}
+
+	embedding := list.Data[2]
+	if embedding.OwnedBy != "github-copilot" || embedding.Type != "embeddings" || embedding.Capabilities != nil {
+		t.Errorf("Unexpected embedding model: %+v", embedding)
+	}
+}
+
+func TestModelEndpoint(t *testing.T) {
+	useModelCatalog(t, http.StatusOK)
+
+	var model ModelObject
+	if status := getJSON(t, "/v1/models/claude-3.7-sonnet", &model); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if model.ID != "claude-3.7-sonnet" || model.OwnedBy != "Anthropic" || model.ContextWindow != 200000 {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+
+	var errorResp struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if status := getJSON(t, "/v1/models/unknown-model", &errorResp); status != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", status)
+	}
+	if errorResp.Error.Code != "model_not_found" || errorResp.Error.Type != "invalid_request_error" {
+		t.Errorf("Unexpected error: %+v", errorResp.Error)
+	}
+}
+
+func TestModelsEndpointCachesCatalog(t *testing.T) {
+	requests := useModelCatalog(t, http.StatusOK)
+
+	var list ModelList
+	getJSON(t, "/v1/models", &list)
+	getJSON(t, "/v1/models", &list)
+	var model ModelObject
+	getJSON(t, "/v1/models/gpt-4o", &model)
+
+	if *requests != 1 {
+		t.Errorf("Expected the catalog to be fetched once, got %d requests", *requests)
+	}
+
+	// An expired catalog is fetched again
+	modelCatalog.fetchedAt = time.Now().Add(-Models_cache_ttl)
+	getJSON(t, "/v1/models", &list)
+
+	if *requests != 2 {
+		t.Errorf("Expected the expired catalog to be fetched again, got %d requests", *requests)
+	}
+}
+
+func TestModelsEndpointUpstreamError(t *testing.T) {
+	useModelCatalog(t, http.StatusServiceUnavailable)
+
+	var errorResp map[string]interface{}
+	if status := getJSON(t, "/v1/models", &errorResp); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", status)
+	}
+
+	// A stale catalog is served rather than an error
+	modelCatalog.models = []pkg.Model{{ID: "gpt-4o"}}
+
+	var list ModelList
+	if status := getJSON(t, "/v1/models", &list); status != http.StatusOK {
+		t.Fatalf("Expected status 200 with a stale catalog, got %d", status)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != "gpt-4o" {
+		t.Errorf("Expected the stale catalog, got %+v", list.Data)
+	}
+}
+
+func TestModelCacheSharesOneFetch(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, testModelCatalog)
+	})
+
+	cache := newModelCache()
+
+	// A caller that gives up is not held by the slow fetch
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cache.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the caller to give up, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			models, err := cache.get(context.Background())
+			if err == nil && len(models) == 0 {
+				err = errors.New("empty catalog")
+			}
+			errs <- err
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected the catalog, got %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected every caller to share one fetch, got %d requests", requests)
+	}
+}
@@ -0,0 +1,671 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// OllamaChatRequest is the body of an Ollama /api/chat request.
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []pkg.Tool      `json:"tools,omitempty"`
+	// Format is "json" or a JSON schema.
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	// Stream defaults to true, as in Ollama.
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// OllamaGenerateRequest is the body of an Ollama /api/generate request.
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images holds base64 encoded images without a data URL prefix.
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	// ToolName names the tool a tool message answers.
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+type OllamaToolCall struct {
+	Function OllamaFunctionCall `json:"function"`
+}
+
+type OllamaFunctionCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// OllamaOptions holds the model options that have a Copilot equivalent;
+// the others are ignored.
+type OllamaOptions struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Seed             *int64   `json:"seed,omitempty"`
+	NumPredict       *int64   `json:"num_predict,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model     string        `json:"model"`
+	CreatedAt time.Time     `json:"created_at"`
+	Message   OllamaMessage `json:"message"`
+	OllamaDone
+}
+
+type OllamaGenerateResponse struct {
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+	Response  string    `json:"response"`
+	OllamaDone
+}
+
+// OllamaDone holds the fields Ollama sets on the last response of a
+// generation.
+type OllamaDone struct {
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	PromptEvalCount int64  `json:"prompt_eval_count,omitempty"`
+	EvalCount       int64  `json:"eval_count,omitempty"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+// OllamaShowRequest names a model; Name is the deprecated spelling of Model.
+type OllamaShowRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name"`
+}
+
+type OllamaShowResponse struct {
+	Modelfile    string                 `json:"modelfile"`
+	Parameters   string                 `json:"parameters"`
+	Template     string                 `json:"template"`
+	Details      OllamaModelDetails     `json:"details"`
+	ModelInfo    map[string]interface{} `json:"model_info"`
+	Capabilities []string               `json:"capabilities"`
+	ModifiedAt   time.Time              `json:"modified_at"`
+}
+
+// payload translates the request into the payload of the chat pipeline.
+func (r OllamaChatRequest) payload() (Payload, error) {
+	stream := true
+	if r.Stream != nil {
+		stream = *r.Stream
+	}
+
+	payload := Payload{
+		Model:  ollamaModel(r.Model),
+		Tools:  r.Tools,
+		Stream: &stream,
+	}
+
+	if o := r.Options; o != nil {
+		payload.Temperature = o.Temperature
+		payload.TopP = o.TopP
+		payload.Seed = o.Seed
+		payload.PresencePenalty = o.PresencePenalty
+		payload.FrequencyPenalty = o.FrequencyPenalty
+		// Ollama uses -1 and -2 for no limit and filling the context
+		if o.NumPredict != nil && *o.NumPredict > 0 {
+			payload.MaxTokens = o.NumPredict
+		}
+		if len(o.Stop) > 0 {
+			payload.Stop = o.Stop
+		}
+	}
+
+	format, err := ollamaResponseFormat(r.Format)
+	if err != nil {
+		return payload, err
+	}
+	payload.ResponseFormat = format
+
+	payload.Messages, err = ollamaMessages(r.Messages)
+	return payload, err
+}
+
+// payload translates the request into the payload of the chat pipeline,
+// with the prompt as the only user message.
+func (r OllamaGenerateRequest) payload() (Payload, error) {
+	var messages []OllamaMessage
+	if r.System != "" {
+		messages = append(messages, OllamaMessage{Role: "system", Content: r.System})
+	}
+	messages = append(messages, OllamaMessage{Role: "user", Content: r.Prompt, Images: r.Images})
+
+	return OllamaChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Format:   r.Format,
+		Options:  r.Options,
+		Stream:   r.Stream,
+	}.payload()
+}
+
+// ollamaModel returns the Copilot model for an Ollama model name, dropping
+// the default tag.
+func ollamaModel(name string) *string {
+	name = strings.TrimSuffix(name, ":latest")
+	if name == "" {
+		return nil
+	}
+	return &name
+}
+
+func ollamaResponseFormat(format json.RawMessage) (*pkg.ResponseFormat, error) {
+	if len(format) == 0 || string(format) == "null" || string(format) == `""` {
+		return nil, nil
+	}
+
+	if string(format) == `"json"` {
+		return &pkg.ResponseFormat{Type: "json_object"}, nil
+	}
+
+	if format[0] != '{' {
+		return nil, fmt.Errorf("format: expected \"json\" or a JSON schema")
+	}
+
+	schema, err := json.Marshal(map[string]interface{}{"name": "response", "schema": format})
+	if err != nil {
+		return nil, err
+	}
+	return &pkg.ResponseFormat{Type: "json_schema", JSONSchema: schema}, nil
+}
+
+// ollamaMessages translates Ollama messages into chat messages. Ollama does
+// not identify tool calls, so they are given IDs and every tool message is
+// matched with a pending call, by tool name when it has one.
+func ollamaMessages(messages []OllamaMessage) ([]pkg.Message, error) {
+	type pendingCall struct {
+		id   string
+		name string
+	}
+
+	result := make([]pkg.Message, 0, len(messages))
+	var pending []pendingCall
+
+	for i, m := range messages {
+		message := pkg.Message{Role: m.Role, Content: m.Content}
+
+		if len(m.Images) > 0 {
+			if m.Content != "" {
+				message.MultiContent = append(message.MultiContent, pkg.ContentPart{Type: "text", Text: m.Content})
+			}
+			for j, image := range m.Images {
+				imageURL, err := ollamaImageURL(image)
+				if err != nil {
+					return nil, fmt.Errorf("messages[%d].images[%d]: %w", i, j, err)
+				}
+				message.MultiContent = append(message.MultiContent, pkg.ContentPart{Type: "image_url", ImageURL: &pkg.ImageURL{URL: imageURL}})
+			}
+			message.Content = ""
+		}
+
+		if len(m.ToolCalls) > 0 {
+			pending = pending[:0]
+		}
+		for j, toolCall := range m.ToolCalls {
+			// Ollama sends the arguments as an object, Copilot as a string
+			var arguments bytes.Buffer
+			if err := json.Compact(&arguments, toolCall.Function.Arguments); err != nil || arguments.String() == "null" {
+				arguments.Reset()
+				arguments.WriteString("{}")
+			}
+
+			id := fmt.Sprintf("call_%d_%d", i, j)
+			message.ToolCalls = append(message.ToolCalls, pkg.ToolCall{
+				ID:   id,
+				Type: "function",
+				Function: pkg.FunctionCall{
+					Name:      toolCall.Function.Name,
+					Arguments: arguments.String(),
+				},
+			})
+			pending = append(pending, pendingCall{id, toolCall.Function.Name})
+		}
+
+		if m.Role == "tool" && len(pending) > 0 {
+			k := 0
+			for j, call := range pending {
+				if m.ToolName != "" && call.name == m.ToolName {
+					k = j
+					break
+				}
+			}
+			message.ToolCallID = pending[k].id
+			pending = append(pending[:k], pending[k+1:]...)
+		}
+
+		result = append(result, message)
+	}
+
+	return result, nil
+}
+
+// ollamaImageURL turns a base64 encoded image into a data URL, detecting its
+// type from its content.
+func ollamaImageURL(image string) (string, error) {
+	if strings.HasPrefix(image, "data:") {
+		return image, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 image data")
+	}
+
+	return "data:" + http.DetectContentType(data) + ";base64," + image, nil
+}
+
+func ollamaChatHandler(c *fiber.Ctx) error {
+	var request OllamaChatRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/api/chat").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	payload, err := request.payload()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return ollamaRespond(c, payload, func(model string, message OllamaMessage, done OllamaDone) interface{} {
+		return OllamaChatResponse{
+			Model:      model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    message,
+			OllamaDone: done,
+		}
+	})
+}
+
+func ollamaGenerateHandler(c *fiber.Ctx) error {
+	var request OllamaGenerateRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/api/generate").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	newResponse := func(model string, message OllamaMessage, done OllamaDone) interface{} {
+		return OllamaGenerateResponse{
+			Model:      model,
+			CreatedAt:  time.Now().UTC(),
+			Response:   message.Content,
+			OllamaDone: done,
+		}
+	}
+
+	// Ollama loads the model when the prompt is empty; there is nothing to
+	// load here
+	if request.Prompt == "" && len(request.Images) == 0 {
+		model := Model
+		if name := ollamaModel(request.Model); name != nil {
+			model = *name
+		}
+		return c.JSON(newResponse(model, OllamaMessage{}, OllamaDone{Done: true, DoneReason: "load"}))
+	}
+
+	payload, err := request.payload()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return ollamaRespond(c, payload, newResponse)
+}
+
+// ollamaRespond runs payload through the chat pipeline and writes the result
+// with newResponse, as newline-delimited JSON when streaming.
+func ollamaRespond(c *fiber.Ctx, payload Payload, newResponse func(model string, message OllamaMessage, done OllamaDone) interface{}) error {
+	startTime := time.Now()
+	request := payload.completionRequest()
+
+	if err := resolveImages(request.Messages); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Debug().
+		Int("message_count", len(request.Messages)).
+		Str("model", request.Model).
+		Bool("stream", request.Stream).
+		Msg("Processing Ollama request")
+
+	if request.Stream {
+		err := streamResponse(c, request, func(w *bufio.Writer, chatStream *pkg.ChatStream) {
+			if err := writeOllamaStream(w, chatStream, request, startTime, newResponse); err != nil {
+				log.Debug().
+					Err(err).
+					Str("model", request.Model).
+					Msg("Client disconnected, aborted streaming Ollama request")
+			}
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", request.Model).
+				Msg("Failed to get streaming Ollama response")
+			return sendOllamaError(c, err)
+		}
+
+		c.Set("Content-Type", "application/x-ndjson")
+		return nil
+	}
+
+	completionResp, err := completeChat(c.UserContext(), request)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Msg("Failed to get Ollama response")
+		return sendOllamaError(c, err)
+	}
+
+	// Copilot may split text and tool calls over several choices, so the
+	// content of all choices is merged
+	message := OllamaMessage{Role: "assistant"}
+	var texts []string
+	var completion strings.Builder
+	finishReason := ""
+
+	for _, choice := range completionResp.Choices {
+		choiceMessage := choice.Message
+		if choiceMessage == nil {
+			choiceMessage = choice.Delta
+		}
+		if choiceMessage == nil {
+			continue
+		}
+
+		if choiceMessage.Content != "" {
+			texts = append(texts, choiceMessage.Content)
+		}
+		message.ToolCalls = append(message.ToolCalls, ollamaToolCalls(choiceMessage.ToolCalls)...)
+		writeCompletion(&completion, choiceMessage)
+
+		if finishReason == "" {
+			finishReason = choice.FinishReason
+		}
+	}
+	message.Content = strings.Join(texts, "\n\n")
+
+	usage := completionResp.Usage
+	if usage == (pkg.Usage{}) {
+		usage = estimateUsage(request.Model, request.Messages, completion.String())
+	}
+
+	return c.JSON(newResponse(request.Model, message, ollamaDone(finishReason, usage, startTime)))
+}
+
+// writeOllamaStream writes a response per content delta of chatStream. Ollama
+// sends tool calls whole, so their fragments are collected and written
+// before the final response. It returns an error only when writing to the
+// client fails.
+func writeOllamaStream(w *bufio.Writer, chatStream *pkg.ChatStream, request pkg.CompletionRequest, startTime time.Time, newResponse func(model string, message OllamaMessage, done OllamaDone) interface{}) error {
+	var completion strings.Builder
+	var toolCalls []pkg.ToolCall
+	toolCallIndexes := map[int64]int{}
+	finishReason := ""
+
+	for chatStream.Next() {
+		for _, choice := range chatStream.Current().Choices {
+			if choice.FinishReason != "" && finishReason == "" {
+				finishReason = choice.FinishReason
+			}
+
+			delta := choice.Delta
+			if delta == nil {
+				continue
+			}
+			writeCompletion(&completion, delta)
+
+			if delta.Content != "" {
+				if err := writeNDJSON(w, newResponse(request.Model, OllamaMessage{Role: "assistant", Content: delta.Content}, OllamaDone{})); err != nil {
+					return err
+				}
+			}
+
+			for i, toolCall := range delta.ToolCalls {
+				key := int64(i)
+				if toolCall.Index != nil {
+					key = *toolCall.Index
+				}
+
+				position, ok := toolCallIndexes[key]
+				if !ok {
+					toolCallIndexes[key] = len(toolCalls)
+					toolCalls = append(toolCalls, toolCall)
+					continue
+				}
+				toolCalls[position].Function.Name += toolCall.Function.Name
+				toolCalls[position].Function.Arguments += toolCall.Function.Arguments
+			}
+		}
+	}
+
+	if err := chatStream.Err(); err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Msg("Streaming Ollama response failed")
+		_, message := upstreamErrorMessage(err)
+		return writeNDJSON(w, fiber.Map{"error": message})
+	}
+
+	if len(toolCalls) > 0 {
+		if err := writeNDJSON(w, newResponse(request.Model, OllamaMessage{Role: "assistant", ToolCalls: ollamaToolCalls(toolCalls)}, OllamaDone{})); err != nil {
+			return err
+		}
+	}
+
+	usage := chatStream.Usage()
+	if usage == (pkg.Usage{}) {
+		usage = estimateUsage(request.Model, request.Messages, completion.String())
+	}
+
+	return writeNDJSON(w, newResponse(request.Model, OllamaMessage{Role: "assistant"}, ollamaDone(finishReason, usage, startTime)))
+}
+
+func ollamaToolCalls(toolCalls []pkg.ToolCall) []OllamaToolCall {
+	var result []OllamaToolCall
+	for _, toolCall := range toolCalls {
+		result = append(result, OllamaToolCall{
+			Function: OllamaFunctionCall{
+				Name:      toolCall.Function.Name,
+				Arguments: toolCallInput(toolCall.Function.Arguments),
+			},
+		})
+	}
+	return result
+}
+
+// ollamaDone builds the final fields of a generation. Ollama reports tool
+// calls as a normal stop.
+func ollamaDone(finishReason string, usage pkg.Usage, startTime time.Time) OllamaDone {
+	doneReason := "stop"
+	if finishReason == pkg.FinishReasonLength {
+		doneReason = "length"
+	}
+
+	return OllamaDone{
+		Done:            true,
+		DoneReason:      doneReason,
+		TotalDuration:   time.Since(startTime).Nanoseconds(),
+		PromptEvalCount: usage.PromptTokens,
+		EvalCount:       usage.CompletionTokens,
+	}
+}
+
+// writeNDJSON writes v as a line of JSON and flushes it to the client.
+func writeNDJSON(w *bufio.Writer, v interface{}) error {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// sendOllamaError writes an upstream error as an Ollama error body with the
+// mapped status.
+func sendOllamaError(c *fiber.Ctx, err error) error {
+	setRetryAfter(c, err)
+
+	status, message := upstreamErrorMessage(err)
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// ollamaTagsHandler lists the Copilot models as local Ollama models.
+func ollamaTagsHandler(c *fiber.Ctx) error {
+	models, err := modelCatalog.get(c.UserContext())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list models")
+		return sendOllamaError(c, err)
+	}
+
+	response := OllamaTagsResponse{Models: []OllamaModel{}}
+	seen := map[string]bool{}
+	for _, model := range models {
+		if seen[model.ID] {
+			continue
+		}
+		seen[model.ID] = true
+
+		response.Models = append(response.Models, OllamaModel{
+			Name:    model.ID,
+			Model:   model.ID,
+			Digest:  ollamaDigest(model.ID),
+			Details: ollamaModelDetails(model),
+		})
+	}
+
+	return c.JSON(response)
+}
+
+func ollamaShowHandler(c *fiber.Ctx) error {
+	var request OllamaShowRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	name := request.Model
+	if name == "" {
+		name = request.Name
+	}
+	id := ollamaModel(name)
+	if id == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "model is required"})
+	}
+
+	model, ok, err := modelCatalog.find(c.UserContext(), *id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list models")
+		return sendOllamaError(c, err)
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("model '%s' not found", name)})
+	}
+
+	details := ollamaModelDetails(model)
+	modelInfo := map[string]interface{}{
+		"general.architecture": details.Family,
+		"general.basename":     model.Name,
+	}
+	if limit := model.Capabilities.Limits.MaxContextWindowTokens; limit > 0 {
+		modelInfo[details.Family+".context_length"] = limit
+	}
+
+	return c.JSON(OllamaShowResponse{
+		Details:      details,
+		ModelInfo:    modelInfo,
+		Capabilities: ollamaCapabilities(model),
+	})
+}
+
+func ollamaModelDetails(model pkg.Model) OllamaModelDetails {
+	family := model.Capabilities.Family
+	if family == "" {
+		family = model.ID
+	}
+
+	return OllamaModelDetails{
+		Format:   "copilot",
+		Family:   family,
+		Families: []string{family},
+	}
+}
+
+func ollamaCapabilities(model pkg.Model) []string {
+	if model.Capabilities.Type == "embeddings" {
+		return []string{"embedding"}
+	}
+
+	capabilities := []string{"completion"}
+	supports := model.Capabilities.Supports
+	if supports.ToolCalls != nil && *supports.ToolCalls {
+		capabilities = append(capabilities, "tools")
+	}
+	if supports.Vision != nil && *supports.Vision {
+		capabilities = append(capabilities, "vision")
+	}
+	return capabilities
+}
+
+// ollamaDigest derives a stable digest from the model ID, as Ollama clients
+// use it to tell models apart.
+func ollamaDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+const testPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+func postOllama(t *testing.T, path, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+// readNDJSON decodes every line of data as a JSON object.
+func readNDJSON(t *testing.T, data []byte) []map[string]interface{} {
+	t.Helper()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Failed to decode line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestOllamaChatPayload(t *testing.T) {
+	body := `{
+		"model": "gpt-4o:latest",
+		"format": "json",
+		"options": {"temperature": 0.1, "top_p": 0.5, "seed": 42, "num_predict": 64, "stop": ["END"]},
+		"messages": [
+			{"role": "user", "content": "Describe this", "images": ["` + testPNG + `"]},
+			{"role": "assistant", "content": "", "tool_calls": [
+				{"function": {"name": "get_weather", "arguments": {"city": "Ottawa"}}},
+				{"function": {"name": "get_time", "arguments": {}}}
+			]},
+			{"role": "tool", "content": "12:00", "tool_name": "get_time"},
+			{"role": "tool", "content": "Sunny"}
+		]
+	}`
+
+	var request OllamaChatRequest
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	payload, err := request.payload()
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	completion := payload.completionRequest()
+	if completion.Model != "gpt-4o" {
+		t.Errorf("Expected the :latest tag to be dropped, got %s", completion.Model)
+	}
+	if !completion.Stream {
+		t.Error("Expected streaming by default")
+	}
+	if completion.Temperature != 0.1 || completion.TopP != 0.5 || *completion.Seed != 42 || *completion.MaxTokens != 64 {
+		t.Errorf("Unexpected options: %+v", completion)
+	}
+	if stop, ok := completion.Stop.([]string); !ok || stop[0] != "END" {
+		t.Errorf("Expected stop [END], got %v", completion.Stop)
+	}
+	if completion.ResponseFormat == nil || completion.ResponseFormat.Type != "json_object" {
+		t.Errorf("Expected json_object response format, got %+v", completion.ResponseFormat)
+	}
+
+	user := completion.Messages[0]
+	if len(user.MultiContent) != 2 || user.MultiContent[0].Text != "Describe this" {
+		t.Fatalf("Unexpected user parts: %+v", user.MultiContent)
+	}
+	if url := user.MultiContent[1].ImageURL.URL; url != "data:image/png;base64,"+testPNG {
+		t.Errorf("Expected a PNG data URL, got %s", url)
+	}
+
+	assistant := completion.Messages[1]
+	if len(assistant.ToolCalls) != 2 || assistant.ToolCalls[0].Function.Arguments != `{"city":"Ottawa"}` {
+		t.Fatalf("Unexpected tool calls: %+v", assistant.ToolCalls)
+	}
+
+	// The named result answers the second call, the other one the first
+	if completion.Messages[2].ToolCallID != assistant.ToolCalls[1].ID {
+		t.Errorf("Expected tool message for get_time to answer %s, got %s", assistant.ToolCalls[1].ID, completion.Messages[2].ToolCallID)
+	}
+	if completion.Messages[3].ToolCallID != assistant.ToolCalls[0].ID {
+		t.Errorf("Expected tool message to answer %s, got %s", assistant.ToolCalls[0].ID, completion.Messages[3].ToolCallID)
+	}
+}
+
+func TestOllamaResponseFormat(t *testing.T) {
+	format, err := ollamaResponseFormat(json.RawMessage(`{"type":"object"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if format.Type != "json_schema" || string(format.JSONSchema) != `{"name":"response","schema":{"type":"object"}}` {
+		t.Errorf("Unexpected schema format: %s %s", format.Type, format.JSONSchema)
+	}
+
+	if _, err := ollamaResponseFormat(json.RawMessage(`"yaml"`)); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestOllamaChatEndpoint(t *testing.T) {
+	var upstreamRequest pkg.CompletionRequest
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[
+			{"message":{"role":"assistant","content":"Checking."},"finish_reason":"stop"},
+			{"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Ottawa\"}"}}]},"finish_reason":"tool_calls"}
+		],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	})
+
+	resp, data := postOllama(t, "/api/chat", `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Weather?"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+	if upstreamRequest.Stream {
+		t.Error("Expected a non-streaming upstream request")
+	}
+
+	var response OllamaChatResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", data, err)
+	}
+
+	if response.Model != "gpt-4o" || !response.Done || response.DoneReason != "stop" {
+		t.Errorf("Unexpected response: %s", data)
+	}
+	if response.Message.Role != "assistant" || response.Message.Content != "Checking." {
+		t.Errorf("Unexpected message: %+v", response.Message)
+	}
+	if len(response.Message.ToolCalls) != 1 || string(response.Message.ToolCalls[0].Function.Arguments) != `{"city":"Ottawa"}` {
+		t.Errorf("Expected tool call arguments as an object, got %s", data)
+	}
+	if response.PromptEvalCount != 10 || response.EvalCount != 5 || response.TotalDuration == 0 {
+		t.Errorf("Unexpected counts: %+v", response.OllamaDone)
+	}
+}
+
+func TestOllamaChatEndpointStreaming(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeUpstreamChunk(w, "Hello", "")
+		writeUpstreamChunk(w, " world", "")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Ottawa\"}"}}]}}]}`+"\n\n")
+		writeUpstreamChunk(w, "", "length")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	resp, data := postOllama(t, "/api/chat", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected application/x-ndjson, got %s", ct)
+	}
+
+	lines := readNDJSON(t, data)
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %d: %s", len(lines), data)
+	}
+
+	text := ""
+	for _, line := range lines[:2] {
+		if line["done"] != false {
+			t.Errorf("Expected done false before the last line, got %v", line)
+		}
+		text += line["message"].(map[string]interface{})["content"].(string)
+	}
+	if text != "Hello world" {
+		t.Errorf("Expected Hello world, got %q", text)
+	}
+
+	toolCalls := lines[2]["message"].(map[string]interface{})["tool_calls"].([]interface{})
+	function := toolCalls[0].(map[string]interface{})["function"].(map[string]interface{})
+	if function["name"] != "get_weather" || function["arguments"].(map[string]interface{})["city"] != "Ottawa" {
+		t.Errorf("Expected the assembled tool call, got %v", function)
+	}
+
+	last := lines[3]
+	if last["done"] != true || last["done_reason"] != "length" {
+		t.Errorf("Expected a final done line with reason length, got %v", last)
+	}
+	if last["eval_count"] == nil || last["prompt_eval_count"] == nil {
+		t.Errorf("Expected estimated counts, got %v", last)
+	}
+}
+
+func TestOllamaGenerateEndpoint(t *testing.T) {
+	var upstreamRequest pkg.CompletionRequest
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeUpstreamChunk(w, "4", "stop")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	resp, data := postOllama(t, "/api/generate", `{"model":"gpt-4o","system":"Answer with a number.","prompt":"2+2?"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	if len(upstreamRequest.Messages) != 2 || upstreamRequest.Messages[0].Role != "system" || upstreamRequest.Messages[1].Content != "2+2?" {
+		t.Errorf("Unexpected upstream messages: %+v", upstreamRequest.Messages)
+	}
+
+	lines := readNDJSON(t, data)
+	if len(lines) != 2 || lines[0]["response"] != "4" || lines[1]["done"] != true || lines[1]["response"] != "" {
+		t.Errorf("Unexpected generate stream: %s", data)
+	}
+}
+
+func TestOllamaGenerateEndpointLoad(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no upstream request for an empty prompt")
+	})
+
+	resp, data := postOllama(t, "/api/generate", `{"model":"gpt-4o"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var response OllamaGenerateResponse
+	json.Unmarshal(data, &response)
+	if !response.Done || response.DoneReason != "load" || response.Model != "gpt-4o" {
+		t.Errorf("Unexpected load response: %s", data)
+	}
+}
+
+func TestOllamaEndpointErrors(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"slow down"}}`)
+	})
+
+	resp, data := postOllama(t, "/api/chat", `{"messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", resp.StatusCode)
+	}
+	if string(data) != `{"error":"slow down"}` {
+		t.Errorf("Expected an Ollama error body, got %s", data)
+	}
+
+	resp, data = postOllama(t, "/api/chat", `{"messages":[{"role":"user","content":"Hi","images":["not base64!"]}]}`)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "messages[0].images[0]") {
+		t.Errorf("Expected status 400 naming the image, got %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestOllamaTagsEndpoint(t *testing.T) {
+	useModelCatalog(t, http.StatusOK)
+
+	var response OllamaTagsResponse
+	if status := getJSON(t, "/api/tags", &response); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	if len(response.Models) != 3 {
+		t.Fatalf("Expected 3 models, got %+v", response.Models)
+	}
+
+	model := response.Models[0]
+	if model.Name != "gpt-4o" || model.Model != "gpt-4o" || model.Details.Family != "gpt-4o" || len(model.Digest) != 64 {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	if response.Models[1].Digest == model.Digest {
+		t.Error("Expected distinct digests")
+	}
+}
+
+func TestOllamaShowEndpoint(t *testing.T) {
+	useModelCatalog(t, http.StatusOK)
+
+	resp, data := postOllama(t, "/api/show", `{"model":"gpt-4o:latest"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var response OllamaShowResponse
+	json.Unmarshal(data, &response)
+	if strings.Join(response.Capabilities, ",") != "completion,tools,vision" {
+		t.Errorf("Expected completion,tools,vision, got %v", response.Capabilities)
+	}
+	if response.ModelInfo["gpt-4o.context_length"] != float64(128000) {
+		t.Errorf("Expected the context length, got %v", response.ModelInfo)
+	}
+
+	resp, data = postOllama(t, "/api/show", `{"name":"text-embedding-3-small"}`)
+	json.Unmarshal(data, &response)
+	if resp.StatusCode != http.StatusOK || strings.Join(response.Capabilities, ",") != "embedding" {
+		t.Errorf("Expected an embedding model, got %d: %s", resp.StatusCode, data)
+	}
+
+	resp, data = postOllama(t, "/api/show", `{"model":"llama3"}`)
+	if resp.StatusCode != http.StatusNotFound || string(data) != `{"error":"model 'llama3' not found"}` {
+		t.Errorf("Expected status 404, got %d: %s", resp.StatusCode, data)
+	}
+}
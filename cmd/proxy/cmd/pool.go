@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Pool_profiles are the profiles whose accounts requests are spread
+	// across. The active profile is used alone when it is empty.
+	Pool_profiles []string
+	// Pool_balance is how the next account is picked, balanceRoundRobin or
+	// balanceLeastInFlight.
+	Pool_balance = balanceRoundRobin
+	// Pool_cooldown is how long an account is skipped after it was rate
+	// limited without a Retry-After hint, or its token was rejected.
+	Pool_cooldown = time.Minute
+)
+
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastInFlight = "least-in-flight"
+)
+
+// Admin_token grants access to /admin/health from any address, including
+// the username and last error of every account. Without it, only clients on
+// the loopback interface get the report, with those left out.
+var Admin_token string
+
+// Admin_token_env is the environment variable Admin_token is read from when
+// --admin-token is not given.
+const Admin_token_env = "GO_COPILOT_PROXY_ADMIN_TOKEN"
+
+// accounts are the Copilot accounts requests are sent with. start builds
+// them with startAccountPool once client is configured.
+var accounts *accountPool
+
+// errNoAccounts is returned for requests made before the pool is built.
+var errNoAccounts = errors.New("no Copilot account is configured")
+
+// account is a GitHub account of the pool with its own session token.
+type account struct {
+	profile  string
+	username string
+	sessions *pkg.TokenManager
+
+	inFlight atomic.Int64
+	requests atomic.Int64
+
+	mu            sync.Mutex
+	cooldownUntil time.Time
+	failures      int64
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// accountPool spreads requests across accounts and skips the ones that are
+// cooling down. It is safe for concurrent use.
+type accountPool struct {
+	balance  string
+	accounts []*account
+	next     atomic.Uint64
+}
+
+// AccountHealth is the state of an account reported by /admin/health.
+// Username and LastError are only reported to clients with the admin token.
+type AccountHealth struct {
+	Profile          string     `json:"profile"`
+	Username         string     `json:"username,omitempty"`
+	Status           string     `json:"status"`
+	CooldownUntil    *time.Time `json:"cooldown_until,omitempty"`
+	InFlight         int64      `json:"in_flight"`
+	Requests         int64      `json:"requests"`
+	Failures         int64      `json:"failures"`
+	LastError        string     `json:"last_error,omitempty"`
+	LastErrorAt      *time.Time `json:"last_error_at,omitempty"`
+	SessionExpiresAt *time.Time `json:"session_expires_at,omitempty"`
+}
+
+// PoolHealth is the response of /admin/health.
+type PoolHealth struct {
+	Status   string          `json:"status"`
+	Balance  string          `json:"balance"`
+	Accounts []AccountHealth `json:"accounts"`
+}
+
+func newAccount(profile, username string, sessions *pkg.TokenManager) *account {
+	return &account{profile: profile, username: username, sessions: sessions}
+}
+
+func newAccountPool(balance string, accounts ...*account) *accountPool {
+	return &accountPool{balance: balance, accounts: accounts}
+}
+
+// poolRetryPolicy returns the retry policy of the client. With more than one
+// account, a rate limited or rejected request is not retried on the same
+// account but fails over to the next one at once.
+func poolRetryPolicy() pkg.RetryPolicy {
+	policy := pkg.DefaultRetryPolicy()
+	if len(Pool_profiles) > 1 {
+		policy.FailFast = []int{fiber.StatusTooManyRequests, fiber.StatusUnauthorized}
+	}
+	return policy
+}
+
+// validateBalance checks a --balance value.
+func validateBalance(balance string) error {
+	if balance != balanceRoundRobin && balance != balanceLeastInFlight {
+		return fmt.Errorf("invalid balance %q, use %s or %s", balance, balanceRoundRobin, balanceLeastInFlight)
+	}
+	return nil
+}
+
+// startAccountPool starts keeping the session token of every account fresh.
+// Without a pool, the single account uses the token found by findToken, which
+// must be valid. Otherwise an account whose session cannot be started joins
+// the pool in cooldown and keeps being retried.
+func startAccountPool(ctx context.Context) (*accountPool, error) {
+	if err := validateBalance(Pool_balance); err != nil {
+		return nil, err
+	}
+
+	if len(Pool_profiles) == 0 {
+		found, err := findToken()
+		if err != nil {
+			return nil, err
+		}
+
+		a := newAccount(found.name, found.username, pkg.NewTokenManager(client, found.token))
+		if err := a.sessions.Start(ctx); err != nil {
+			return nil, fmt.Errorf("validating token from %s: %w", found.source, err)
+		}
+
+		log.Info().Str("source", found.source).Str("username", found.username).Msg("Using token")
+		return newAccountPool(Pool_balance, a), nil
+	}
+
+	if Token_file != "" {
+		return nil, errors.New("--token-file cannot be combined with --pool")
+	}
+
+	var pool []*account
+	for _, profile := range Pool_profiles {
+		token, err := readToken(profile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no token found for profile %s, please run login --profile %s first", profile, profile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading token of profile %s: %w", profile, err)
+		}
+
+		info, _ := readProfileInfo(profile)
+		a := newAccount(profile, info.Username, pkg.NewTokenManager(client, token))
+
+		if err := a.sessions.Start(ctx); err != nil {
+			log.Error().Err(err).Str("profile", profile).Msg("Error getting session token, retrying after cooldown")
+			a.fail(err, Pool_cooldown)
+			go a.retryStart(ctx)
+		}
+
+		log.Info().Str("profile", profile).Str("username", info.Username).Msg("Using account")
+		pool = append(pool, a)
+	}
+
+	return newAccountPool(Pool_balance, pool...), nil
+}
+
+// retryStart starts the session of an account whose first attempt failed,
+// trying again after every cooldown.
+func (a *account) retryStart(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(Pool_cooldown):
+		}
+
+		if err := a.sessions.Start(ctx); err != nil {
+			log.Error().Err(err).Str("profile", a.profile).Msg("Error getting session token, retrying after cooldown")
+			a.fail(err, Pool_cooldown)
+			continue
+		}
+		return
+	}
+}
+
+// pick returns the next account that is not cooling down and has not been
+// tried yet. Without one, it returns the time the first account in cooldown
+// becomes available again.
+func (p *accountPool) pick(tried map[*account]bool) (*account, time.Time) {
+	now := time.Now()
+
+	var candidates []*account
+	var availableAt time.Time
+	for _, a := range p.accounts {
+		if tried[a] {
+			continue
+		}
+		if until := a.cooldownEnd(); now.Before(until) {
+			if availableAt.IsZero() || until.Before(availableAt) {
+				availableAt = until
+			}
+			continue
+		}
+		candidates = append(candidates, a)
+	}
+
+	if len(candidates) == 0 {
+		return nil, availableAt
+	}
+
+	// Start from the next account in turn, so that least-in-flight spreads
+	// ties too
+	start := int((p.next.Add(1) - 1) % uint64(len(candidates)))
+	picked := candidates[start]
+
+	if p.balance == balanceLeastInFlight {
+		for i := 1; i < len(candidates); i++ {
+			a := candidates[(start+i)%len(candidates)]
+			if a.inFlight.Load() < picked.inFlight.Load() {
+				picked = a
+			}
+		}
+	}
+
+	return picked, time.Time{}
+}
+
+// acquire counts a request against a until ctx is done. The returned
+// function releases it early, for a request that was not sent after all.
+func (a *account) acquire(ctx context.Context) func() {
+	a.inFlight.Add(1)
+	a.requests.Add(1)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { a.inFlight.Add(-1) })
+	}
+
+	stop := context.AfterFunc(ctx, release)
+	return func() {
+		stop()
+		release()
+	}
+}
+
+func (a *account) cooldownEnd() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.cooldownUntil
+}
+
+// fail records err and puts the account into cooldown for d.
+func (a *account) fail(err error, d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.failures++
+	a.lastError = err.Error()
+	a.lastErrorAt = now
+	if until := now.Add(d); until.After(a.cooldownUntil) {
+		a.cooldownUntil = until
+	}
+}
+
+// cooldown returns how long the account should be skipped after err, or
+// false if err says nothing about the account.
+func cooldown(err error) (time.Duration, bool) {
+	var apiErr *pkg.APIError
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+
+	switch apiErr.StatusCode {
+	case fiber.StatusTooManyRequests:
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter, true
+		}
+		return Pool_cooldown, true
+	case fiber.StatusUnauthorized:
+		return Pool_cooldown, true
+	}
+	return 0, false
+}
+
+// health reports the state of every account, with the username and last
+// error of each when detailed is set.
+func (p *accountPool) health(detailed bool) PoolHealth {
+	now := time.Now()
+	health := PoolHealth{Balance: p.balance, Accounts: []AccountHealth{}}
+
+	available := 0
+	for _, a := range p.accounts {
+		a.mu.Lock()
+		state := AccountHealth{
+			Profile:  a.profile,
+			Status:   "ok",
+			InFlight: a.inFlight.Load(),
+			Requests: a.requests.Load(),
+			Failures: a.failures,
+		}
+		if detailed {
+			state.Username = a.username
+			state.LastError = a.lastError
+		}
+		if now.Before(a.cooldownUntil) {
+			until := a.cooldownUntil
+			state.Status = "cooldown"
+			state.CooldownUntil = &until
+		} else {
+			available++
+		}
+		if !a.lastErrorAt.IsZero() {
+			at := a.lastErrorAt
+			state.LastErrorAt = &at
+		}
+		a.mu.Unlock()
+
+		if session := a.sessions.Session(); session.ExpiresAt > 0 {
+			expiresAt := time.Unix(session.ExpiresAt, 0)
+			state.SessionExpiresAt = &expiresAt
+		}
+
+		health.Accounts = append(health.Accounts, state)
+	}
+
+	sort.SliceStable(health.Accounts, func(i, j int) bool {
+		return health.Accounts[i].Profile < health.Accounts[j].Profile
+	})
+
+	switch available {
+	case len(p.accounts):
+		health.Status = "ok"
+	case 0:
+		health.Status = "unavailable"
+	default:
+		health.Status = "degraded"
+	}
+
+	return health
+}
+
+// adminHealthHandler reports the state of every account, answering 503 when
+// none can take requests. Clients presenting Admin_token as a bearer token get
+// the detailed report; other clients must be on the loopback interface.
+func adminHealthHandler(c *fiber.Ctx) error {
+	detailed := hasAdminToken(c)
+	if !detailed && !isLoopback(c.Context().RemoteIP()) {
+		return c.Status(fiber.StatusForbidden).JSON(errorObject("The admin endpoints are only available from localhost or with the admin token", errorTypePermission, "forbidden"))
+	}
+
+	if accounts == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(PoolHealth{Status: "unavailable", Accounts: []AccountHealth{}})
+	}
+
+	health := accounts.health(detailed)
+
+	status := fiber.StatusOK
+	if health.Status == "unavailable" {
+		status = fiber.StatusServiceUnavailable
+	}
+	return c.Status(status).JSON(health)
+}
+
+// hasAdminToken reports whether the request carries Admin_token.
+func hasAdminToken(c *fiber.Ctx) bool {
+	if Admin_token == "" {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(Admin_token)) == 1
+}
+
+// isLoopback reports whether ip is a loopback address. It is the address of
+// the connection, so a proxy in front of the server cannot be told apart from
+// a local client.
+func isLoopback(ip net.IP) bool {
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// newTestAccount returns an account of profile that starts out with
+// sessionToken.
+func newTestAccount(profile string, sessionToken string) *account {
+	return newAccount(profile, profile+"-user", pkg.NewTokenManager(client, "access-token", pkg.WithSession(pkg.SessionResponse{Token: sessionToken})))
+}
+
+// usePool replaces the accounts of a useUpstream mock for the duration of the
+// test.
+func usePool(t *testing.T, balance string, pool ...*account) {
+	t.Helper()
+
+	original := accounts
+	accounts = newAccountPool(balance, pool...)
+	t.Cleanup(func() {
+		accounts = original
+	})
+}
+
+func postChat(t *testing.T) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	return resp
+}
+
+func TestAccountPoolRoundRobin(t *testing.T) {
+	var mu sync.Mutex
+	tokens := map[string]int{}
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens[r.Header.Get("authorization")]++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pkg.CompletionResponse{
+			Choices: []pkg.Choice{{Message: &pkg.Message{Role: "assistant", Content: "Hello"}}},
+		})
+	})
+	usePool(t, balanceRoundRobin, newTestAccount("a", "session-a"), newTestAccount("b", "session-b"))
+
+	for i := 0; i < 4; i++ {
+		resp := postChat(t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d: expected status 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	if tokens["Bearer session-a"] != 2 || tokens["Bearer session-b"] != 2 {
+		t.Errorf("Expected 2 requests per account, got %v", tokens)
+	}
+
+	for _, a := range accounts.accounts {
+		waitForInFlight(t, a, 0)
+	}
+}
+
+func TestAccountPoolLeastInFlight(t *testing.T) {
+	a, b, c := newTestAccount("a", "session-a"), newTestAccount("b", "session-b"), newTestAccount("c", "session-c")
+	pool := newAccountPool(balanceLeastInFlight, a, b, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.acquire(ctx)
+	a.acquire(ctx)
+	c.acquire(ctx)
+
+	for i := 0; i < 3; i++ {
+		if picked, _ := pool.pick(nil); picked != b {
+			t.Errorf("Pick %d: expected account b, got %s", i, picked.profile)
+		}
+	}
+
+	cancel()
+	waitForInFlight(t, a, 0)
+	waitForInFlight(t, c, 0)
+
+	// Ties are spread in turn
+	seen := map[*account]bool{}
+	for i := 0; i < 3; i++ {
+		picked, _ := pool.pick(nil)
+		seen[picked] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected ties to be spread across all accounts, got %d", len(seen))
+	}
+}
+
+func TestAccountPoolFailsOverWhenRateLimited(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("authorization"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("authorization") == "Bearer session-a" {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Slow down","code":"rate_limited"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(pkg.CompletionResponse{
+			Choices: []pkg.Choice{{Message: &pkg.Message{Role: "assistant", Content: "Hello"}}},
+		})
+	})
+	a, b := newTestAccount("a", "session-a"), newTestAccount("b", "session-b")
+	usePool(t, balanceRoundRobin, a, b)
+
+	for i := 0; i < 2; i++ {
+		resp := postChat(t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d: expected status 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	// a is only tried once, the second request goes to b directly
+	expected := []string{"Bearer session-a", "Bearer session-b", "Bearer session-b"}
+	if strings.Join(tokens, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected upstream requests %v, got %v", expected, tokens)
+	}
+
+	until := a.cooldownEnd()
+	if d := time.Until(until); d < 25*time.Second || d > 30*time.Second {
+		t.Errorf("Expected account a to cool down for the Retry-After hint, got %s", d)
+	}
+	if !b.cooldownEnd().IsZero() {
+		t.Errorf("Expected account b not to cool down, got %s", b.cooldownEnd())
+	}
+}
+
+func TestAccountPoolFailsOverWithoutRetrying(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	server := useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("authorization"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("authorization") == "Bearer session-a" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Slow down","code":"rate_limited"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(pkg.CompletionResponse{
+			Choices: []pkg.Choice{{Message: &pkg.Message{Role: "assistant", Content: "Hello"}}},
+		})
+	})
+
+	originalProfiles := Pool_profiles
+	Pool_profiles = []string{"a", "b"}
+	t.Cleanup(func() { Pool_profiles = originalProfiles })
+
+	client = pkg.NewClient(pkg.WithCopilotURL(server.URL), pkg.WithRetryPolicy(poolRetryPolicy()))
+	usePool(t, balanceRoundRobin, newTestAccount("a", "session-a"), newTestAccount("b", "session-b"))
+
+	start := time.Now()
+	resp := postChat(t)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	// The default policy would wait at least 400ms before retrying a
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected to fail over without backing off, took %s", elapsed)
+	}
+	expected := []string{"Bearer session-a", "Bearer session-b"}
+	if strings.Join(tokens, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected upstream requests %v, got %v", expected, tokens)
+	}
+	if client.Retries() != 0 {
+		t.Errorf("Expected no retries, got %d", client.Retries())
+	}
+}
+
+func TestAccountPoolAllCoolingDown(t *testing.T) {
+	requests := 0
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		t.Errorf("Unexpected upstream request to %s", r.URL.Path)
+	})
+	a, b := newTestAccount("a", "session-a"), newTestAccount("b", "session-b")
+	a.fail(&pkg.APIError{StatusCode: http.StatusTooManyRequests, Message: "Slow down"}, 20*time.Second)
+	b.fail(&pkg.APIError{StatusCode: http.StatusUnauthorized, Message: "Bad credentials"}, 10*time.Second)
+	usePool(t, balanceRoundRobin, a, b)
+
+	resp := postChat(t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("Expected Retry-After 10, got %q", resp.Header.Get("Retry-After"))
+	}
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests, got %d", requests)
+	}
+}
+
+func TestAdminHealthHandler(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	a, b := newTestAccount("a", "session-a"), newTestAccount("b", "session-b")
+	usePool(t, balanceLeastInFlight, b, a)
+
+	originalAdminToken := Admin_token
+	Admin_token = "admin-token"
+	t.Cleanup(func() { Admin_token = originalAdminToken })
+
+	// Requests through app.Test come from 0.0.0.0, so they need the token
+	for _, authorization := range []string{"", "Bearer wrong-token", "admin-token"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/health", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := newApp().Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403 with authorization %q, got %d", authorization, resp.StatusCode)
+		}
+	}
+
+	get := func() (int, PoolHealth) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/health", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		resp, err := newApp().Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var health PoolHealth
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp.StatusCode, health
+	}
+
+	status, health := get()
+	if status != http.StatusOK || health.Status != "ok" {
+		t.Errorf("Expected status 200 and ok, got %d and %s", status, health.Status)
+	}
+	if health.Balance != balanceLeastInFlight {
+		t.Errorf("Expected balance %s, got %s", balanceLeastInFlight, health.Balance)
+	}
+	if len(health.Accounts) != 2 || health.Accounts[0].Profile != "a" || health.Accounts[0].Username != "a-user" {
+		t.Fatalf("Expected accounts a and b sorted by profile, got %+v", health.Accounts)
+	}
+
+	a.fail(&pkg.APIError{StatusCode: http.StatusTooManyRequests, Message: "Slow down"}, time.Minute)
+
+	status, health = get()
+	if status != http.StatusOK || health.Status != "degraded" {
+		t.Errorf("Expected status 200 and degraded, got %d and %s", status, health.Status)
+	}
+	state := health.Accounts[0]
+	if state.Status != "cooldown" || state.CooldownUntil == nil || state.Failures != 1 || state.LastError == "" {
+		t.Errorf("Expected account a to be cooling down after a failure, got %+v", state)
+	}
+
+	b.fail(&pkg.APIError{StatusCode: http.StatusUnauthorized, Message: "Bad credentials"}, time.Minute)
+
+	status, health = get()
+	if status != http.StatusServiceUnavailable || health.Status != "unavailable" {
+		t.Errorf("Expected status 503 and unavailable, got %d and %s", status, health.Status)
+	}
+
+	// Without the token, usernames and errors are left out
+	for _, state := range accounts.health(false).Accounts {
+		if state.Username != "" || state.LastError != "" || state.Failures != 1 {
+			t.Errorf("Expected the failure without details, got %+v", state)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":   true,
+		"127.0.0.2":   true,
+		"::1":         true,
+		"0.0.0.0":     false,
+		"192.168.1.2": false,
+		"::":          false,
+	}
+
+	for ip, expected := range tests {
+		if got := isLoopback(net.ParseIP(ip)); got != expected {
+			t.Errorf("Expected isLoopback(%s) to be %v, got %v", ip, expected, got)
+		}
+	}
+	if isLoopback(nil) {
+		t.Error("Expected a missing address not to be loopback")
+	}
+}
+
+func TestWithSessionBeforeStart(t *testing.T) {
+	usePool(t, balanceRoundRobin)
+	accounts = nil
+
+	err := withSession(context.Background(), func(token string) error {
+		t.Error("Expected no call without accounts")
+		return nil
+	})
+	if err != errNoAccounts {
+		t.Errorf("Expected errNoAccounts, got %v", err)
+	}
+}
+
+func waitForInFlight(t *testing.T, a *account, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for a.inFlight.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d requests in flight for %s, got %d", n, a.profile, a.inFlight.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
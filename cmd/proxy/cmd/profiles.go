@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// Profile is the profile selected with --profile. When it is empty, the
+// profile chosen with "profiles use" is used, or default_profile.
+var Profile string
+
+const default_profile = "default"
+
+// current_profile_file_name is the file in the config directory naming the
+// profile chosen with "profiles use".
+const current_profile_file_name = "current_profile"
+
+// profile_info_file_name is the file in a profile directory holding its
+// profileInfo.
+const profile_info_file_name = "profile.json"
+
+// profile_name_pattern keeps profile names usable as directory names.
+var profile_name_pattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// profileInfo is what is known about the account of a profile, stored in
+// plain text next to its token so that it can be listed without the
+// passphrase.
+type profileInfo struct {
+	Username string `json:"username,omitempty"`
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&Profile, "profile", "", "GitHub account profile to use (default: the profile chosen with \"profiles use\", or \"default\")")
+
+	profilesCmd.AddCommand(profilesListCmd, profilesUseCmd, profilesRemoveCmd)
+	rootCmd.AddCommand(profilesCmd)
+}
+
+var profilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "Manage GitHub account profiles",
+	Long:  `Manage the GitHub accounts you have logged in with. Log in to a new profile with "login --profile <name>".`,
+}
+
+var profilesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List profiles",
+	Long:  `List the profiles you have logged in with. The active profile is marked with an asterisk.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+		if err := migrateLegacyToken(); err != nil {
+			log.Error().Msgf("Error migrating token file: %s", err)
+			return
+		}
+
+		profiles, err := listProfiles()
+		if err != nil {
+			log.Error().Msgf("Error listing profiles: %s", err)
+			return
+		}
+		if len(profiles) == 0 {
+			log.Info().Msg("No profiles found, please run login first")
+			return
+		}
+
+		active, _ := activeProfile()
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		for _, profile := range profiles {
+			marker := " "
+			if profile == active {
+				marker = "*"
+			}
+
+			info, err := readProfileInfo(profile)
+			if err != nil {
+				log.Warn().Msgf("Error reading profile %s: %s", profile, err)
+			}
+			username := info.Username
+			if username == "" {
+				username = "-"
+			}
+
+			fmt.Fprintf(w, "%s %s\t%s\n", marker, profile, username)
+		}
+		w.Flush()
+	},
+}
+
+var profilesUseCmd = &cobra.Command{
+	Use:   "use <profile>",
+	Short: "Make a profile the active one",
+	Long:  `Make a profile the one used by start and logout when --profile is not given.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+		if err := migrateLegacyToken(); err != nil {
+			log.Error().Msgf("Error migrating token file: %s", err)
+			return
+		}
+
+		profile := args[0]
+		if !tokenExists(profile) {
+			log.Error().Msgf("Profile %s does not exist, please run login --profile %s first", profile, profile)
+			return
+		}
+
+		if err := setCurrentProfile(profile); err != nil {
+			log.Error().Msgf("Error switching profile: %s", err)
+			return
+		}
+
+		log.Info().Msgf("Switched to profile %s", profile)
+	},
+}
+
+var profilesRemoveCmd = &cobra.Command{
+	Use:   "remove <profile>",
+	Short: "Remove a profile and its token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+		if err := migrateLegacyToken(); err != nil {
+			log.Error().Msgf("Error migrating token file: %s", err)
+			return
+		}
+
+		profile := args[0]
+		err := removeProfile(profile)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Error().Msgf("Profile %s does not exist", profile)
+			return
+		}
+		if err != nil {
+			log.Error().Msgf("Error removing profile: %s", err)
+			return
+		}
+
+		log.Info().Msgf("Removed profile %s", profile)
+	},
+}
+
+// activeProfile returns the profile commands operate on.
+func activeProfile() (string, error) {
+	if Profile != "" {
+		return Profile, validateProfile(Profile)
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, current_profile_file_name))
+	if errors.Is(err, os.ErrNotExist) {
+		return default_profile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	profile := strings.TrimSpace(string(data))
+	return profile, validateProfile(profile)
+}
+
+// setCurrentProfile makes profile the active one when --profile is not
+// given.
+func setCurrentProfile(profile string) error {
+	if err := validateProfile(profile); err != nil {
+		return err
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(dir, current_profile_file_name), []byte(profile))
+}
+
+// hasCurrentProfile reports whether a profile was chosen with "profiles use"
+// or at the first login.
+func hasCurrentProfile() bool {
+	dir, err := configDir()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, current_profile_file_name))
+	return err == nil
+}
+
+func validateProfile(profile string) error {
+	if !profile_name_pattern.MatchString(profile) {
+		return fmt.Errorf("invalid profile name %q, use letters, digits, '.', '_' and '-'", profile)
+	}
+	return nil
+}
+
+// profileDir returns the directory holding the token and info of profile.
+func profileDir(profile string) (string, error) {
+	if err := validateProfile(profile); err != nil {
+		return "", err
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "profiles", profile), nil
+}
+
+// listProfiles returns the names of the profiles that hold a token, sorted.
+func listProfiles() ([]string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "profiles"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []string
+	for _, entry := range entries {
+		if entry.IsDir() && profile_name_pattern.MatchString(entry.Name()) && tokenExists(entry.Name()) {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+	return profiles, nil
+}
+
+func readProfileInfo(profile string) (profileInfo, error) {
+	var info profileInfo
+
+	dir, err := profileDir(profile)
+	if err != nil {
+		return info, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, profile_info_file_name))
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+func writeProfileInfo(profile string, info profileInfo) error {
+	dir, err := profileDir(profile)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(dir, profile_info_file_name), data)
+}
+
+// removeProfile deletes the token and info of profile. The active profile
+// falls back to the default when it is removed.
+func removeProfile(profile string) error {
+	if !tokenExists(profile) {
+		return os.ErrNotExist
+	}
+
+	dir, err := profileDir(profile)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	base, err := configDir()
+	if err != nil {
+		return err
+	}
+
+	current := filepath.Join(base, current_profile_file_name)
+	data, err := os.ReadFile(current)
+	if err == nil && strings.TrimSpace(string(data)) == profile {
+		return os.Remove(current)
+	}
+	return nil
+}
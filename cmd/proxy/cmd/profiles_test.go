@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// useProfileFlag sets --profile for the duration of the test.
+func useProfileFlag(t *testing.T, profile string) {
+	t.Helper()
+
+	originalProfile := Profile
+	Profile = profile
+	t.Cleanup(func() { Profile = originalProfile })
+}
+
+func TestActiveProfile(t *testing.T) {
+	useConfigDir(t)
+	useProfileFlag(t, "")
+
+	if profile, err := activeProfile(); err != nil || profile != default_profile {
+		t.Errorf("Expected %s, got %q, %v", default_profile, profile, err)
+	}
+
+	if err := setCurrentProfile("work"); err != nil {
+		t.Fatalf("setCurrentProfile failed: %v", err)
+	}
+	if profile, _ := activeProfile(); profile != "work" {
+		t.Errorf("Expected work, got %q", profile)
+	}
+
+	// The flag wins over the current profile
+	Profile = "personal"
+	if profile, _ := activeProfile(); profile != "personal" {
+		t.Errorf("Expected personal, got %q", profile)
+	}
+}
+
+func TestInvalidProfileNames(t *testing.T) {
+	useConfigDir(t)
+
+	for _, profile := range []string{"", "../escape", "a/b", ".hidden", "-flag"} {
+		if _, err := profileDir(profile); err == nil {
+			t.Errorf("Expected %q to be rejected", profile)
+		}
+		if err := writeToken(profile, "gho_token", false); err == nil {
+			t.Errorf("Expected writing a token for %q to fail", profile)
+		}
+	}
+}
+
+func TestProfilesAreSeparate(t *testing.T) {
+	useConfigDir(t)
+
+	writeToken("personal", "gho_personal", false)
+	writeToken("work", "gho_work", false)
+	writeProfileInfo("work", profileInfo{Username: "octocat"})
+
+	for profile, expected := range map[string]string{"personal": "gho_personal", "work": "gho_work"} {
+		if token, err := readToken(profile); err != nil || token != expected {
+			t.Errorf("Profile %s: expected %s, got %q, %v", profile, expected, token, err)
+		}
+	}
+
+	profiles, err := listProfiles()
+	if err != nil || strings.Join(profiles, ",") != "personal,work" {
+		t.Errorf("Expected personal,work, got %v, %v", profiles, err)
+	}
+
+	info, err := readProfileInfo("work")
+	if err != nil || info.Username != "octocat" {
+		t.Errorf("Expected username octocat, got %+v, %v", info, err)
+	}
+}
+
+func TestRemoveProfile(t *testing.T) {
+	useConfigDir(t)
+	useProfileFlag(t, "")
+
+	writeToken("work", "gho_work", false)
+	setCurrentProfile("work")
+
+	if err := removeProfile("work"); err != nil {
+		t.Fatalf("removeProfile failed: %v", err)
+	}
+	if tokenExists("work") {
+		t.Error("Expected the token to be removed")
+	}
+
+	// The removed profile is no longer the active one
+	if profile, _ := activeProfile(); profile != default_profile {
+		t.Errorf("Expected %s, got %q", default_profile, profile)
+	}
+
+	if err := removeProfile("work"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for a missing profile, got %v", err)
+	}
+}
+
+func TestProfilesListCommand(t *testing.T) {
+	useConfigDir(t)
+	useProfileFlag(t, "")
+
+	writeToken("personal", "gho_personal", false)
+	writeToken("work", "gho_work", false)
+	writeProfileInfo("work", profileInfo{Username: "octocat"})
+	setCurrentProfile("work")
+
+	var out bytes.Buffer
+	profilesListCmd.SetOut(&out)
+	defer profilesListCmd.SetOut(nil)
+
+	profilesListCmd.Run(profilesListCmd, nil)
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 profiles, got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[0], "  personal") || !strings.HasSuffix(lines[0], "-") {
+		t.Errorf("Unexpected line for personal: %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "* work") || !strings.HasSuffix(lines[1], "octocat") {
+		t.Errorf("Unexpected line for work: %q", lines[1])
+	}
+}
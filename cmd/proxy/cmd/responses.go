@@ -0,0 +1,842 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// Response statuses.
+const (
+	responseStatusCompleted  = "completed"
+	responseStatusFailed     = "failed"
+	responseStatusIncomplete = "incomplete"
+	responseStatusInProgress = "in_progress"
+)
+
+// ResponsesRequest is the body of an OpenAI Responses API request.
+type ResponsesRequest struct {
+	Model        *string `json:"model,omitempty"`
+	Instructions string  `json:"instructions,omitempty"`
+	// Input is a string or a list of input items.
+	Input              ResponsesInput      `json:"input"`
+	Tools              []ResponsesTool     `json:"tools,omitempty"`
+	ToolChoice         interface{}         `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool               `json:"parallel_tool_calls,omitempty"`
+	Temperature        *float64            `json:"temperature,omitempty"`
+	TopP               *float64            `json:"top_p,omitempty"`
+	MaxOutputTokens    *int64              `json:"max_output_tokens,omitempty"`
+	Stream             bool                `json:"stream,omitempty"`
+	PreviousResponseID string              `json:"previous_response_id,omitempty"`
+	Store              *bool               `json:"store,omitempty"`
+	Text               *ResponsesText      `json:"text,omitempty"`
+	Reasoning          *ResponsesReasoning `json:"reasoning,omitempty"`
+	User               string              `json:"user,omitempty"`
+	Metadata           map[string]string   `json:"metadata,omitempty"`
+}
+
+// ResponsesInput is a list of input items. A plain string is accepted as a
+// single user message.
+type ResponsesInput []ResponsesInputItem
+
+// ResponsesInputItem is a message, function_call or function_call_output
+// item. Items without a type are messages.
+type ResponsesInputItem struct {
+	Type string `json:"type,omitempty"`
+	ID   string `json:"id,omitempty"`
+
+	// message
+	Role    string           `json:"role,omitempty"`
+	Content ResponsesContent `json:"content,omitempty"`
+
+	// function_call and function_call_output
+	CallID    string           `json:"call_id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Arguments string           `json:"arguments,omitempty"`
+	Output    ResponsesContent `json:"output,omitempty"`
+}
+
+// ResponsesContent is a list of content parts. A plain string is accepted as
+// a single text part.
+type ResponsesContent []ResponsesContentPart
+
+type ResponsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	Refusal  string `json:"refusal,omitempty"`
+}
+
+// ResponsesTool is a function tool; the Responses API flattens the function
+// definition into the tool.
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ResponsesText struct {
+	Format ResponsesTextFormat `json:"format"`
+}
+
+type ResponsesTextFormat struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ResponsesReasoning struct {
+	Effort string `json:"effort,omitempty"`
+}
+
+// ResponseObject is a response in the Responses API format. Output holds
+// ResponsesMessageItem and ResponsesFunctionCallItem values.
+type ResponseObject struct {
+	ID                 string                     `json:"id"`
+	Object             string                     `json:"object"`
+	CreatedAt          int64                      `json:"created_at"`
+	Status             string                     `json:"status"`
+	Error              *ResponseError             `json:"error"`
+	IncompleteDetails  *ResponseIncompleteDetails `json:"incomplete_details"`
+	Instructions       *string                    `json:"instructions"`
+	MaxOutputTokens    *int64                     `json:"max_output_tokens"`
+	Model              string                     `json:"model"`
+	Output             []interface{}              `json:"output"`
+	ParallelToolCalls  bool                       `json:"parallel_tool_calls"`
+	PreviousResponseID *string                    `json:"previous_response_id"`
+	Store              bool                       `json:"store"`
+	Temperature        float64                    `json:"temperature"`
+	TopP               float64                    `json:"top_p"`
+	ToolChoice         interface{}                `json:"tool_choice"`
+	Tools              []ResponsesTool            `json:"tools"`
+	Usage              *ResponsesUsage            `json:"usage"`
+	Metadata           map[string]string          `json:"metadata"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponsesUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+	TotalTokens  int64 `json:"total_tokens"`
+}
+
+type ResponsesMessageItem struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Status  string                `json:"status"`
+	Role    string                `json:"role"`
+	Content []ResponsesOutputText `json:"content"`
+}
+
+type ResponsesOutputText struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type ResponsesFunctionCallItem struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+func (in *ResponsesInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = ResponsesInput{{Type: "message", Role: "user", Content: ResponsesContent{{Type: "input_text", Text: text}}}}
+		return nil
+	}
+
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = items
+	return nil
+}
+
+func (c *ResponsesContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ResponsesContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+
+	var parts []ResponsesContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// text joins the text of the content parts.
+func (c ResponsesContent) text() string {
+	var texts []string
+	for _, part := range c {
+		switch part.Type {
+		case "input_text", "output_text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// payload translates the request into the payload of the chat pipeline.
+// history is the conversation of the previous response, if any.
+func (r ResponsesRequest) payload(history []pkg.Message) (Payload, error) {
+	stream := r.Stream
+	payload := Payload{
+		Model:             r.Model,
+		Temperature:       r.Temperature,
+		TopP:              r.TopP,
+		Stream:            &stream,
+		MaxTokens:         r.MaxOutputTokens,
+		ParallelToolCalls: r.ParallelToolCalls,
+		User:              r.User,
+	}
+
+	if r.Reasoning != nil {
+		payload.ReasoningEffort = r.Reasoning.Effort
+	}
+
+	if r.Text != nil {
+		switch format := r.Text.Format; format.Type {
+		case "", "text":
+		case "json_object":
+			payload.ResponseFormat = &pkg.ResponseFormat{Type: "json_object"}
+		case "json_schema":
+			// The chat API nests the schema, without its type, in json_schema
+			jsonSchema := map[string]interface{}{"name": format.Name, "schema": format.Schema}
+			if format.Description != "" {
+				jsonSchema["description"] = format.Description
+			}
+			if format.Strict != nil {
+				jsonSchema["strict"] = *format.Strict
+			}
+			schema, err := json.Marshal(jsonSchema)
+			if err != nil {
+				return payload, err
+			}
+			payload.ResponseFormat = &pkg.ResponseFormat{Type: "json_schema", JSONSchema: schema}
+		default:
+			return payload, fmt.Errorf("text.format: unsupported type %q", format.Type)
+		}
+	}
+
+	for i, tool := range r.Tools {
+		if tool.Type != "function" {
+			return payload, fmt.Errorf("tools[%d]: unsupported tool type %q", i, tool.Type)
+		}
+		payload.Tools = append(payload.Tools, pkg.Tool{
+			Type: "function",
+			Function: pkg.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	switch choice := r.ToolChoice.(type) {
+	case nil:
+	case string:
+		payload.ToolChoice = choice
+	case map[string]interface{}:
+		if choice["type"] != "function" {
+			return payload, fmt.Errorf("tool_choice: unsupported type %v", choice["type"])
+		}
+		payload.ToolChoice = map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choice["name"]},
+		}
+	default:
+		return payload, fmt.Errorf("tool_choice: expected a string or an object")
+	}
+
+	if r.Instructions != "" {
+		payload.Messages = append(payload.Messages, pkg.Message{Role: "system", Content: r.Instructions})
+	}
+	payload.Messages = append(payload.Messages, history...)
+
+	messages, err := responsesMessages(r.Input)
+	if err != nil {
+		return payload, err
+	}
+	payload.Messages = append(payload.Messages, messages...)
+
+	return payload, nil
+}
+
+// responsesMessages translates input items into chat messages. Consecutive
+// function calls become the tool calls of one assistant message.
+func responsesMessages(items ResponsesInput) ([]pkg.Message, error) {
+	var messages []pkg.Message
+
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			message, err := responsesMessage(item)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %w", i, err)
+			}
+			messages = append(messages, message)
+		case "function_call":
+			toolCall := pkg.ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: pkg.FunctionCall{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}
+
+			last := len(messages) - 1
+			if last >= 0 && messages[last].Role == "assistant" {
+				messages[last].ToolCalls = append(messages[last].ToolCalls, toolCall)
+			} else {
+				messages = append(messages, pkg.Message{Role: "assistant", ToolCalls: []pkg.ToolCall{toolCall}})
+			}
+		case "function_call_output":
+			messages = append(messages, pkg.Message{Role: "tool", ToolCallID: item.CallID, Content: item.Output.text()})
+		case "reasoning":
+			// Reasoning from earlier turns cannot be replayed to Copilot
+		default:
+			return nil, fmt.Errorf("input[%d]: unsupported item type %q", i, item.Type)
+		}
+	}
+
+	return messages, nil
+}
+
+func responsesMessage(item ResponsesInputItem) (pkg.Message, error) {
+	role := item.Role
+	// Copilot does not know the developer role
+	if role == "developer" {
+		role = "system"
+	}
+	message := pkg.Message{Role: role}
+
+	var parts []pkg.ContentPart
+	hasImages := false
+
+	for j, part := range item.Content {
+		switch part.Type {
+		case "input_text", "output_text":
+			parts = append(parts, pkg.ContentPart{Type: "text", Text: part.Text})
+		case "refusal":
+			parts = append(parts, pkg.ContentPart{Type: "text", Text: part.Refusal})
+		case "input_image":
+			if part.ImageURL == "" {
+				return message, fmt.Errorf("content[%d]: only image_url images are supported", j)
+			}
+			parts = append(parts, pkg.ContentPart{Type: "image_url", ImageURL: &pkg.ImageURL{URL: part.ImageURL, Detail: part.Detail}})
+			hasImages = true
+		default:
+			return message, fmt.Errorf("content[%d]: unsupported content type %q", j, part.Type)
+		}
+	}
+
+	if hasImages {
+		message.MultiContent = parts
+		return message, nil
+	}
+
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		texts = append(texts, part.Text)
+	}
+	message.Content = strings.Join(texts, "\n\n")
+	return message, nil
+}
+
+func newResponseID() string {
+	return "resp_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func newResponseItemID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// newResponseObject returns an in-progress response echoing the request.
+func newResponseObject(payload ResponsesRequest, request pkg.CompletionRequest, store bool) ResponseObject {
+	response := ResponseObject{
+		ID:                newResponseID(),
+		Object:            "response",
+		CreatedAt:         time.Now().Unix(),
+		Status:            responseStatusInProgress,
+		MaxOutputTokens:   payload.MaxOutputTokens,
+		Model:             request.Model,
+		Output:            []interface{}{},
+		ParallelToolCalls: payload.ParallelToolCalls == nil || *payload.ParallelToolCalls,
+		Store:             store,
+		Temperature:       request.Temperature,
+		TopP:              request.TopP,
+		ToolChoice:        payload.ToolChoice,
+		Tools:             payload.Tools,
+		Metadata:          payload.Metadata,
+	}
+
+	if payload.Instructions != "" {
+		response.Instructions = &payload.Instructions
+	}
+	if payload.PreviousResponseID != "" {
+		response.PreviousResponseID = &payload.PreviousResponseID
+	}
+	if response.ToolChoice == nil {
+		response.ToolChoice = "auto"
+	}
+	if response.Tools == nil {
+		response.Tools = []ResponsesTool{}
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+
+	return response
+}
+
+// finish sets the status and usage of the response from the finish reason
+// of the completion.
+func (r *ResponseObject) finish(finishReason string, usage pkg.Usage) {
+	r.Status = responseStatusCompleted
+	switch finishReason {
+	case pkg.FinishReasonLength:
+		r.Status = responseStatusIncomplete
+		r.IncompleteDetails = &ResponseIncompleteDetails{Reason: "max_output_tokens"}
+	case pkg.FinishReasonContentFilter:
+		r.Status = responseStatusIncomplete
+		r.IncompleteDetails = &ResponseIncompleteDetails{Reason: "content_filter"}
+	}
+
+	r.Usage = &ResponsesUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.PromptTokens + usage.CompletionTokens,
+	}
+}
+
+// storeResponse saves the response and its conversation for chaining.
+// Failing to store it does not fail the request.
+func storeResponse(response ResponseObject, history []pkg.Message, input ResponsesInput, output pkg.Message) {
+	messages, _ := responsesMessages(input)
+
+	conversation := make([]pkg.Message, 0, len(history)+len(messages)+1)
+	conversation = append(conversation, history...)
+	conversation = append(conversation, messages...)
+	if output.Content != "" || len(output.ToolCalls) > 0 {
+		conversation = append(conversation, output)
+	}
+
+	if err := responses.put(storedResponse{Response: response, Messages: conversation}); err != nil {
+		log.Error().
+			Err(err).
+			Str("response_id", response.ID).
+			Msg("Failed to store response")
+	}
+}
+
+func responsesHandler(c *fiber.Ctx) error {
+	var payload ResponsesRequest
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/v1/responses").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("Invalid request payload", errorTypeInvalidRequest, ""))
+	}
+
+	var history []pkg.Message
+	if payload.PreviousResponseID != "" {
+		previous, ok, err := responses.get(payload.PreviousResponseID)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("response_id", payload.PreviousResponseID).
+				Msg("Failed to load previous response")
+			return c.Status(fiber.StatusInternalServerError).JSON(errorObject("Failed to load previous response", errorTypeServer, ""))
+		}
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(errorObject(fmt.Sprintf("Previous response with id '%s' not found.", payload.PreviousResponseID), errorTypeInvalidRequest, "previous_response_not_found"))
+		}
+		history = previous.Messages
+	}
+
+	chatPayload, err := payload.payload(history)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject(err.Error(), errorTypeInvalidRequest, ""))
+	}
+	if len(chatPayload.Messages) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("input: at least one item is required", errorTypeInvalidRequest, ""))
+	}
+
+	request := chatPayload.completionRequest()
+	if err := resolveImages(request.Messages); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject(err.Error(), errorTypeInvalidRequest, "invalid_image"))
+	}
+
+	store := payload.Store == nil || *payload.Store
+	response := newResponseObject(payload, request, store)
+
+	log.Debug().
+		Int("message_count", len(request.Messages)).
+		Str("model", request.Model).
+		Bool("stream", request.Stream).
+		Str("previous_response_id", payload.PreviousResponseID).
+		Msg("Processing responses request")
+
+	if request.Stream {
+		err := streamResponse(c, request, func(w *bufio.Writer, chatStream *pkg.ChatStream) {
+			output, err := writeResponsesStream(w, chatStream, request, &response)
+			if err != nil {
+				log.Debug().
+					Err(err).
+					Str("model", request.Model).
+					Str("response_id", response.ID).
+					Msg("Client disconnected, aborted streaming response")
+				return
+			}
+
+			if store && response.Status != responseStatusFailed {
+				storeResponse(response, history, payload.Input, output)
+			}
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", request.Model).
+				Msg("Failed to get streaming response")
+			return sendUpstreamError(c, err)
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+
+		return nil
+	}
+
+	completionResp, err := completeChat(c.UserContext(), request)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Msg("Failed to get response")
+		return sendUpstreamError(c, err)
+	}
+
+	// Copilot may split text and tool calls over several choices, so the
+	// content of all choices is merged into one message item followed by
+	// the function calls
+	output := pkg.Message{Role: "assistant"}
+	var texts []string
+	var completion strings.Builder
+	finishReason := ""
+
+	for _, choice := range completionResp.Choices {
+		message := choice.Message
+		if message == nil {
+			message = choice.Delta
+		}
+		if message == nil {
+			continue
+		}
+
+		if message.Content != "" {
+			texts = append(texts, message.Content)
+		}
+		output.ToolCalls = append(output.ToolCalls, message.ToolCalls...)
+		writeCompletion(&completion, message)
+
+		if finishReason == "" || choice.FinishReason == pkg.FinishReasonLength {
+			finishReason = choice.FinishReason
+		}
+	}
+	output.Content = strings.Join(texts, "\n\n")
+
+	if output.Content != "" {
+		response.Output = append(response.Output, responsesMessageItem(newResponseItemID("msg"), output.Content, responseStatusCompleted))
+	}
+	for i, toolCall := range output.ToolCalls {
+		if toolCall.ID == "" {
+			output.ToolCalls[i].ID = newResponseItemID("call")
+		}
+		response.Output = append(response.Output, ResponsesFunctionCallItem{
+			Type:      "function_call",
+			ID:        newResponseItemID("fc"),
+			CallID:    output.ToolCalls[i].ID,
+			Name:      toolCall.Function.Name,
+			Arguments: toolCall.Function.Arguments,
+			Status:    responseStatusCompleted,
+		})
+	}
+
+	usage := completionResp.Usage
+	if usage == (pkg.Usage{}) {
+		usage = estimateUsage(request.Model, request.Messages, completion.String())
+	}
+	response.finish(finishReason, usage)
+
+	if store {
+		storeResponse(response, history, payload.Input, output)
+	}
+
+	return c.JSON(response)
+}
+
+// responseHandler returns a stored response.
+func responseHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	stored, ok, err := responses.get(id)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("response_id", id).
+			Msg("Failed to load response")
+		return c.Status(fiber.StatusInternalServerError).JSON(errorObject("Failed to load response", errorTypeServer, ""))
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(errorObject(fmt.Sprintf("Response with id '%s' not found.", id), errorTypeInvalidRequest, ""))
+	}
+
+	return c.JSON(stored.Response)
+}
+
+func responsesMessageItem(id, text, status string) ResponsesMessageItem {
+	item := ResponsesMessageItem{
+		Type:    "message",
+		ID:      id,
+		Status:  status,
+		Role:    "assistant",
+		Content: []ResponsesOutputText{},
+	}
+	if status == responseStatusCompleted {
+		item.Content = append(item.Content, ResponsesOutputText{Type: "output_text", Text: text, Annotations: []interface{}{}})
+	}
+	return item
+}
+
+// writeResponsesStream translates the chunks of chatStream into Responses
+// API events and completes response. It returns the generated message for
+// storage, and an error only when writing to the client fails.
+func writeResponsesStream(w *bufio.Writer, chatStream *pkg.ChatStream, request pkg.CompletionRequest, response *ResponseObject) (pkg.Message, error) {
+	output := pkg.Message{Role: "assistant"}
+
+	sequence := 0
+	emit := func(event string, data fiber.Map) error {
+		data["type"] = event
+		data["sequence_number"] = sequence
+		sequence++
+		return writeNamedEvent(w, event, data)
+	}
+
+	if err := emit("response.created", fiber.Map{"response": response}); err != nil {
+		return output, err
+	}
+	if err := emit("response.in_progress", fiber.Map{"response": response}); err != nil {
+		return output, err
+	}
+
+	// Output items are sent one after another: an item is done as soon as
+	// content for another item arrives
+	var messageItem *ResponsesMessageItem
+	var callItem *ResponsesFunctionCallItem
+	var text strings.Builder
+	toolCalls := map[int64]int{}
+
+	finishItem := func() error {
+		outputIndex := len(response.Output)
+		switch {
+		case messageItem != nil:
+			item := responsesMessageItem(messageItem.ID, text.String(), responseStatusCompleted)
+			part := item.Content[0]
+			messageItem = nil
+
+			output.Content += text.String()
+			text.Reset()
+
+			if err := emit("response.output_text.done", fiber.Map{"item_id": item.ID, "output_index": outputIndex, "content_index": 0, "text": part.Text}); err != nil {
+				return err
+			}
+			if err := emit("response.content_part.done", fiber.Map{"item_id": item.ID, "output_index": outputIndex, "content_index": 0, "part": part}); err != nil {
+				return err
+			}
+			response.Output = append(response.Output, item)
+			return emit("response.output_item.done", fiber.Map{"output_index": outputIndex, "item": item})
+		case callItem != nil:
+			item := *callItem
+			item.Status = responseStatusCompleted
+			callItem = nil
+
+			if err := emit("response.function_call_arguments.done", fiber.Map{"item_id": item.ID, "output_index": outputIndex, "arguments": item.Arguments}); err != nil {
+				return err
+			}
+			response.Output = append(response.Output, item)
+			return emit("response.output_item.done", fiber.Map{"output_index": outputIndex, "item": item})
+		}
+		return nil
+	}
+
+	var completion strings.Builder
+	finishReason := ""
+
+	for chatStream.Next() {
+		for _, choice := range chatStream.Current().Choices {
+			if choice.FinishReason != "" && (finishReason == "" || choice.FinishReason == pkg.FinishReasonLength) {
+				finishReason = choice.FinishReason
+			}
+
+			delta := choice.Delta
+			if delta == nil {
+				continue
+			}
+			writeCompletion(&completion, delta)
+
+			if delta.Content != "" {
+				if messageItem == nil {
+					if err := finishItem(); err != nil {
+						return output, err
+					}
+					item := responsesMessageItem(newResponseItemID("msg"), "", responseStatusInProgress)
+					messageItem = &item
+
+					outputIndex := len(response.Output)
+					if err := emit("response.output_item.added", fiber.Map{"output_index": outputIndex, "item": item}); err != nil {
+						return output, err
+					}
+					part := ResponsesOutputText{Type: "output_text", Text: "", Annotations: []interface{}{}}
+					if err := emit("response.content_part.added", fiber.Map{"item_id": item.ID, "output_index": outputIndex, "content_index": 0, "part": part}); err != nil {
+						return output, err
+					}
+				}
+
+				text.WriteString(delta.Content)
+				err := emit("response.output_text.delta", fiber.Map{
+					"item_id":       messageItem.ID,
+					"output_index":  len(response.Output),
+					"content_index": 0,
+					"delta":         delta.Content,
+				})
+				if err != nil {
+					return output, err
+				}
+			}
+
+			for i, toolCall := range delta.ToolCalls {
+				key := int64(i)
+				if toolCall.Index != nil {
+					key = *toolCall.Index
+				}
+
+				if _, ok := toolCalls[key]; !ok {
+					if err := finishItem(); err != nil {
+						return output, err
+					}
+
+					callID := toolCall.ID
+					if callID == "" {
+						callID = newResponseItemID("call")
+					}
+					callItem = &ResponsesFunctionCallItem{
+						Type:   "function_call",
+						ID:     newResponseItemID("fc"),
+						CallID: callID,
+						Name:   toolCall.Function.Name,
+						Status: responseStatusInProgress,
+					}
+					toolCalls[key] = len(output.ToolCalls)
+					output.ToolCalls = append(output.ToolCalls, pkg.ToolCall{
+						ID:       callID,
+						Type:     "function",
+						Function: pkg.FunctionCall{Name: toolCall.Function.Name},
+					})
+
+					if err := emit("response.output_item.added", fiber.Map{"output_index": len(response.Output), "item": callItem}); err != nil {
+						return output, err
+					}
+				}
+
+				if toolCall.Function.Arguments == "" {
+					continue
+				}
+				output.ToolCalls[toolCalls[key]].Function.Arguments += toolCall.Function.Arguments
+				if callItem == nil || callItem.CallID != output.ToolCalls[toolCalls[key]].ID {
+					// Arguments of a call that is already done cannot be
+					// streamed any more
+					continue
+				}
+				callItem.Arguments += toolCall.Function.Arguments
+
+				err := emit("response.function_call_arguments.delta", fiber.Map{
+					"item_id":      callItem.ID,
+					"output_index": len(response.Output),
+					"delta":        toolCall.Function.Arguments,
+				})
+				if err != nil {
+					return output, err
+				}
+			}
+		}
+	}
+
+	if err := chatStream.Err(); err != nil {
+		log.Error().
+			Err(err).
+			Str("model", request.Model).
+			Str("response_id", response.ID).
+			Msg("Streaming response failed")
+
+		status, message := upstreamErrorMessage(err)
+		code := "server_error"
+		if status == fiber.StatusTooManyRequests {
+			code = "rate_limit_exceeded"
+		}
+		response.Status = responseStatusFailed
+		response.Error = &ResponseError{Code: code, Message: message}
+		return output, emit("response.failed", fiber.Map{"response": response})
+	}
+
+	if err := finishItem(); err != nil {
+		return output, err
+	}
+
+	usage := chatStream.Usage()
+	if usage == (pkg.Usage{}) {
+		usage = estimateUsage(request.Model, request.Messages, completion.String())
+	}
+	response.finish(finishReason, usage)
+
+	event := "response.completed"
+	if response.Status == responseStatusIncomplete {
+		event = "response.incomplete"
+	}
+	return output, emit(event, fiber.Map{"response": response})
+}
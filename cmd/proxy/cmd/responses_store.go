@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// responses_store_size is how many responses the in-memory store keeps
+// before it forgets the oldest.
+const responses_store_size = 1000
+
+// responses stores the responses that can be chained with
+// previous_response_id. It is replaced by a file store when --responses-dir
+// is set.
+var responses responseStore = newMemoryResponseStore(responses_store_size)
+
+// response_id_pattern matches the IDs the proxy hands out, which keeps IDs
+// sent by clients from escaping the store directory.
+var response_id_pattern = regexp.MustCompile(`^resp_[0-9a-f]+$`)
+
+// storedResponse is a response together with the conversation that led to
+// it, so that a follow-up request only needs to send its new input.
+type storedResponse struct {
+	Response ResponseObject `json:"response"`
+	// Messages holds the input and output of the response and all responses
+	// before it, without instructions, which are not carried over.
+	Messages []pkg.Message `json:"messages"`
+}
+
+// responseStore keeps responses by ID. Implementations are safe for
+// concurrent use.
+type responseStore interface {
+	get(id string) (storedResponse, bool, error)
+	put(stored storedResponse) error
+}
+
+// memoryResponseStore keeps up to size responses in memory.
+type memoryResponseStore struct {
+	mu        sync.Mutex
+	size      int
+	responses map[string]storedResponse
+	// order is a ring of the stored IDs. Once it is full, oldest is the
+	// index of the ID that is evicted next.
+	order  []string
+	oldest int
+}
+
+func newMemoryResponseStore(size int) *memoryResponseStore {
+	return &memoryResponseStore{size: size, responses: map[string]storedResponse{}}
+}
+
+func (s *memoryResponseStore) get(id string) (storedResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.responses[id]
+	return stored, ok, nil
+}
+
+func (s *memoryResponseStore) put(stored storedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size <= 0 {
+		return nil
+	}
+
+	id := stored.Response.ID
+	if _, ok := s.responses[id]; !ok {
+		if len(s.order) < s.size {
+			s.order = append(s.order, id)
+		} else {
+			delete(s.responses, s.order[s.oldest])
+			s.order[s.oldest] = id
+			s.oldest = (s.oldest + 1) % s.size
+		}
+	}
+	s.responses[id] = stored
+	return nil
+}
+
+// fileResponseStore keeps every response as a JSON file in dir, so that
+// conversations survive a restart.
+type fileResponseStore struct {
+	dir string
+}
+
+func newFileResponseStore(dir string) (*fileResponseStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileResponseStore{dir: dir}, nil
+}
+
+func (s *fileResponseStore) path(id string) (string, error) {
+	if !response_id_pattern.MatchString(id) {
+		return "", fmt.Errorf("invalid response id %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *fileResponseStore) get(id string) (storedResponse, bool, error) {
+	var stored storedResponse
+
+	path, err := s.path(id)
+	if err != nil {
+		// An ID the proxy cannot have handed out is simply unknown
+		return stored, false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stored, false, nil
+	}
+	if err != nil {
+		return stored, false, err
+	}
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return stored, false, err
+	}
+	return stored, true, nil
+}
+
+func (s *fileResponseStore) put(stored storedResponse) error {
+	path, err := s.path(stored.Response.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a partial
+	// response
+	file, err := os.CreateTemp(s.dir, ".response-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,396 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+// useResponseStore gives the test an empty in-memory response store.
+func useResponseStore(t *testing.T) {
+	t.Helper()
+
+	original := responses
+	responses = newMemoryResponseStore(responses_store_size)
+	t.Cleanup(func() {
+		responses = original
+	})
+}
+
+func postResponses(t *testing.T, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func TestResponsesPayload(t *testing.T) {
+	body := `{
+		"model": "gpt-4o",
+		"instructions": "Be brief.",
+		"max_output_tokens": 50,
+		"reasoning": {"effort": "low"},
+		"text": {"format": {"type": "json_schema", "name": "weather", "schema": {"type": "object"}, "strict": true}},
+		"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object"}}],
+		"tool_choice": {"type": "function", "name": "get_weather"},
+		"input": [
+			{"role": "developer", "content": "Use metric units."},
+			{"type": "message", "role": "user", "content": [
+				{"type": "input_text", "text": "Weather here?"},
+				{"type": "input_image", "image_url": "https://example.com/street.png"}
+			]},
+			{"type": "reasoning", "id": "rs_1", "summary": []},
+			{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\":\"Ottawa\"}"},
+			{"type": "function_call", "call_id": "call_2", "name": "get_weather", "arguments": "{\"city\":\"Paris\"}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "Sunny"},
+			{"type": "function_call_output", "call_id": "call_2", "output": [{"type": "input_text", "text": "Rain"}]}
+		]
+	}`
+
+	var request ResponsesRequest
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	history := []pkg.Message{{Role: "user", Content: "Earlier"}, {Role: "assistant", Content: "Reply"}}
+	payload, err := request.payload(history)
+	if err != nil {
+		t.Fatalf("Failed to translate request: %v", err)
+	}
+
+	completion := payload.completionRequest()
+	if completion.Model != "gpt-4o" || *completion.MaxTokens != 50 || completion.ReasoningEffort != "low" || completion.Stream {
+		t.Errorf("Unexpected request: %+v", completion)
+	}
+	if completion.ResponseFormat == nil || string(completion.ResponseFormat.JSONSchema) != `{"name":"weather","schema":{"type":"object"},"strict":true}` {
+		t.Errorf("Unexpected response format: %+v", completion.ResponseFormat)
+	}
+	if len(completion.Tools) != 1 || completion.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("Unexpected tools: %+v", completion.Tools)
+	}
+	if choice, _ := json.Marshal(completion.ToolChoice); string(choice) != `{"function":{"name":"get_weather"},"type":"function"}` {
+		t.Errorf("Unexpected tool_choice: %s", choice)
+	}
+
+	roles := []string{}
+	for _, message := range completion.Messages {
+		roles = append(roles, message.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,system,user,assistant,tool,tool" {
+		t.Fatalf("Unexpected roles: %v", roles)
+	}
+
+	if completion.Messages[0].Content != "Be brief." || completion.Messages[1].Content != "Earlier" {
+		t.Errorf("Expected instructions followed by the history, got %+v", completion.Messages[:2])
+	}
+	if parts := completion.Messages[4].MultiContent; len(parts) != 2 || parts[1].ImageURL.URL != "https://example.com/street.png" {
+		t.Errorf("Unexpected user parts: %+v", parts)
+	}
+	if calls := completion.Messages[5].ToolCalls; len(calls) != 2 || calls[1].ID != "call_2" {
+		t.Errorf("Expected both function calls in one assistant message, got %+v", calls)
+	}
+	if completion.Messages[6].ToolCallID != "call_1" || completion.Messages[7].Content != "Rain" {
+		t.Errorf("Unexpected tool messages: %+v", completion.Messages[6:])
+	}
+}
+
+func TestResponsesPayloadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"built-in tool", `{"input":"Hi","tools":[{"type":"web_search"}]}`},
+		{"file input", `{"input":[{"role":"user","content":[{"type":"input_file","file_id":"file_1"}]}]}`},
+		{"item reference", `{"input":[{"type":"item_reference","id":"msg_1"}]}`},
+		{"text format", `{"input":"Hi","text":{"format":{"type":"yaml"}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request ResponsesRequest
+			if err := json.Unmarshal([]byte(tt.body), &request); err != nil {
+				t.Fatalf("Failed to decode request: %v", err)
+			}
+			if _, err := request.payload(nil); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestResponsesEndpoint(t *testing.T) {
+	useResponseStore(t)
+
+	var upstreamRequests []pkg.CompletionRequest
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var request pkg.CompletionRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		upstreamRequests = append(upstreamRequests, request)
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(upstreamRequests) == 1 {
+			fmt.Fprint(w, `{"choices":[
+				{"message":{"role":"assistant","content":"Checking."},"finish_reason":"stop"},
+				{"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]},"finish_reason":"tool_calls"}
+			],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"It is sunny."},"finish_reason":"stop"}]}`)
+	})
+
+	resp, data := postResponses(t, `{"model":"gpt-4o","instructions":"Be brief.","input":"Weather?","metadata":{"session":"1"}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var first map[string]interface{}
+	if err := json.Unmarshal(data, &first); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", data, err)
+	}
+
+	id, _ := first["id"].(string)
+	if !strings.HasPrefix(id, "resp_") || first["object"] != "response" || first["status"] != "completed" || first["model"] != "gpt-4o" {
+		t.Errorf("Unexpected response envelope: %s", data)
+	}
+	if first["instructions"] != "Be brief." || first["metadata"].(map[string]interface{})["session"] != "1" {
+		t.Errorf("Expected instructions and metadata to be echoed: %s", data)
+	}
+
+	output := first["output"].([]interface{})
+	if len(output) != 2 {
+		t.Fatalf("Expected a message and a function call, got %s", data)
+	}
+	message := output[0].(map[string]interface{})
+	content := message["content"].([]interface{})[0].(map[string]interface{})
+	if message["type"] != "message" || message["role"] != "assistant" || content["type"] != "output_text" || content["text"] != "Checking." {
+		t.Errorf("Unexpected message item: %v", message)
+	}
+	call := output[1].(map[string]interface{})
+	if call["type"] != "function_call" || call["call_id"] != "call_1" || call["name"] != "get_weather" || call["arguments"] != "{}" {
+		t.Errorf("Unexpected function call item: %v", call)
+	}
+
+	usage := first["usage"].(map[string]interface{})
+	if usage["input_tokens"] != float64(10) || usage["output_tokens"] != float64(5) || usage["total_tokens"] != float64(15) {
+		t.Errorf("Unexpected usage: %v", usage)
+	}
+
+	// Chain a function call output onto the stored response
+	body := `{"model":"gpt-4o","previous_response_id":"` + id + `","input":[{"type":"function_call_output","call_id":"call_1","output":"Sunny"}]}`
+	resp, data = postResponses(t, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var second ResponseObject
+	json.Unmarshal(data, &second)
+	if second.PreviousResponseID == nil || *second.PreviousResponseID != id {
+		t.Errorf("Expected previous_response_id %s, got %v", id, second.PreviousResponseID)
+	}
+
+	// Instructions are not carried over
+	roles := []string{}
+	for _, message := range upstreamRequests[1].Messages {
+		roles = append(roles, message.Role)
+	}
+	if strings.Join(roles, ",") != "user,assistant,tool" {
+		t.Fatalf("Expected the stored conversation before the new input, got %v", roles)
+	}
+	assistant := upstreamRequests[1].Messages[1]
+	if assistant.Content != "Checking." || len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID != "call_1" {
+		t.Errorf("Unexpected stored assistant message: %+v", assistant)
+	}
+
+	var stored ResponseObject
+	if status := getJSON(t, "/v1/responses/"+second.ID, &stored); status != http.StatusOK || stored.ID != second.ID {
+		t.Errorf("Expected the stored response, got %d: %+v", status, stored)
+	}
+}
+
+func TestResponsesEndpointNotStored(t *testing.T) {
+	useResponseStore(t)
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"length"}]}`)
+	})
+
+	resp, data := postResponses(t, `{"input":"Hi","store":false}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, data)
+	}
+
+	var response ResponseObject
+	json.Unmarshal(data, &response)
+	if response.Status != "incomplete" || response.IncompleteDetails == nil || response.IncompleteDetails.Reason != "max_output_tokens" {
+		t.Errorf("Expected an incomplete response, got %s", data)
+	}
+
+	var body map[string]interface{}
+	if status := getJSON(t, "/v1/responses/"+response.ID, &body); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unstored response, got %d", status)
+	}
+
+	resp, data = postResponses(t, `{"input":"Hi","previous_response_id":"`+response.ID+`"}`)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(data), "previous_response_not_found") {
+		t.Errorf("Expected status 404, got %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestResponsesEndpointStreaming(t *testing.T) {
+	useResponseStore(t)
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeUpstreamChunk(w, "Let me ", "")
+		writeUpstreamChunk(w, "check.", "")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Ottawa\"}"}}]}}]}`+"\n\n")
+		writeUpstreamChunk(w, "", "tool_calls")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{"model":"gpt-4o","stream":true,"input":"Weather?"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", ct)
+	}
+
+	events := readNamedEvents(t, resp.Body)
+
+	names := []string{}
+	for i, event := range events {
+		names = append(names, event.name)
+		if event.data["sequence_number"] != float64(i) {
+			t.Errorf("Expected sequence_number %d, got %v", i, event.data["sequence_number"])
+		}
+	}
+	want := []string{
+		"response.created", "response.in_progress",
+		"response.output_item.added", "response.content_part.added",
+		"response.output_text.delta", "response.output_text.delta",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta", "response.function_call_arguments.delta",
+		"response.function_call_arguments.done", "response.output_item.done",
+		"response.completed",
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected events %v, got %v", want, names)
+	}
+
+	if events[6].data["text"] != "Let me check." {
+		t.Errorf("Expected the full text, got %v", events[6].data["text"])
+	}
+	if events[12].data["arguments"] != `{"city":"Ottawa"}` || events[12].data["output_index"] != float64(1) {
+		t.Errorf("Unexpected arguments done event: %v", events[12].data)
+	}
+
+	completed := events[14].data["response"].(map[string]interface{})
+	if completed["status"] != "completed" || len(completed["output"].([]interface{})) != 2 {
+		t.Errorf("Unexpected completed response: %v", completed)
+	}
+
+	stored, ok, _ := responses.get(completed["id"].(string))
+	if !ok {
+		t.Fatal("Expected the streamed response to be stored")
+	}
+	last := stored.Messages[len(stored.Messages)-1]
+	if last.Content != "Let me check." || len(last.ToolCalls) != 1 || last.ToolCalls[0].Function.Arguments != `{"city":"Ottawa"}` {
+		t.Errorf("Unexpected stored output: %+v", last)
+	}
+}
+
+func TestMemoryResponseStoreEvictsOldest(t *testing.T) {
+	store := newMemoryResponseStore(2)
+	for _, id := range []string{"resp_1", "resp_2", "resp_3"} {
+		store.put(storedResponse{Response: ResponseObject{ID: id}})
+	}
+
+	if _, ok, _ := store.get("resp_1"); ok {
+		t.Error("Expected the oldest response to be evicted")
+	}
+	if _, ok, _ := store.get("resp_3"); !ok {
+		t.Error("Expected the newest response to be kept")
+	}
+
+	// Eviction keeps going round without growing the store
+	for i := 4; i <= 100; i++ {
+		store.put(storedResponse{Response: ResponseObject{ID: fmt.Sprintf("resp_%d", i)}})
+	}
+	if _, ok, _ := store.get("resp_98"); ok {
+		t.Error("Expected resp_98 to be evicted")
+	}
+	for _, id := range []string{"resp_99", "resp_100"} {
+		if _, ok, _ := store.get(id); !ok {
+			t.Errorf("Expected %s to be kept", id)
+		}
+	}
+	if len(store.responses) != 2 || cap(store.order) != 2 {
+		t.Errorf("Expected 2 stored responses in a ring of 2, got %d in %d", len(store.responses), cap(store.order))
+	}
+}
+
+func TestFileResponseStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "responses")
+	store, err := newFileResponseStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	stored := storedResponse{
+		Response: ResponseObject{ID: "resp_abc123", Output: []interface{}{}},
+		Messages: []pkg.Message{
+			{Role: "user", MultiContent: []pkg.ContentPart{{Type: "text", Text: "Hi"}}},
+			{Role: "assistant", ToolCalls: []pkg.ToolCall{{ID: "call_1", Type: "function"}}},
+		},
+	}
+	if err := store.put(stored); err != nil {
+		t.Fatalf("Failed to store response: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "resp_abc123.json"))
+	if err != nil {
+		t.Fatalf("Expected a response file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	got, ok, err := store.get("resp_abc123")
+	if err != nil || !ok {
+		t.Fatalf("Expected the stored response, got %v %v", ok, err)
+	}
+	if len(got.Messages) != 2 || got.Messages[0].MultiContent[0].Text != "Hi" || got.Messages[1].ToolCalls[0].ID != "call_1" {
+		t.Errorf("Unexpected messages: %+v", got.Messages)
+	}
+
+	if _, ok, err := store.get("../../etc/passwd"); ok || err != nil {
+		t.Errorf("Expected an unknown response for an invalid ID, got %v %v", ok, err)
+	}
+	if err := store.put(storedResponse{Response: ResponseObject{ID: "../escape"}}); err == nil {
+		t.Error("Expected an error for an invalid ID")
+	}
+}
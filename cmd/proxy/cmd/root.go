@@ -9,6 +9,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&Config_dir, "config-dir", "", "directory to store credentials in (default: go-copilot-proxy in the user config directory)")
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "go-copilot-proxy",
 	Short: "Go Copilot Proxy is a proxy server for GitHub Copilot",
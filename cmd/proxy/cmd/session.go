@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// withSession calls fn with the session token of an account from the pool.
+// When the upstream rejects the token, it is refreshed and fn is called once
+// more. An account that is rate limited or whose token is rejected again is
+// put into cooldown and fn is retried with the next account.
+//
+// The request counts against the account until ctx is done, so ctx must be
+// cancelled once the upstream response has been consumed.
+func withSession(ctx context.Context, fn func(token string) error) error {
+	if accounts == nil {
+		return errNoAccounts
+	}
+
+	tried := map[*account]bool{}
+
+	var lastErr error
+	for {
+		a, availableAt := accounts.pick(tried)
+		if a == nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return &pkg.APIError{
+				StatusCode: fiber.StatusTooManyRequests,
+				Message:    "All Copilot accounts are cooling down, try again later",
+				RetryAfter: time.Until(availableAt),
+			}
+		}
+		tried[a] = true
+
+		release := a.acquire(ctx)
+
+		err := a.call(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		release()
+
+		d, ok := cooldown(err)
+		if !ok {
+			return err
+		}
+
+		a.fail(err, d)
+		log.Warn().
+			Err(err).
+			Str("profile", a.profile).
+			Dur("cooldown", d).
+			Msg("Account is cooling down, failing over")
+		lastErr = err
+	}
+}
+
+// call calls fn with the session token of a, refreshing the token once when
+// the upstream rejects it.
+func (a *account) call(ctx context.Context, fn func(token string) error) error {
+	token, err := a.sessions.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(token)
+
+	var apiErr *pkg.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != fiber.StatusUnauthorized {
+		return err
+	}
+
+	log.Warn().Str("profile", a.profile).Msg("Session token was rejected, refreshing it")
+	a.sessions.Invalidate(token)
+
+	if token, err = a.sessions.Token(ctx); err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+// completeChat sends a non-streaming chat request with an account from the
+// pool and returns the response, which has at least one choice. The request
+// counts against the account until the response has been read.
+func completeChat(ctx context.Context, request pkg.CompletionRequest) (pkg.CompletionResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var completionResp pkg.CompletionResponse
+
+	chatStream, err := streamChat(ctx, request)
+	if err != nil {
+		return completionResp, err
+	}
+	defer chatStream.Close()
+
+	if chatStream.Next() {
+		completionResp = chatStream.Current()
+	}
+	if err := chatStream.Err(); err != nil {
+		return completionResp, err
+	}
+
+	if len(completionResp.Choices) == 0 {
+		log.Error().
+			Interface("response", completionResp).
+			Msg("Empty choices array in completion response")
+		return completionResp, errors.New("no choices in completion response")
+	}
+
+	return completionResp, nil
+}
+
+// streamResponse opens a chat stream for request and passes it to write once
+// the response body is being sent. An error opening the stream is returned
+// before anything is sent, so that it can be reported with a matching status
+// code; the caller sets the response headers otherwise. The upstream request
+// is cancelled when write returns, which must be as soon as a write to the
+// client fails, i.e. when it disconnects.
+func streamResponse(c *fiber.Ctx, request pkg.CompletionRequest, write func(w *bufio.Writer, chatStream *pkg.ChatStream)) error {
+	ctx, cancel := context.WithCancel(c.UserContext())
+
+	chatStream, err := streamChat(ctx, request)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		defer chatStream.Close()
+
+		write(w, chatStream)
+	})
+
+	return nil
+}
+
+// streamChat opens a chat stream with the session token of an account from
+// the pool.
+func streamChat(ctx context.Context, request pkg.CompletionRequest) (*pkg.ChatStream, error) {
+	var chatStream *pkg.ChatStream
+	err := withSession(ctx, func(token string) (err error) {
+		chatStream, err = client.StreamChat(ctx, token, request)
+		return err
+	})
+	return chatStream, err
+}
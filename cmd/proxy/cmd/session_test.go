@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+func TestChatHandlerRefreshesRejectedSessionToken(t *testing.T) {
+	var sessionRequests, chatRequests int
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/copilot_internal/v2/token":
+			sessionRequests++
+			if r.Header.Get("authorization") != "token access-token" {
+				t.Errorf("Expected the access token, got %q", r.Header.Get("authorization"))
+			}
+			json.NewEncoder(w).Encode(pkg.SessionResponse{Token: "fresh-token"})
+		case "/chat/completions":
+			chatRequests++
+			if r.Header.Get("authorization") != "Bearer fresh-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":{"message":"token expired"}}`))
+				return
+			}
+			json.NewEncoder(w).Encode(pkg.CompletionResponse{
+				Choices: []pkg.Choice{{Message: &pkg.Message{Role: "assistant", Content: "Hello"}}},
+			})
+		default:
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := newApp().Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d: expected status 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	// The second request reuses the refreshed token
+	if sessionRequests != 1 || chatRequests != 3 {
+		t.Errorf("Expected 1 session and 3 chat requests, got %d and %d", sessionRequests, chatRequests)
+	}
+}
+
+func TestChatHandlerReportsFailedSessionRefresh(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// Both the session token and the access token are rejected
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"bad credentials"}}`))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", resp.StatusCode)
+	}
+}
@@ -2,21 +2,26 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/google/uuid"
 	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/maxneuvians/go-copilot-proxy/pkg/tokenizer"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
-var session_token string
+// client is the Copilot client shared by all handlers.
+var client = pkg.NewClient()
 
 var (
 	Model                  = "claude-3.7-sonnet"
@@ -33,10 +38,46 @@ type Payload struct {
 	Temperature  *float64      `json:"temperature,omitempty"`
 	TopP         *float64      `json:"top_p,omitempty"`
 	Stream       *bool         `json:"stream,omitempty"`
+
+	Tools             []pkg.Tool               `json:"tools,omitempty"`
+	ToolChoice        interface{}              `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool                    `json:"parallel_tool_calls,omitempty"`
+	Functions         []pkg.FunctionDefinition `json:"functions,omitempty"`
+	FunctionCall      interface{}              `json:"function_call,omitempty"`
+
+	MaxTokens           *int64              `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int64              `json:"max_completion_tokens,omitempty"`
+	Stop                interface{}         `json:"stop,omitempty"`
+	PresencePenalty     *float64            `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64            `json:"frequency_penalty,omitempty"`
+	Seed                *int64              `json:"seed,omitempty"`
+	LogitBias           map[string]float64  `json:"logit_bias,omitempty"`
+	User                string              `json:"user,omitempty"`
+	ResponseFormat      *pkg.ResponseFormat `json:"response_format,omitempty"`
+	ReasoningEffort     string              `json:"reasoning_effort,omitempty"`
+
+	StreamOptions *pkg.StreamOptions `json:"stream_options,omitempty"`
 }
 
+// Responses_dir is the directory responses are stored in for
+// previous_response_id; they are kept in memory when it is empty.
+var Responses_dir string
+
+// Image_dir is the only directory file:// image URLs may be read from. They
+// are rejected when it is empty, since any client of the proxy could
+// otherwise read the files of the user running it.
+var Image_dir string
+
 func init() {
 	rootCmd.AddCommand(startCmd)
+
+	startCmd.Flags().StringVar(&Responses_dir, "responses-dir", "", "directory to store responses in for previous_response_id (default: in memory)")
+	startCmd.Flags().StringVar(&Image_dir, "image-dir", "", "directory file:// image URLs may be read from (default: file:// URLs are rejected)")
+	startCmd.Flags().StringVar(&Token_file, "token-file", "", "read the GitHub token from a file, or from stdin with \"-\" (default: "+Copilot_token_env+", the profile, "+GH_token_env+" or the Copilot editor plugins)")
+	startCmd.Flags().StringSliceVar(&Pool_profiles, "pool", nil, "profiles whose accounts requests are spread across (default: the active profile)")
+	startCmd.Flags().StringVar(&Pool_balance, "balance", Pool_balance, "how requests are spread across the pool: "+balanceRoundRobin+" or "+balanceLeastInFlight)
+	startCmd.Flags().DurationVar(&Pool_cooldown, "cooldown", Pool_cooldown, "how long an account is skipped after it was rate limited or its token was rejected")
+	startCmd.Flags().StringVar(&Admin_token, "admin-token", "", "bearer token required to read /admin/health from other hosts (default: "+Admin_token_env+", or localhost only)")
 }
 
 var startCmd = &cobra.Command{
@@ -44,374 +85,540 @@ var startCmd = &cobra.Command{
 	Short: "Start the proxy server",
 	Long:  `Start the proxy server to enable GitHub Copilot proxy.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		app := fiber.New()
-		// Add CORS middleware
-		app.Use(cors.New(cors.Config{
-			AllowOrigins:     "http://localhost:5173",
-			AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-			AllowHeaders:     "Accept,Authorization,Content-Type,Content-Length,Accept-Encoding",
-			AllowCredentials: true,
-		}))
-
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-		// Validate that the TOKEN_FILE exists
-		if _, err := os.Stat(TOKEN_FILE); os.IsNotExist(err) {
-			log.Error().Msgf("The file %s does not exist, please run login first", TOKEN_FILE)
-		}
+		client = pkg.NewClient(
+			pkg.WithLogger(log.Logger),
+			pkg.WithRetryPolicy(poolRetryPolicy()),
+		)
 
-		// Get the authentication token
-		file, err := os.Open(TOKEN_FILE)
-		if err != nil {
-			log.Error().Msgf("Error opening token file: %s", err)
-			return
+		if Admin_token == "" {
+			Admin_token = os.Getenv(Admin_token_env)
 		}
 
-		// If the file exists, read the first line
-		r := bufio.NewReader(file)
-		buffer, _, err := r.ReadLine()
-		if err != nil {
-			log.Error().Msgf("Error reading token from file: %s", err)
-			return
+		if Responses_dir != "" {
+			store, err := newFileResponseStore(Responses_dir)
+			if err != nil {
+				log.Error().Msgf("Error opening responses directory: %s", err)
+				return
+			}
+			responses = store
 		}
 
-		token := string(buffer)
+		// Load the tokenizer vocabularies in the background so that the first
+		// usage estimate is not delayed
+		go func() {
+			if err := tokenizer.Preload(); err != nil {
+				log.Error().Msgf("Error loading tokenizer: %s", err)
+			}
+		}()
 
-		// Get a session token from the token
-		sessionResponse, err := pkg.GetSessionToken(token)
+		// Get a session token for every account and keep them fresh
+		pool, err := startAccountPool(context.Background())
 		if err != nil {
-			log.Error().Msgf("Error getting session token: %s", err)
+			log.Error().Msgf("Error starting accounts: %s", err)
 			return
 		}
+		accounts = pool
 
-		session_token = sessionResponse.Token
+		app := newApp()
+		app.Listen(":3000")
+	},
+}
 
-		// Start a ticker to refresh the session token every 25 minutes
-		go func() {
-			for {
-				log.Info().Msg("Refreshing session token")
-				// Sleep for 25 minutes
-				time.Sleep(25 * time.Minute)
-
-				// Get a new session token
-				sessionResponse, err := pkg.GetSessionToken(token)
-				if err != nil {
-					log.Error().Msgf("Error getting session token: %s", err)
-					return
-				}
-				session_token = sessionResponse.Token
-			}
-		}() // Start the ticker
+// newApp builds the Fiber application with all proxy routes registered.
+func newApp() *fiber.App {
+	app := fiber.New()
+	// Add CORS middleware
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     "http://localhost:5173",
+		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
+		AllowHeaders:     "Accept,Authorization,Content-Type,Content-Length,Accept-Encoding",
+		AllowCredentials: true,
+	}))
+
+	// Register the chat handler for both endpoints
+	app.Post("/chat", chatHandler)
+	app.Post("/v1/chat/completions", chatHandler)
+	app.Post("/v1/completions", completionsHandler)
+	app.Post("/v1/embeddings", embeddingsHandler)
+	app.Post("/v1/messages", messagesHandler)
+	app.Post("/v1/responses", responsesHandler)
+	app.Get("/v1/responses/:id", responseHandler)
+	app.Post("/v1/tokenize", tokenizeHandler)
+	app.Get("/v1/models", modelsHandler)
+	app.Get("/v1/models/:id", modelHandler)
+
+	// Ollama compatible routes
+	app.Post("/api/chat", ollamaChatHandler)
+	app.Post("/api/generate", ollamaGenerateHandler)
+	app.Post("/api/show", ollamaShowHandler)
+	app.Get("/api/tags", ollamaTagsHandler)
+
+	app.Get("/admin/health", adminHealthHandler)
+
+	return app
+}
 
-		// Define the chat handler function that can be reused
-		chatHandler := func(c *fiber.Ctx) error {
-			var payload Payload
+func chatHandler(c *fiber.Ctx) error {
+	var payload Payload
+
+	// Log incoming request
+	log.Debug().
+		Str("path", "/chat").
+		Str("method", "POST").
+		Str("remote_ip", c.IP()).
+		Msg("Incoming chat request")
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/chat").
+			Interface("payload", payload).
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	// Determine streaming mode
+	stream := false
+	if payload.Stream != nil {
+		stream = *payload.Stream
+	}
+
+	// Log parsed payload details
+	modelStr := Model
+	if payload.Model != nil {
+		modelStr = *payload.Model
+	}
+	log.Debug().
+		Int("message_count", len(payload.Messages)).
+		Str("model", modelStr).
+		Bool("stream", stream).
+		Interface("messages", payload.Messages).
+		Msg("Processing chat request")
+
+	request := payload.completionRequest()
+	model := request.Model
+	temperature := request.Temperature
+	topP := request.TopP
+	n := request.N
+
+	// Reject unusable images here rather than after a round trip upstream
+	if err := resolveImages(payload.Messages); err != nil {
+		log.Error().
+			Err(err).
+			Str("model", model).
+			Msg("Invalid image in request")
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject(err.Error(), errorTypeInvalidRequest, "invalid_image"))
+	}
+
+	startTime := time.Now()
+
+	if stream {
+		includeUsage := payload.StreamOptions != nil && payload.StreamOptions.IncludeUsage
+
+		err := streamResponse(c, request, func(w *bufio.Writer, chatStream *pkg.ChatStream) {
+			// Generate an ID for this completion in case the upstream does
+			// not send one
+			header := pkg.CompletionResponse{
+				ID:      "chatcmpl-" + uuid.New().String(),
+				Created: time.Now().Unix(),
+				Model:   model,
+			}
 
-			// Log incoming request
-			log.Debug().
-				Str("path", "/chat").
-				Str("method", "POST").
-				Str("remote_ip", c.IP()).
-				Msg("Incoming chat request")
+			completion, err := writeChatStream(w, chatStream, &header)
+			completionID := header.ID
+			if err != nil {
+				log.Debug().
+					Err(err).
+					Str("model", model).
+					Str("completion_id", completionID).
+					Msg("Client disconnected, aborted streaming chat request")
+				return
+			}
 
-			if err := c.BodyParser(&payload); err != nil {
+			if err := chatStream.Err(); err != nil {
 				log.Error().
 					Err(err).
-					Str("path", "/chat").
-					Interface("payload", payload).
-					Msg("Failed to parse request body")
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error": "Invalid request payload",
-				})
+					Str("model", model).
+					Str("completion_id", completionID).
+					Msg("Streaming chat completion failed")
+				// Headers are already sent, so report the error in SSE format
+				_, body := upstreamError(err)
+				writeEvent(w, body)
+				return
 			}
 
-			// Determine streaming mode
-			stream := false
-			if payload.Stream != nil {
-				stream = *payload.Stream
-			}
+			// Report usage in a final chunk without choices, estimating it
+			// when the upstream did not report any
+			if includeUsage {
+				usage := chatStream.Usage()
+				if usage == (pkg.Usage{}) {
+					usage = estimateUsage(model, payload.Messages, completion)
+				}
 
-			// Log parsed payload details
-			modelStr := Model
-			if payload.Model != nil {
-				modelStr = *payload.Model
+				usageChunk := pkg.CompletionResponse{
+					ID:      header.ID,
+					Object:  "chat.completion.chunk",
+					Created: header.Created,
+					Model:   header.Model,
+					Choices: []pkg.Choice{},
+					Usage:   usage,
+				}
+				if err := writeEvent(w, usageChunk); err != nil {
+					return
+				}
 			}
+
+			// Send final [DONE] message
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			w.Flush()
+
+			// Log streaming completion
 			log.Debug().
-				Int("message_count", len(payload.Messages)).
-				Str("model", modelStr).
-				Bool("stream", stream).
+				Str("model", model).
+				Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
+				Str("completion_id", completionID).
+				Msg("Streaming chat request completed successfully")
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", model).
+				Float64("temperature", temperature).
+				Float64("top_p", topP).
+				Int64("n", n).
 				Interface("messages", payload.Messages).
-				Msg("Processing chat request")
+				Msg("Failed to get streaming chat completion")
+			return sendUpstreamError(c, err)
+		}
 
-			n := Completion_n
-			if payload.Completion_N != nil {
-				n = *payload.Completion_N
-			}
+		// Set SSE headers for streaming
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+		c.Set("Access-Control-Allow-Origin", "*")
 
-			model := Model
-			if payload.Model != nil {
-				model = *payload.Model
-			}
+		return nil
+	} else {
+		// Non-streaming response (existing logic)
+		completionResp, err := completeChat(c.UserContext(), request)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("model", model).
+				Float64("temperature", temperature).
+				Float64("top_p", topP).
+				Int64("n", n).
+				Interface("messages", payload.Messages).
+				Msg("Failed to get chat completion")
+			return sendUpstreamError(c, err)
+		}
 
-			temperature := Completion_temperature
-			if payload.Temperature != nil {
-				temperature = *payload.Temperature
+		// Pass the upstream response through, only filling in what Copilot
+		// leaves out
+		choices := mergeChoices(completionResp.Choices)
+		var completion strings.Builder
+		for i := range choices {
+			responseMessage := choices[i].Message
+			if responseMessage.Role == "" {
+				responseMessage.Role = "assistant"
 			}
-
-			topP := Completion_top_p
-			if payload.TopP != nil {
-				topP = *payload.TopP
+			writeCompletion(&completion, responseMessage)
+
+			if choices[i].FinishReason == "" {
+				switch {
+				case len(responseMessage.ToolCalls) > 0:
+					choices[i].FinishReason = pkg.FinishReasonToolCalls
+				case responseMessage.FunctionCall != nil:
+					choices[i].FinishReason = pkg.FinishReasonFunctionCall
+				default:
+					choices[i].FinishReason = pkg.FinishReasonStop
+				}
 			}
+		}
 
-			startTime := time.Now()
-
-			if stream {
-				// Set SSE headers for streaming
-				c.Set("Content-Type", "text/event-stream")
-				c.Set("Cache-Control", "no-cache")
-				c.Set("Connection", "keep-alive")
-				c.Set("Access-Control-Allow-Origin", "*")
-
-				// Generate unique ID for this completion
-				completionID := "chatcmpl-" + uuid.New().String()
-				created := time.Now().Unix()
-
-				// Handle streaming response
-				err := pkg.Chat(session_token, payload.Messages, model, temperature, topP, n, true, func(completionResponse pkg.CompletionResponse) error {
-					if len(completionResponse.Choices) == 0 {
-						return nil
-					}
-
-					choice := completionResponse.Choices[0]
-
-					// Handle the case where we get a chunk with both content and finish_reason
-					// This ensures we follow OpenAI's specification correctly
-					if choice.FinishReason != "" && choice.Delta != nil && choice.Delta.Content != "" {
-						// Send the content chunk first (without finish_reason)
-						contentChunk := pkg.CompletionResponse{
-							ID:      completionID,
-							Object:  "chat.completion.chunk",
-							Created: created,
-							Model:   model,
-							Choices: []pkg.Choice{
-								{
-									Index: choice.Index,
-									Delta: &pkg.Message{
-										Role:    choice.Delta.Role,
-										Content: choice.Delta.Content,
-									},
-									FinishReason: "", // No finish reason for content chunk
-								},
-							},
-						}
-
-						chunkBytes, err := json.Marshal(contentChunk)
-						if err != nil {
-							log.Error().Err(err).Msg("Failed to marshal content chunk")
-							return err
-						}
-
-						_, writeErr := fmt.Fprintf(c.Response().BodyWriter(), "data: %s\n\n", string(chunkBytes))
-						if writeErr != nil {
-							log.Error().Err(writeErr).Msg("Failed to write content chunk")
-							return writeErr
-						}
-
-						// Flush the response
-						if f, ok := c.Response().BodyWriter().(interface{ Flush() }); ok {
-							f.Flush()
-						}
-
-						// Send the finish reason chunk separately (with no delta)
-						finishChunk := pkg.CompletionResponse{
-							ID:      completionID,
-							Object:  "chat.completion.chunk",
-							Created: created,
-							Model:   model,
-							Choices: []pkg.Choice{
-								{
-									Index:        choice.Index,
-									Delta:        nil, // No delta for finish chunk
-									FinishReason: choice.FinishReason,
-								},
-							},
-						}
-
-						finishBytes, err := json.Marshal(finishChunk)
-						if err != nil {
-							log.Error().Err(err).Msg("Failed to marshal finish chunk")
-							return err
-						}
-
-						_, writeErr = fmt.Fprintf(c.Response().BodyWriter(), "data: %s\n\n", string(finishBytes))
-						if writeErr != nil {
-							log.Error().Err(writeErr).Msg("Failed to write finish chunk")
-							return writeErr
-						}
-
-						// Flush the response
-						if f, ok := c.Response().BodyWriter().(interface{ Flush() }); ok {
-							f.Flush()
-						}
-
-						return nil
-					}
-
-					// Handle normal chunks (either content-only or finish-only)
-					streamChunk := pkg.CompletionResponse{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: created,
-						Model:   model,
-						Choices: []pkg.Choice{
-							{
-								Index:        choice.Index,
-								Delta:        choice.Delta,
-								FinishReason: choice.FinishReason,
-							},
-						},
-					}
-
-					// Marshal and send chunk
-					chunkBytes, err := json.Marshal(streamChunk)
-					if err != nil {
-						log.Error().Err(err).Msg("Failed to marshal stream chunk")
-						return err
-					}
-
-					// Write SSE formatted data
-					_, writeErr := fmt.Fprintf(c.Response().BodyWriter(), "data: %s\n\n", string(chunkBytes))
-					if writeErr != nil {
-						log.Error().Err(writeErr).Msg("Failed to write stream chunk")
-						return writeErr
-					}
-
-					// Flush the response
-					if f, ok := c.Response().BodyWriter().(interface{ Flush() }); ok {
-						f.Flush()
-					}
-
-					return nil
-				})
-
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("model", model).
-						Float64("temperature", temperature).
-						Float64("top_p", topP).
-						Int64("n", n).
-						Interface("messages", payload.Messages).
-						Msg("Failed to get streaming chat completion")
-					// Send error in SSE format
-					errorData := map[string]interface{}{
-						"error": map[string]interface{}{
-							"message": fmt.Sprintf("Failed to process chat request: %v", err),
-							"type":    "server_error",
-						},
-					}
-					errorBytes, _ := json.Marshal(errorData)
-					fmt.Fprintf(c.Response().BodyWriter(), "data: %s\n\n", string(errorBytes))
-					return nil
-				}
+		usage := completionResp.Usage
+		// If usage is not available from the original response, create default values
+		if usage == (pkg.Usage{}) {
+			usage = estimateUsage(model, payload.Messages, completion.String())
+		}
 
-				// Send final [DONE] message
-				fmt.Fprintf(c.Response().BodyWriter(), "data: [DONE]\n\n")
+		openAIResponse := pkg.CompletionResponse{
+			ID:      completionResp.ID,
+			Object:  "chat.completion",
+			Created: completionResp.Created,
+			Model:   completionResp.Model,
+			Choices: choices,
+			Usage:   usage,
+		}
+		if openAIResponse.ID == "" {
+			openAIResponse.ID = "chatcmpl-" + uuid.New().String()
+		}
+		if openAIResponse.Created == 0 {
+			openAIResponse.Created = time.Now().Unix()
+		}
+		if openAIResponse.Model == "" {
+			openAIResponse.Model = model
+		}
 
-				// Log streaming completion
-				log.Debug().
-					Str("model", model).
-					Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
-					Str("completion_id", completionID).
-					Msg("Streaming chat request completed successfully")
-
-				return nil
-			} else {
-				// Non-streaming response (existing logic)
-				resp := ""
-				var completionResp pkg.CompletionResponse
-
-				err := pkg.Chat(session_token, payload.Messages, model, temperature, topP, n, false, func(completionResponse pkg.CompletionResponse) error {
-					// Add validation and logging
-					if len(completionResponse.Choices) == 0 {
-						log.Error().
-							Interface("response", completionResponse).
-							Msg("Empty choices array in completion response")
-						return fmt.Errorf("no choices in completion response")
-					}
-
-					choice := completionResponse.Choices[0]
-					if choice.Message != nil {
-						resp = choice.Message.Content
-					} else if choice.Delta != nil {
-						resp = choice.Delta.Content
-					}
-					completionResp = completionResponse
-					return nil
-				})
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("model", model).
-						Float64("temperature", temperature).
-						Float64("top_p", topP).
-						Int64("n", n).
-						Interface("messages", payload.Messages).
-						Msg("Failed to get chat completion")
-					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-						"error": fmt.Sprintf("Failed to process chat request: %v", err),
-					})
-				}
+		// Log successful response
+		log.Debug().
+			Str("model", model).
+			Int("response_length", completion.Len()).
+			Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
+			Interface("response", openAIResponse).
+			Msg("Chat request completed successfully")
+
+		c.Set("Content-Type", "application/json")
+		return c.JSON(openAIResponse)
+	}
+}
 
-				// Create OpenAI-compatible response
-				usage := completionResp.Usage
-				// If usage is not available from the original response, create default values
-				if usage.TotalTokens == 0 && usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
-					// Estimate token counts (rough approximation)
-					promptTokens := int64(len(fmt.Sprintf("%v", payload.Messages)) / 4)
-					completionTokens := int64(len(resp) / 4)
-					usage = pkg.Usage{
-						PromptTokens:     promptTokens,
-						CompletionTokens: completionTokens,
-						TotalTokens:      promptTokens + completionTokens,
-					}
-				}
+// completionRequest builds the Copilot request for the payload, using the
+// configured defaults for the model and sampling parameters it leaves out.
+// Stream options are only forwarded for streaming requests.
+func (p Payload) completionRequest() pkg.CompletionRequest {
+	model := Model
+	if p.Model != nil {
+		model = *p.Model
+	}
+
+	temperature := Completion_temperature
+	if p.Temperature != nil {
+		temperature = *p.Temperature
+	}
+
+	topP := Completion_top_p
+	if p.TopP != nil {
+		topP = *p.TopP
+	}
+
+	n := Completion_n
+	if p.Completion_N != nil {
+		n = *p.Completion_N
+	}
+
+	stream := false
+	if p.Stream != nil {
+		stream = *p.Stream
+	}
+
+	request := pkg.CompletionRequest{
+		Model:       model,
+		Messages:    p.Messages,
+		Temperature: temperature,
+		TopP:        topP,
+		N:           n,
+		Stream:      stream,
+
+		Tools:             p.Tools,
+		ToolChoice:        p.ToolChoice,
+		ParallelToolCalls: p.ParallelToolCalls,
+		Functions:         p.Functions,
+		FunctionCall:      p.FunctionCall,
+
+		MaxTokens:           p.MaxTokens,
+		MaxCompletionTokens: p.MaxCompletionTokens,
+		Stop:                p.Stop,
+		PresencePenalty:     p.PresencePenalty,
+		FrequencyPenalty:    p.FrequencyPenalty,
+		Seed:                p.Seed,
+		LogitBias:           p.LogitBias,
+		User:                p.User,
+		ResponseFormat:      p.ResponseFormat,
+		ReasoningEffort:     p.ReasoningEffort,
+	}
+
+	if stream {
+		request.StreamOptions = p.StreamOptions
+	}
+
+	return request
+}
 
-				openAIResponse := pkg.CompletionResponse{
-					ID:      "chatcmpl-" + uuid.New().String(),
-					Object:  "chat.completion",
-					Created: time.Now().Unix(),
-					Model:   model,
-					Choices: []pkg.Choice{
-						{
-							Index: 0,
-							Message: &pkg.Message{
-								Role:    "assistant",
-								Content: resp,
-							},
-							FinishReason: pkg.FinishReasonStop,
-						},
-					},
-					Usage: usage,
-				}
+// mergeChoices returns the choices of a non-streaming response ordered by
+// index. Copilot may split one message over several choices with the same
+// index, e.g. its text and its tool calls, so those are merged into one.
+func mergeChoices(upstream []pkg.Choice) []pkg.Choice {
+	var choices []pkg.Choice
+	positions := map[int64]int{}
+
+	for _, choice := range upstream {
+		message := choice.Message
+		if message == nil {
+			message = choice.Delta
+		}
+		if message == nil {
+			message = &pkg.Message{}
+		}
 
-				// Log successful response
-				log.Debug().
-					Str("model", model).
-					Int("response_length", len(resp)).
-					Float64("duration_ms", float64(time.Since(startTime).Milliseconds())).
-					Interface("response", openAIResponse).
-					Msg("Chat request completed successfully")
+		i, ok := positions[choice.Index]
+		if !ok {
+			merged := *message
+			merged.ToolCalls = append([]pkg.ToolCall(nil), message.ToolCalls...)
+			positions[choice.Index] = len(choices)
+			choices = append(choices, pkg.Choice{Index: choice.Index, Message: &merged, FinishReason: choice.FinishReason})
+			continue
+		}
+
+		merged := choices[i].Message
+		if merged.Role == "" {
+			merged.Role = message.Role
+		}
+		if merged.Content != "" && message.Content != "" {
+			merged.Content += "\n\n"
+		}
+		merged.Content += message.Content
+		merged.ToolCalls = append(merged.ToolCalls, message.ToolCalls...)
+		if merged.FunctionCall == nil {
+			merged.FunctionCall = message.FunctionCall
+		}
+
+		// A tool call wins over the end of the turn reported by another choice
+		if choices[i].FinishReason == "" || choice.FinishReason == pkg.FinishReasonToolCalls {
+			choices[i].FinishReason = choice.FinishReason
+		}
+	}
+
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].Index < choices[j].Index
+	})
+	return choices
+}
 
-				c.Set("Content-Type", "application/json")
-				return c.JSON(openAIResponse)
+// writeChatStream forwards every chunk of chatStream to the client as an
+// OpenAI chat.completion.chunk event, one event per choice, and returns the
+// streamed content. The chunks carry the id, creation time and model of
+// header until the upstream sends its own, which header is updated with. It
+// returns an error only when writing to the client fails.
+func writeChatStream(w *bufio.Writer, chatStream *pkg.ChatStream, header *pkg.CompletionResponse) (string, error) {
+	// The first values the upstream sends are kept, so that every chunk of
+	// the completion carries the same ones
+	var upstreamID, upstreamCreated, upstreamModel bool
+
+	newChunk := func(index int64, delta *pkg.Message, finishReason string) pkg.CompletionResponse {
+		return pkg.CompletionResponse{
+			ID:      header.ID,
+			Object:  "chat.completion.chunk",
+			Created: header.Created,
+			Model:   header.Model,
+			Choices: []pkg.Choice{
+				{
+					Index:        index,
+					Delta:        delta,
+					FinishReason: finishReason,
+				},
+			},
+		}
+	}
+
+	var completion strings.Builder
+
+	for chatStream.Next() {
+		chunk := chatStream.Current()
+		if chunk.ID != "" && !upstreamID {
+			header.ID, upstreamID = chunk.ID, true
+		}
+		if chunk.Created != 0 && !upstreamCreated {
+			header.Created, upstreamCreated = chunk.Created, true
+		}
+		if chunk.Model != "" && !upstreamModel {
+			header.Model, upstreamModel = chunk.Model, true
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				writeCompletion(&completion, choice.Delta)
+			}
+
+			// Handle the case where we get a chunk with both content (or tool
+			// call fragments) and finish_reason
+			// This ensures we follow OpenAI's specification correctly
+			if choice.FinishReason != "" && choice.Delta != nil && hasDelta(choice.Delta) {
+				// Send the content chunk first (without finish_reason), then
+				// the finish reason chunk separately (with no delta)
+				if err := writeEvent(w, newChunk(choice.Index, choice.Delta, "")); err != nil {
+					return completion.String(), err
+				}
+				if err := writeEvent(w, newChunk(choice.Index, nil, choice.FinishReason)); err != nil {
+					return completion.String(), err
+				}
+				continue
+			}
+
+			// Handle normal chunks (either content-only or finish-only)
+			if err := writeEvent(w, newChunk(choice.Index, choice.Delta, choice.FinishReason)); err != nil {
+				return completion.String(), err
 			}
 		}
+	}
 
-		// Register the chat handler for both endpoints
-		app.Post("/chat", chatHandler)
-		app.Post("/v1/chat/completions", chatHandler)
+	return completion.String(), nil
+}
 
-		app.Listen(":3000")
-	},
+// writeCompletion appends the generated text of message, including tool and
+// function call arguments, to completion for token counting.
+func writeCompletion(completion *strings.Builder, message *pkg.Message) {
+	completion.WriteString(message.Content)
+	for _, toolCall := range message.ToolCalls {
+		completion.WriteString(toolCall.Function.Name)
+		completion.WriteString(toolCall.Function.Arguments)
+	}
+	if message.FunctionCall != nil {
+		completion.WriteString(message.FunctionCall.Name)
+		completion.WriteString(message.FunctionCall.Arguments)
+	}
+}
+
+// estimateUsage counts the tokens of the prompt and completion with the
+// tokenizer of model for when the upstream does not report usage.
+func estimateUsage(model string, messages []pkg.Message, completion string) pkg.Usage {
+	var promptTokens, completionTokens int64
+
+	if t, err := tokenizer.ForModel(model); err == nil {
+		promptTokens = int64(t.CountMessages(messages))
+		completionTokens = int64(t.Count(completion))
+	} else {
+		// Fall back to roughly four characters per token
+		log.Error().Err(err).Str("model", model).Msg("Failed to load tokenizer")
+		promptTokens = int64(len(fmt.Sprintf("%v", messages)) / 4)
+		completionTokens = int64(len(completion) / 4)
+	}
+
+	return pkg.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// hasDelta reports whether a streamed delta carries anything besides the role.
+func hasDelta(delta *pkg.Message) bool {
+	return delta.Content != "" || len(delta.ToolCalls) > 0 || delta.FunctionCall != nil
+}
+
+// resolveImages validates the images of a request, reading file:// URLs from
+// Image_dir only.
+func resolveImages(messages []pkg.Message) error {
+	return pkg.ResolveImagesFrom(messages, pkg.DefaultMaxImageSize, Image_dir)
+}
+
+// writeEvent writes v as a single SSE data event and flushes it to the
+// client. It returns an error only when writing fails, which means the client
+// has gone away; an event that cannot be encoded is logged and skipped.
+func writeEvent(w *bufio.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode stream event, skipping it")
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+
+	return w.Flush()
 }
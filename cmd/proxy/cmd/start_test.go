@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -14,8 +18,20 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/maxneuvians/go-copilot-proxy/pkg/tokenizer"
 )
 
+// TestMain loads the tokenizer vocabularies before any test runs.
+func TestMain(m *testing.M) {
+	// Loading the vocabularies can outlast the app.Test timeout, especially
+	// with the race detector
+	if err := tokenizer.Preload(); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
 // Helper function to create a test Fiber app with the chat endpoint
 func createTestApp() *fiber.App {
 	app := fiber.New()
@@ -1099,3 +1115,1038 @@ func TestStreamingFinishChunkDeltaHandling(t *testing.T) {
 		}
 	}
 }
+
+// useUpstream points the shared client and a single account at a mock
+// Copilot API for the duration of the test. The account starts out with the
+// session token "session-token".
+func useUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	originalClient, originalAccounts := client, accounts
+	client = pkg.NewClient(pkg.WithGitHubAPIURL(server.URL), pkg.WithCopilotURL(server.URL))
+	accounts = newAccountPool(balanceRoundRobin, newTestAccount(default_profile, "session-token"))
+
+	t.Cleanup(func() {
+		client, accounts = originalClient, originalAccounts
+		server.Close()
+	})
+
+	return server
+}
+
+func writeUpstreamChunk(w http.ResponseWriter, content string, finishReason string) {
+	chunk := pkg.CompletionResponse{
+		Choices: []pkg.Choice{
+			{
+				Delta:        &pkg.Message{Role: "assistant", Content: content},
+				FinishReason: finishReason,
+			},
+		},
+	}
+	data, _ := json.Marshal(chunk)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	w.(http.Flusher).Flush()
+}
+
+func TestChatHandlerStreamsUpstreamChunks(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeUpstreamChunk(w, "Hello", "")
+		writeUpstreamChunk(w, " world", pkg.FinishReasonStop)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	app := newApp()
+
+	streamValue := true
+	payload := Payload{
+		Messages: []pkg.Message{{Role: "user", Content: "Hi"}},
+		Stream:   &streamValue,
+	}
+	payloadBytes, _ := json.Marshal(payload)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected Content-Type: text/event-stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+
+	var content strings.Builder
+	var finishReason string
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+
+		var chunk pkg.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to unmarshal chunk %q: %v", data, err)
+		}
+		if chunk.Choices[0].Delta != nil {
+			content.WriteString(chunk.Choices[0].Delta.Content)
+		}
+		if chunk.Choices[0].FinishReason != "" {
+			finishReason = chunk.Choices[0].FinishReason
+		}
+	}
+
+	if content.String() != "Hello world" {
+		t.Errorf("Expected streamed content 'Hello world', got %q", content.String())
+	}
+	if finishReason != pkg.FinishReasonStop {
+		t.Errorf("Expected finish reason stop, got %q", finishReason)
+	}
+	if !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Error("Response should end with [DONE] marker")
+	}
+}
+
+func TestChatHandlerAbortsUpstreamOnClientDisconnect(t *testing.T) {
+	upstreamDone := make(chan struct{})
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			writeUpstreamChunk(w, strings.Repeat("x", 1024), "")
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	})
+
+	app := newApp()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"stream":true}`
+	resp, err := http.Post("http://"+ln.Addr().String()+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+
+	// Read the first event, then hang up
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("Expected a data event, got %q (%v)", line, err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream request was not aborted after the client disconnected")
+	}
+}
+
+func TestChatHandlerMapsUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name               string
+		upstreamStatus     int
+		upstreamBody       string
+		retryAfter         string
+		expectedStatus     int
+		expectedType       string
+		expectedCode       interface{}
+		expectedRetryAfter string
+	}{
+		{
+			name:           "Unauthorized",
+			upstreamStatus: http.StatusUnauthorized,
+			upstreamBody:   `{"error":{"message":"Invalid token","type":"unauthorized","code":"invalid_token"}}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedType:   "authentication_error",
+			expectedCode:   "invalid_token",
+		},
+		{
+			name:               "Rate limited",
+			upstreamStatus:     http.StatusTooManyRequests,
+			upstreamBody:       `{"error":{"message":"Slow down","type":"rate_limit","code":"rate_limited"}}`,
+			retryAfter:         "7",
+			expectedStatus:     http.StatusTooManyRequests,
+			expectedType:       "rate_limit_error",
+			expectedCode:       "rate_limited",
+			expectedRetryAfter: "7",
+		},
+		{
+			name:           "Service unavailable",
+			upstreamStatus: http.StatusServiceUnavailable,
+			upstreamBody:   `upstream unavailable`,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "server_error",
+			expectedCode:   nil,
+		},
+		{
+			name:           "Bad request",
+			upstreamStatus: http.StatusBadRequest,
+			upstreamBody:   `{"error":{"message":"model not supported","type":"invalid_request_error","code":"model_not_supported"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedType:   "invalid_request_error",
+			expectedCode:   "model_not_supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.upstreamStatus)
+				w.Write([]byte(tt.upstreamBody))
+			})
+
+			app := newApp()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hi"}]}`))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if resp.Header.Get("Retry-After") != tt.expectedRetryAfter {
+				t.Errorf("Expected Retry-After %q, got %q", tt.expectedRetryAfter, resp.Header.Get("Retry-After"))
+			}
+
+			var body struct {
+				Error struct {
+					Message string      `json:"message"`
+					Type    string      `json:"type"`
+					Code    interface{} `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode error response: %v", err)
+			}
+
+			if body.Error.Type != tt.expectedType {
+				t.Errorf("Expected error type %s, got %s", tt.expectedType, body.Error.Type)
+			}
+			if body.Error.Code != tt.expectedCode {
+				t.Errorf("Expected error code %v, got %v", tt.expectedCode, body.Error.Code)
+			}
+			if body.Error.Message == "" {
+				t.Error("Expected a non-empty error message")
+			}
+		})
+	}
+}
+
+func TestChatHandlerStreamingUpstreamErrorStatus(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"Slow down","type":"rate_limit","code":"rate_limited"}}`))
+	})
+
+	app := newApp()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hi"}],"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 before any event is streamed, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") == "text/event-stream" {
+		t.Error("Upstream errors before the first chunk should not be sent as an event stream")
+	}
+	if resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("Expected Retry-After: 3, got %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestChatHandlerForwardsTools(t *testing.T) {
+	var upstreamRequest map[string]interface{}
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"chatcmpl-1","choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Ottawa\"}"}}]}}]}`)
+	})
+
+	app := newApp()
+
+	body := `{
+		"messages": [
+			{"role": "user", "content": "Weather?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_0", "type": "function", "function": {"name": "get_weather", "arguments": "{}"}}]},
+			{"role": "tool", "tool_call_id": "call_0", "content": "sunny"}
+		],
+		"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required",
+		"parallel_tool_calls": false
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	// The tool definitions and history reach the upstream request
+	if upstreamRequest["tool_choice"] != "required" {
+		t.Errorf("Expected tool_choice required upstream, got %v", upstreamRequest["tool_choice"])
+	}
+	if upstreamRequest["parallel_tool_calls"] != false {
+		t.Errorf("Expected parallel_tool_calls false upstream, got %v", upstreamRequest["parallel_tool_calls"])
+	}
+	tools, _ := upstreamRequest["tools"].([]interface{})
+	if len(tools) != 1 {
+		t.Errorf("Expected 1 tool upstream, got %v", upstreamRequest["tools"])
+	}
+	messages, _ := upstreamRequest["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages upstream, got %v", upstreamRequest["messages"])
+	}
+	if toolMessage, _ := messages[2].(map[string]interface{}); toolMessage["tool_call_id"] != "call_0" {
+		t.Errorf("Expected tool_call_id call_0 upstream, got %v", messages[2])
+	}
+	if assistantMessage, _ := messages[1].(map[string]interface{}); assistantMessage["tool_calls"] == nil {
+		t.Errorf("Expected assistant tool_calls upstream, got %v", messages[1])
+	}
+
+	// The tool calls are returned to the client
+	var completionResp pkg.CompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completionResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	choice := completionResp.Choices[0]
+	if choice.FinishReason != pkg.FinishReasonToolCalls {
+		t.Errorf("Expected finish_reason tool_calls, got %s", choice.FinishReason)
+	}
+	if choice.Message == nil || len(choice.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call in the response, got %+v", choice.Message)
+	}
+	if choice.Message.ToolCalls[0].Function.Arguments != `{"city":"Ottawa"}` {
+		t.Errorf("Unexpected arguments: %s", choice.Message.ToolCalls[0].Function.Arguments)
+	}
+}
+
+func TestChatHandlerStreamsToolCallDeltas(t *testing.T) {
+	fragments := []string{`{"ci`, `ty":"Ot`, `tawa"}`}
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"role":"assistant","content":null,"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`+"\n\n")
+		for i, fragment := range fragments {
+			finish := ""
+			if i == len(fragments)-1 {
+				finish = `,"finish_reason":"tool_calls"`
+			}
+			arguments, _ := json.Marshal(fragment)
+			fmt.Fprintf(w, `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":%s}}]}%s}]}`+"\n\n", arguments, finish)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	app := newApp()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Weather?"}],"stream":true,"tools":[{"type":"function","function":{"name":"get_weather"}}]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var name, arguments, finishReason string
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+
+		var chunk pkg.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to unmarshal chunk %q: %v", data, err)
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != "" {
+			finishReason = choice.FinishReason
+			if choice.Delta != nil {
+				t.Error("Finish chunk should not carry a delta")
+			}
+		}
+		if choice.Delta == nil {
+			continue
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			if call.Index == nil || *call.Index != 0 {
+				t.Errorf("Expected tool call index 0, got %v", call.Index)
+			}
+			if call.Function.Name != "" {
+				name = call.Function.Name
+			}
+			arguments += call.Function.Arguments
+		}
+	}
+
+	if name != "get_weather" {
+		t.Errorf("Expected function name get_weather, got %q", name)
+	}
+	if arguments != `{"city":"Ottawa"}` {
+		t.Errorf("Expected argument fragments in order, got %q", arguments)
+	}
+	if finishReason != pkg.FinishReasonToolCalls {
+		t.Errorf("Expected finish_reason tool_calls, got %q", finishReason)
+	}
+}
+
+func TestChatHandlerForwardsImageParts(t *testing.T) {
+	var upstreamRequest map[string]interface{}
+	var visionHeader string
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		visionHeader = r.Header.Get("Copilot-Vision-Request")
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"A cat"}}]}`)
+	})
+
+	app := newApp()
+
+	body := `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image_url", "image_url": {"url": "https://example.com/cat.png", "detail": "high"}}
+			]}
+		]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+	}
+
+	if visionHeader != "true" {
+		t.Errorf("Expected Copilot-Vision-Request header, got %q", visionHeader)
+	}
+
+	// The content parts reach the upstream request unchanged
+	messages, _ := upstreamRequest["messages"].([]interface{})
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message upstream, got %v", upstreamRequest["messages"])
+	}
+	content, _ := messages[0].(map[string]interface{})["content"].([]interface{})
+	if len(content) != 2 {
+		t.Fatalf("Expected 2 content parts upstream, got %v", messages[0])
+	}
+	imagePart, _ := content[1].(map[string]interface{})
+	imageURL, _ := imagePart["image_url"].(map[string]interface{})
+	if imagePart["type"] != "image_url" || imageURL["url"] != "https://example.com/cat.png" || imageURL["detail"] != "high" {
+		t.Errorf("Unexpected image part upstream: %v", content[1])
+	}
+}
+
+func TestChatHandlerRejectsInvalidImages(t *testing.T) {
+	upstreamCalled := false
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+	})
+
+	app := newApp()
+
+	body := `{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "data:text/plain;base64,aGVsbG8="}}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+	}
+
+	var errorResp struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if errorResp.Error.Type != "invalid_request_error" || errorResp.Error.Code != "invalid_image" {
+		t.Errorf("Unexpected error: %+v", errorResp.Error)
+	}
+	if upstreamCalled {
+		t.Error("Expected the request to be rejected before reaching upstream")
+	}
+}
+
+func TestChatHandlerRejectsFileImages(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the request to be rejected before reaching upstream")
+	})
+
+	for _, path := range []string{"/etc/passwd", "/nonexistent/secret.png"} {
+		body := `{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "file://` + path + `"}}]}]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := newApp().Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, resp.StatusCode)
+		}
+		if !strings.Contains(string(respBody), "invalid image_url") || strings.Contains(string(respBody), path) {
+			t.Errorf("%s: expected a generic invalid image_url error, got %s", path, respBody)
+		}
+	}
+}
+
+func TestChatHandlerForwardsSamplingParameters(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+	}{
+		{"max_tokens", `256`},
+		{"max_completion_tokens", `512`},
+		{"stop", `"\n\n"`},
+		{"stop", `["END","STOP"]`},
+		{"presence_penalty", `0.5`},
+		{"frequency_penalty", `-0.25`},
+		{"seed", `42`},
+		{"logit_bias", `{"50256":-100}`},
+		{"user", `"user-1234"`},
+		{"response_format", `{"type":"json_object"}`},
+		{"response_format", `{"type":"json_schema","json_schema":{"name":"joke","schema":{"type":"object"},"strict":true}}`},
+		{"reasoning_effort", `"high"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field+"="+tt.value, func(t *testing.T) {
+			var upstreamRequest map[string]json.RawMessage
+
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"ok"}}]}`)
+			})
+
+			app := newApp()
+
+			body := fmt.Sprintf(`{"messages":[{"role":"user","content":"Hello"}],%q:%s}`, tt.field, tt.value)
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status 200, got %d. Body: %s", resp.StatusCode, string(body))
+			}
+
+			raw, ok := upstreamRequest[tt.field]
+			if !ok {
+				t.Fatalf("Expected %s in the upstream request, got %v", tt.field, upstreamRequest)
+			}
+
+			var got, want interface{}
+			json.Unmarshal(raw, &got)
+			json.Unmarshal([]byte(tt.value), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %s to be %s upstream, got %s", tt.field, tt.value, string(raw))
+			}
+		})
+	}
+}
+
+func TestChatHandlerReturnsAllChoices(t *testing.T) {
+	var upstreamN float64
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var upstreamRequest map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&upstreamRequest)
+		upstreamN, _ = upstreamRequest["n"].(float64)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[
+			{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"First"}},
+			{"index":1,"finish_reason":"stop","message":{"role":"assistant","content":"Second"}},
+			{"index":2,"finish_reason":"tool_calls","message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}}
+		]}`)
+	})
+
+	app := newApp()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hello"}],"n":3}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if upstreamN != 3 {
+		t.Errorf("Expected n=3 upstream, got %v", upstreamN)
+	}
+
+	var completionResp pkg.CompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completionResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if len(completionResp.Choices) != 3 {
+		t.Fatalf("Expected 3 choices, got %d", len(completionResp.Choices))
+	}
+	for i, want := range []string{"First", "Second", ""} {
+		choice := completionResp.Choices[i]
+		if choice.Index != int64(i) {
+			t.Errorf("Expected choice %d to have index %d, got %d", i, i, choice.Index)
+		}
+		if choice.Message == nil || choice.Message.Content != want {
+			t.Errorf("Expected choice %d content %q, got %+v", i, want, choice.Message)
+		}
+	}
+	if completionResp.Choices[2].FinishReason != pkg.FinishReasonToolCalls || len(completionResp.Choices[2].Message.ToolCalls) != 1 {
+		t.Errorf("Expected choice 2 to carry its tool call, got %+v", completionResp.Choices[2])
+	}
+}
+
+func TestChatHandlerMergesSplitChoices(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[
+			{"index":1,"finish_reason":"stop","message":{"role":"assistant","content":"Other"}},
+			{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Let me check"}},
+			{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}}
+		]}`)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hello"}],"n":2}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newApp().Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var completionResp pkg.CompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completionResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if len(completionResp.Choices) != 2 {
+		t.Fatalf("Expected 2 choices, got %+v", completionResp.Choices)
+	}
+	first, second := completionResp.Choices[0], completionResp.Choices[1]
+	if first.Index != 0 || first.Message.Content != "Let me check" || len(first.Message.ToolCalls) != 1 || first.FinishReason != pkg.FinishReasonToolCalls {
+		t.Errorf("Expected the split choice 0 to be merged, got %+v with %+v", first, first.Message)
+	}
+	if second.Index != 1 || second.Message.Content != "Other" || second.FinishReason != pkg.FinishReasonStop {
+		t.Errorf("Expected choice 1 to be kept, got %+v with %+v", second, second.Message)
+	}
+}
+
+func TestChatHandlerStreamsAllChoices(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"role":"assistant","content":"A"}},{"index":1,"delta":{"role":"assistant","content":"B"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":1,"delta":{"content":"b"},"finish_reason":"length"}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"content":"a"},"finish_reason":"stop"}]}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	app := newApp()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hello"}],"n":2,"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	content := map[int64]string{}
+	finishReasons := map[int64]string{}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+			continue
+		}
+
+		var chunk pkg.CompletionResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("Failed to parse chunk %q: %v", line, err)
+		}
+		if len(chunk.Choices) != 1 {
+			t.Fatalf("Expected one choice per chunk, got %d", len(chunk.Choices))
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta != nil {
+			content[choice.Index] += choice.Delta.Content
+		}
+		if choice.FinishReason != "" {
+			finishReasons[choice.Index] = choice.FinishReason
+		}
+	}
+
+	if content[0] != "Aa" || content[1] != "Bb" {
+		t.Errorf("Expected per-choice content Aa and Bb, got %q", content)
+	}
+	if finishReasons[0] != "stop" || finishReasons[1] != "length" {
+		t.Errorf("Expected finish reasons stop and length, got %q", finishReasons)
+	}
+}
+
+func TestChatHandlerPreservesUpstreamFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream string
+		check    func(t *testing.T, resp pkg.CompletionResponse)
+	}{
+		{
+			name:     "upstream fields",
+			upstream: `{"id":"chatcmpl-upstream","created":1700000000,"model":"claude-3.7-sonnet-20250219","choices":[{"index":0,"finish_reason":"length","message":{"role":"assistant","content":"Truncated"}}],"usage":{"prompt_tokens":12,"completion_tokens":100,"total_tokens":112}}`,
+			check: func(t *testing.T, resp pkg.CompletionResponse) {
+				if resp.ID != "chatcmpl-upstream" {
+					t.Errorf("Expected upstream id, got %s", resp.ID)
+				}
+				if resp.Created != 1700000000 {
+					t.Errorf("Expected upstream created, got %d", resp.Created)
+				}
+				if resp.Model != "claude-3.7-sonnet-20250219" {
+					t.Errorf("Expected upstream model, got %s", resp.Model)
+				}
+				if resp.Choices[0].FinishReason != pkg.FinishReasonLength {
+					t.Errorf("Expected finish_reason length, got %s", resp.Choices[0].FinishReason)
+				}
+				if resp.Usage != (pkg.Usage{PromptTokens: 12, CompletionTokens: 100, TotalTokens: 112}) {
+					t.Errorf("Expected upstream usage, got %+v", resp.Usage)
+				}
+			},
+		},
+		{
+			name:     "content filter",
+			upstream: `{"choices":[{"index":0,"finish_reason":"content_filter","message":{"role":"assistant","content":""}}]}`,
+			check: func(t *testing.T, resp pkg.CompletionResponse) {
+				if resp.Choices[0].FinishReason != pkg.FinishReasonContentFilter {
+					t.Errorf("Expected finish_reason content_filter, got %s", resp.Choices[0].FinishReason)
+				}
+			},
+		},
+		{
+			name:     "synthesized fields",
+			upstream: `{"choices":[{"message":{"content":"Hi","function_call":{"name":"f","arguments":"{}"}}}]}`,
+			check: func(t *testing.T, resp pkg.CompletionResponse) {
+				if !strings.HasPrefix(resp.ID, "chatcmpl-") {
+					t.Errorf("Expected a generated id, got %s", resp.ID)
+				}
+				if resp.Created == 0 {
+					t.Error("Expected a generated created timestamp")
+				}
+				if resp.Model != Model {
+					t.Errorf("Expected the requested model %s, got %s", Model, resp.Model)
+				}
+				if resp.Choices[0].FinishReason != pkg.FinishReasonFunctionCall {
+					t.Errorf("Expected finish_reason function_call, got %s", resp.Choices[0].FinishReason)
+				}
+				if resp.Choices[0].Message.Role != "assistant" {
+					t.Errorf("Expected role assistant, got %s", resp.Choices[0].Message.Role)
+				}
+				if resp.Usage.TotalTokens == 0 {
+					t.Error("Expected estimated usage")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, tt.upstream)
+			})
+
+			app := newApp()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hello"}]}`))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var completionResp pkg.CompletionResponse
+			if err := json.NewDecoder(resp.Body).Decode(&completionResp); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if completionResp.Object != "chat.completion" {
+				t.Errorf("Expected object chat.completion, got %s", completionResp.Object)
+			}
+			if len(completionResp.Choices) != 1 {
+				t.Fatalf("Expected 1 choice, got %d", len(completionResp.Choices))
+			}
+
+			tt.check(t, completionResp)
+		})
+	}
+}
+
+func TestChatHandlerStreamsUpstreamFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		wantID    string
+		wantModel string
+	}{
+		{
+			name:      "upstream fields",
+			header:    `"id":"chatcmpl-upstream","created":1700000000,"model":"claude-3.7-sonnet-20250219",`,
+			wantID:    "chatcmpl-upstream",
+			wantModel: "claude-3.7-sonnet-20250219",
+		},
+		{
+			name:      "synthesized fields",
+			wantModel: Model,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, `data: {`+tt.header+`"choices":[{"index":0,"delta":{"role":"assistant","content":"Hi"}}]}`+"\n\n")
+				fmt.Fprint(w, `data: {`+tt.header+`"choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`+"\n\n")
+				fmt.Fprint(w, "data: [DONE]\n\n")
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"Hello"}],"stream":true,"stream_options":{"include_usage":true}}`))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := newApp().Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			ids := map[string]bool{}
+			chunks := 0
+
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if !strings.HasPrefix(line, "data: ") || line == "data: [DONE]" {
+					continue
+				}
+
+				var chunk pkg.CompletionResponse
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+					t.Fatalf("Failed to parse chunk %q: %v", line, err)
+				}
+				chunks++
+				ids[chunk.ID] = true
+
+				if tt.wantID != "" && chunk.ID != tt.wantID {
+					t.Errorf("Expected upstream id %s, got %s", tt.wantID, chunk.ID)
+				}
+				if tt.wantID == "" && !strings.HasPrefix(chunk.ID, "chatcmpl-") {
+					t.Errorf("Expected a generated id, got %s", chunk.ID)
+				}
+				if chunk.Model != tt.wantModel {
+					t.Errorf("Expected model %s, got %s", tt.wantModel, chunk.Model)
+				}
+			}
+
+			// The content, finish reason and usage chunks share one id
+			if chunks != 3 || len(ids) != 1 {
+				t.Errorf("Expected 3 chunks with one id, got %d with %v", chunks, ids)
+			}
+		})
+	}
+}
+
+func TestChatHandlerStreamsUsage(t *testing.T) {
+	tests := []struct {
+		name          string
+		request       string
+		upstreamUsage string
+		wantUsage     bool
+		check         func(t *testing.T, usage pkg.Usage)
+	}{
+		{
+			name:          "upstream usage",
+			request:       `{"messages":[{"role":"user","content":"Hello"}],"stream":true,"stream_options":{"include_usage":true}}`,
+			upstreamUsage: `{"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`,
+			wantUsage:     true,
+			check: func(t *testing.T, usage pkg.Usage) {
+				if usage != (pkg.Usage{PromptTokens: 9, CompletionTokens: 3, TotalTokens: 12}) {
+					t.Errorf("Expected upstream usage, got %+v", usage)
+				}
+			},
+		},
+		{
+			name:      "estimated usage",
+			request:   `{"messages":[{"role":"user","content":"Hello"}],"stream":true,"stream_options":{"include_usage":true}}`,
+			wantUsage: true,
+			check: func(t *testing.T, usage pkg.Usage) {
+				// Counted with cl100k_base: 3 per message, 1 for the role, 1
+				// for the content and 3 for the reply; 7 for the completion
+				if want := (pkg.Usage{PromptTokens: 8, CompletionTokens: 7, TotalTokens: 15}); usage != want {
+					t.Errorf("Expected estimated usage %+v, got %+v", want, usage)
+				}
+			},
+		},
+		{
+			name:          "not requested",
+			request:       `{"messages":[{"role":"user","content":"Hello"}],"stream":true}`,
+			upstreamUsage: `{"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamRequest map[string]interface{}
+
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&upstreamRequest)
+
+				w.Header().Set("Content-Type", "text/event-stream")
+				writeUpstreamChunk(w, "Hello there, how are you?", "")
+				writeUpstreamChunk(w, "", "stop")
+				if tt.upstreamUsage != "" {
+					fmt.Fprintf(w, "data: %s\n\n", tt.upstreamUsage)
+				}
+				fmt.Fprint(w, "data: [DONE]\n\n")
+			})
+
+			app := newApp()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.request))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+
+			if events[len(events)-1] != "data: [DONE]" {
+				t.Fatalf("Expected the stream to end with [DONE], got %q", events[len(events)-1])
+			}
+
+			var usageChunks []map[string]json.RawMessage
+			lastUsageEvent := -1
+			for i, event := range events[:len(events)-1] {
+				var chunk map[string]json.RawMessage
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+					t.Fatalf("Failed to parse chunk %q: %v", event, err)
+				}
+				if string(chunk["choices"]) == "[]" {
+					usageChunks = append(usageChunks, chunk)
+					lastUsageEvent = i
+				}
+			}
+
+			if !tt.wantUsage {
+				if len(usageChunks) != 0 {
+					t.Errorf("Expected no usage chunk, got %v", usageChunks)
+				}
+				if _, ok := upstreamRequest["stream_options"]; ok {
+					t.Errorf("Expected no stream_options upstream, got %v", upstreamRequest["stream_options"])
+				}
+				return
+			}
+
+			if len(usageChunks) != 1 {
+				t.Fatalf("Expected exactly one usage chunk, got %d", len(usageChunks))
+			}
+			if lastUsageEvent != len(events)-2 {
+				t.Errorf("Expected the usage chunk to be last before [DONE], got %q", events[len(events)-2])
+			}
+			if streamOptions, _ := upstreamRequest["stream_options"].(map[string]interface{}); streamOptions["include_usage"] != true {
+				t.Errorf("Expected stream_options to be forwarded upstream, got %v", upstreamRequest["stream_options"])
+			}
+
+			var usage pkg.Usage
+			if err := json.Unmarshal(usageChunks[0]["usage"], &usage); err != nil {
+				t.Fatalf("Failed to parse usage: %v", err)
+			}
+			tt.check(t, usage)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/maxneuvians/go-copilot-proxy/pkg/tokenizer"
+	"github.com/rs/zerolog/log"
+)
+
+// TokenizePayload is the body of a /v1/tokenize request. Exactly one of Input
+// and Messages must be set.
+type TokenizePayload struct {
+	Model    *string       `json:"model,omitempty"`
+	Input    *string       `json:"input,omitempty"`
+	Messages []pkg.Message `json:"messages,omitempty"`
+}
+
+type TokenizeResponse struct {
+	Object   string `json:"object"`
+	Model    string `json:"model"`
+	Encoding string `json:"encoding"`
+	Count    int    `json:"count"`
+	// Tokens holds the token IDs of Input; it is omitted for messages.
+	Tokens []int `json:"tokens,omitempty"`
+}
+
+// tokenizeHandler counts tokens offline with the tokenizer of the requested
+// model. Messages are counted as a chat prompt, including the per-message
+// overhead.
+func tokenizeHandler(c *fiber.Ctx) error {
+	var payload TokenizePayload
+
+	if err := c.BodyParser(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("path", "/v1/tokenize").
+			Msg("Failed to parse request body")
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("Invalid request payload", errorTypeInvalidRequest, ""))
+	}
+
+	if (payload.Input == nil) == (payload.Messages == nil) {
+		return c.Status(fiber.StatusBadRequest).JSON(errorObject("Exactly one of input or messages is required", errorTypeInvalidRequest, ""))
+	}
+
+	model := Model
+	if payload.Model != nil {
+		model = *payload.Model
+	}
+
+	t, err := tokenizer.ForModel(model)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("model", model).
+			Msg("Failed to load tokenizer")
+		return c.Status(fiber.StatusInternalServerError).JSON(errorObject("Failed to load tokenizer", errorTypeServer, ""))
+	}
+
+	response := TokenizeResponse{
+		Object:   "tokenize",
+		Model:    model,
+		Encoding: t.Encoding(),
+	}
+
+	if payload.Input != nil {
+		response.Tokens = t.Encode(*payload.Input)
+		response.Count = len(response.Tokens)
+	} else {
+		response.Count = t.CountMessages(payload.Messages)
+	}
+
+	return c.JSON(response)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       TokenizeResponse
+	}{
+		{
+			name:       "input",
+			body:       `{"model":"gpt-4o","input":"hello world"}`,
+			wantStatus: http.StatusOK,
+			want:       TokenizeResponse{Object: "tokenize", Model: "gpt-4o", Encoding: "o200k_base", Count: 2, Tokens: []int{24912, 2375}},
+		},
+		{
+			name:       "default model",
+			body:       `{"input":"hello world"}`,
+			wantStatus: http.StatusOK,
+			want:       TokenizeResponse{Object: "tokenize", Model: Model, Encoding: "cl100k_base", Count: 2, Tokens: []int{15339, 1917}},
+		},
+		{
+			name:       "messages",
+			body:       `{"model":"gpt-4","messages":[{"role":"user","content":"hello world"}]}`,
+			wantStatus: http.StatusOK,
+			// 3 per message, 1 for the role, 2 for the content and 3 for the reply
+			want: TokenizeResponse{Object: "tokenize", Model: "gpt-4", Encoding: "cl100k_base", Count: 9},
+		},
+		{
+			name:       "neither",
+			body:       `{"model":"gpt-4"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "both",
+			body:       `{"input":"hi","messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid JSON",
+			body:       `{"input":`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/tokenize", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("Expected status %d, got %d. Body: %s", tt.wantStatus, resp.StatusCode, string(body))
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got TokenizeResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
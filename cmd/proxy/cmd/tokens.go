@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Token_file is a file start reads the GitHub token from instead of a
+// profile, or "-" for stdin.
+var Token_file string
+
+// Environment variables start takes the GitHub token from when neither
+// --token-file nor --profile is given. Copilot_token_env is preferred to the
+// active profile, GH_token_env is only used when the profile has no token.
+const (
+	Copilot_token_env = "GITHUB_COPILOT_TOKEN"
+	GH_token_env      = "GH_TOKEN"
+)
+
+// editor_credential_files are the files the official Copilot editor plugins
+// store their GitHub token in, in the order they are searched.
+var editor_credential_files = []string{"hosts.json", "apps.json"}
+
+// max_token_file_size keeps a mistaken --token-file from being read whole.
+const max_token_file_size = 64 << 10
+
+// tokenSource is a GitHub token found for start and where it was found.
+type tokenSource struct {
+	token string
+	// name identifies the account in /admin/health: the profile, or the
+	// source of a token that does not belong to one.
+	name     string
+	source   string
+	username string
+}
+
+// editorCredentials is an entry of the editor plugins' hosts.json, keyed by
+// host, or apps.json, keyed by host and app ID.
+type editorCredentials struct {
+	User       string `json:"user"`
+	OAuthToken string `json:"oauth_token"`
+}
+
+// findToken returns the token start uses when no pool is given. It is read
+// from --token-file, then from GITHUB_COPILOT_TOKEN, the active profile,
+// GH_TOKEN and the files of the Copilot editor plugins. With --profile, only
+// the profile is looked at.
+func findToken() (tokenSource, error) {
+	if Token_file != "" {
+		return readTokenFile(Token_file)
+	}
+
+	if Profile == "" {
+		if found, ok := envToken(Copilot_token_env); ok {
+			return found, nil
+		}
+	}
+
+	profile, err := activeProfile()
+	if err != nil {
+		return tokenSource{}, err
+	}
+
+	token, err := readToken(profile)
+	if err == nil {
+		info, _ := readProfileInfo(profile)
+		return tokenSource{token: token, name: profile, source: "profile " + profile, username: info.Username}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return tokenSource{}, err
+	}
+
+	if Profile == "" {
+		if found, ok := envToken(GH_token_env); ok {
+			return found, nil
+		}
+		if found, ok := findEditorToken(); ok {
+			return found, nil
+		}
+	}
+
+	return tokenSource{}, fmt.Errorf("no token found for profile %s, please run login first or set %s", profile, Copilot_token_env)
+}
+
+// envToken returns the token in the environment variable env, if any.
+func envToken(env string) (tokenSource, bool) {
+	token := strings.TrimSpace(os.Getenv(env))
+	if token == "" {
+		return tokenSource{}, false
+	}
+	return tokenSource{token: token, name: env, source: "environment variable " + env}, true
+}
+
+// readTokenFile reads a token from path, or from stdin when path is "-".
+func readTokenFile(path string) (tokenSource, error) {
+	name, source := "token-file", "file "+path
+	reader := io.Reader(os.Stdin)
+
+	if path == "-" {
+		name, source = "stdin", "stdin"
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return tokenSource{}, err
+		}
+		defer file.Close()
+
+		// The file may belong to someone else or sit on a read-only mount,
+		// so a mode that is too open is only reported
+		if info, err := file.Stat(); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			log.Warn().Msgf("Token file %s is accessible by other users (mode %04o), consider restricting it to 0600", path, info.Mode().Perm())
+		}
+		reader = file
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, max_token_file_size))
+	if err != nil {
+		return tokenSource{}, err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return tokenSource{}, fmt.Errorf("no token in %s", source)
+	}
+	return tokenSource{token: token, name: name, source: source}, nil
+}
+
+// editorConfigDir returns the directory the Copilot editor plugins store
+// their credentials in.
+func editorConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "github-copilot"), nil
+	}
+	if dir := os.Getenv("LOCALAPPDATA"); runtime.GOOS == "windows" && dir != "" {
+		return filepath.Join(dir, "github-copilot"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "github-copilot"), nil
+}
+
+// findEditorToken returns the github.com token stored by a Copilot editor
+// plugin, if any. Files that cannot be read are skipped with a warning.
+func findEditorToken() (tokenSource, bool) {
+	dir, err := editorConfigDir()
+	if err != nil {
+		return tokenSource{}, false
+	}
+
+	for _, name := range editor_credential_files {
+		path := filepath.Join(dir, name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Warn().Msgf("Error reading %s: %s", path, err)
+			}
+			continue
+		}
+
+		var hosts map[string]editorCredentials
+		if err := json.Unmarshal(data, &hosts); err != nil {
+			log.Warn().Msgf("Ignoring %s: %s", path, err)
+			continue
+		}
+
+		// Sort the keys so that the same token is picked every time
+		keys := make([]string, 0, len(hosts))
+		for key := range hosts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			host, _, _ := strings.Cut(key, ":")
+			if credentials := hosts[key]; host == "github.com" && credentials.OAuthToken != "" {
+				return tokenSource{token: credentials.OAuthToken, name: name, source: "file " + path, username: credentials.User}, true
+			}
+		}
+	}
+
+	return tokenSource{}, false
+}
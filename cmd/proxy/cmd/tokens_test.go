@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTokenSources clears every token source for the duration of the test
+// and returns the directory of the editor plugins.
+func useTokenSources(t *testing.T) string {
+	t.Helper()
+
+	useConfigDir(t)
+	useProfileFlag(t, "")
+
+	originalTokenFile := Token_file
+	Token_file = ""
+	t.Cleanup(func() { Token_file = originalTokenFile })
+
+	t.Setenv(Copilot_token_env, "")
+	t.Setenv(GH_token_env, "")
+
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	return filepath.Join(xdg, "github-copilot")
+}
+
+func writeEditorFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func TestFindTokenPrecedence(t *testing.T) {
+	editorDir := useTokenSources(t)
+
+	writeEditorFile(t, editorDir, "apps.json", `{"github.com:Iv1.b507a08c87ecfe98": {"user": "apps-user", "oauth_token": "apps-token", "githubAppId": "Iv1.b507a08c87ecfe98"}}`)
+	assertToken(t, "apps-token", "apps.json", "apps-user")
+
+	writeEditorFile(t, editorDir, "hosts.json", `{"github.com": {"user": "hosts-user", "oauth_token": "hosts-token"}}`)
+	assertToken(t, "hosts-token", "hosts.json", "hosts-user")
+
+	t.Setenv(GH_token_env, "gh-token")
+	assertToken(t, "gh-token", GH_token_env, "")
+
+	// GH_TOKEN is often set for other tools, so a stored profile wins
+	if err := writeToken(default_profile, "profile-token", false); err != nil {
+		t.Fatalf("writeToken failed: %v", err)
+	}
+	assertToken(t, "profile-token", default_profile, "")
+
+	t.Setenv(Copilot_token_env, "copilot-token")
+	assertToken(t, "copilot-token", Copilot_token_env, "")
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	Token_file = path
+	assertToken(t, "file-token", "token-file", "")
+}
+
+func TestFindTokenKeepsTokenFileMode(t *testing.T) {
+	useTokenSources(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("file-token\n"), 0644); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("Failed to set token file mode: %v", err)
+	}
+
+	Token_file = path
+	assertToken(t, "file-token", "token-file", "")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat token file: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0644 {
+		t.Errorf("Expected the token file to keep mode 0644, got %04o", mode)
+	}
+}
+
+func TestFindTokenWithProfileFlag(t *testing.T) {
+	editorDir := useTokenSources(t)
+	useProfileFlag(t, "work")
+
+	t.Setenv(Copilot_token_env, "copilot-token")
+	writeEditorFile(t, editorDir, "hosts.json", `{"github.com": {"user": "hosts-user", "oauth_token": "hosts-token"}}`)
+
+	// Neither the environment nor the editor plugins stand in for the profile
+	_, err := findToken()
+	if err == nil || !strings.Contains(err.Error(), "no token found for profile work") {
+		t.Errorf("Expected no token for profile work, got %v", err)
+	}
+
+	if err := writeToken("work", "work-token", false); err != nil {
+		t.Fatalf("writeToken failed: %v", err)
+	}
+	assertToken(t, "work-token", "work", "")
+}
+
+func TestFindTokenFromStdin(t *testing.T) {
+	useTokenSources(t)
+	Token_file = "-"
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	writer.Write([]byte("  stdin-token\n"))
+	writer.Close()
+
+	originalStdin := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() {
+		os.Stdin = originalStdin
+		reader.Close()
+	})
+
+	assertToken(t, "stdin-token", "stdin", "")
+}
+
+func TestFindTokenErrors(t *testing.T) {
+	editorDir := useTokenSources(t)
+
+	// Unusable editor files are skipped
+	writeEditorFile(t, editorDir, "hosts.json", `not json`)
+	writeEditorFile(t, editorDir, "apps.json", `{"github.example.com": {"user": "enterprise", "oauth_token": "enterprise-token"}}`)
+
+	if _, err := findToken(); err == nil || !strings.Contains(err.Error(), "please run login first") {
+		t.Errorf("Expected no token to be found, got %v", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	Token_file = empty
+	if _, err := findToken(); err == nil || !strings.Contains(err.Error(), "no token in file") {
+		t.Errorf("Expected an empty token file to fail, got %v", err)
+	}
+
+	Token_file = filepath.Join(t.TempDir(), "missing")
+	if _, err := findToken(); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing token file to fail, got %v", err)
+	}
+}
+
+func assertToken(t *testing.T, token string, name string, username string) {
+	t.Helper()
+
+	found, err := findToken()
+	if err != nil {
+		t.Fatalf("findToken failed: %v", err)
+	}
+	if found.token != token || found.name != name || found.username != username {
+		t.Errorf("Expected token %s from %s of %q, got %s from %s of %q", token, name, username, found.token, found.name, found.username)
+	}
+}
+
+func TestStartAccountPoolValidatesToken(t *testing.T) {
+	useTokenSources(t)
+	t.Setenv(Copilot_token_env, "revoked-token")
+
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "token revoked-token" {
+			t.Errorf("Expected the token from the environment, got %q", r.Header.Get("authorization"))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"Bad credentials"}`))
+	})
+
+	_, err := startAccountPool(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "validating token from environment variable "+Copilot_token_env) {
+		t.Errorf("Expected the token to be rejected, got %v", err)
+	}
+}
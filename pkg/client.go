@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Client talks to the GitHub OAuth and Copilot APIs. A Client holds no
+// per-request state and is safe for concurrent use, so several differently
+// configured clients can live side by side in one process.
+type Client struct {
+	httpClient  *http.Client
+	logger      zerolog.Logger
+	retryPolicy RetryPolicy
+	retries     atomic.Int64
+
+	embeddingsBatchSize int
+
+	clientID            string
+	editorVersion       string
+	editorPluginVersion string
+	userAgent           string
+
+	authenticationEndpoint string
+	codeCompletionEndpoint string
+	completionEndpoint     string
+	embeddingsEndpoint     string
+	loginEndpoint          string
+	modelsEndpoint         string
+	sessionEndpoint        string
+	userEndpoint           string
+}
+
+// Option configures a Client created with NewClient.
+type Option func(*Client)
+
+// NewClient returns a Client using the public GitHub endpoints and editor
+// headers, modified by the given options.
+func NewClient(opts ...Option) *Client {
+	c := defaultClient()
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// defaultClient builds a Client from the package-level defaults. It is
+// evaluated on every call of the package-level functions so that they keep
+// honoring the current values of those defaults.
+func defaultClient() *Client {
+	return &Client{
+		httpClient: &http.Client{},
+		logger:     log.Logger,
+
+		embeddingsBatchSize: embeddings_batch_size,
+
+		clientID:            editor_client_id,
+		editorVersion:       editor_version,
+		editorPluginVersion: editor_plugin_version,
+		userAgent:           user_agent,
+
+		authenticationEndpoint: github_authentication_endpoint,
+		codeCompletionEndpoint: github_code_completion_endpoint,
+		completionEndpoint:     github_completion_endpoint,
+		embeddingsEndpoint:     github_embeddings_endpoint,
+		loginEndpoint:          github_login_endpoint,
+		modelsEndpoint:         github_models_endpoint,
+		sessionEndpoint:        github_session_endpoint,
+		userEndpoint:           github_user_endpoint,
+	}
+}
+
+// WithHTTPClient sets the *http.Client used for every request.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTransport sets the http.RoundTripper used for every request while
+// keeping the rest of the configured *http.Client.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *Client) {
+		httpClient := *c.httpClient
+		httpClient.Transport = transport
+		c.httpClient = &httpClient
+	}
+}
+
+// WithLogger sets the logger used to report request failures.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithGitHubURL sets the base URL of the GitHub OAuth device flow
+// (https://github.com by default).
+func WithGitHubURL(baseURL string) Option {
+	return func(c *Client) {
+		baseURL = strings.TrimRight(baseURL, "/")
+		c.loginEndpoint = baseURL + "/login/device/code"
+		c.authenticationEndpoint = baseURL + "/login/oauth/access_token"
+	}
+}
+
+// WithGitHubAPIURL sets the base URL of the GitHub REST API used to exchange
+// an OAuth token for a Copilot session token and to look up its user
+// (https://api.github.com by default).
+func WithGitHubAPIURL(baseURL string) Option {
+	return func(c *Client) {
+		baseURL = strings.TrimRight(baseURL, "/")
+		c.sessionEndpoint = baseURL + "/copilot_internal/v2/token"
+		c.userEndpoint = baseURL + "/user"
+	}
+}
+
+// WithCopilotURL sets the base URL of the Copilot API
+// (https://api.githubcopilot.com by default). Code completions are sent to
+// the same host; use WithCopilotProxyURL after it to send them elsewhere.
+func WithCopilotURL(baseURL string) Option {
+	return func(c *Client) {
+		baseURL = strings.TrimRight(baseURL, "/")
+		c.completionEndpoint = baseURL + "/chat/completions"
+		c.embeddingsEndpoint = baseURL + "/embeddings"
+		c.modelsEndpoint = baseURL + "/models"
+		c.codeCompletionEndpoint = baseURL + code_completion_path
+	}
+}
+
+// WithCopilotProxyURL sets the base URL of the Copilot code completions
+// engine (https://copilot-proxy.githubusercontent.com by default).
+func WithCopilotProxyURL(baseURL string) Option {
+	return func(c *Client) {
+		c.codeCompletionEndpoint = strings.TrimRight(baseURL, "/") + code_completion_path
+	}
+}
+
+// WithClientID sets the OAuth client ID used for the device flow.
+func WithClientID(clientID string) Option {
+	return func(c *Client) {
+		c.clientID = clientID
+	}
+}
+
+// WithEditorVersion sets the editor-version header sent with every request.
+func WithEditorVersion(version string) Option {
+	return func(c *Client) {
+		c.editorVersion = version
+	}
+}
+
+// WithEditorPluginVersion sets the editor-plugin-version header sent with
+// every request.
+func WithEditorPluginVersion(version string) Option {
+	return func(c *Client) {
+		c.editorPluginVersion = version
+	}
+}
+
+// WithUserAgent sets the user-agent header sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewClientDefaults(t *testing.T) {
+	c := NewClient()
+
+	if c.loginEndpoint != github_login_endpoint {
+		t.Errorf("Expected login endpoint %s, got %s", github_login_endpoint, c.loginEndpoint)
+	}
+	if c.authenticationEndpoint != github_authentication_endpoint {
+		t.Errorf("Expected authentication endpoint %s, got %s", github_authentication_endpoint, c.authenticationEndpoint)
+	}
+	if c.sessionEndpoint != github_session_endpoint {
+		t.Errorf("Expected session endpoint %s, got %s", github_session_endpoint, c.sessionEndpoint)
+	}
+	if c.completionEndpoint != github_completion_endpoint {
+		t.Errorf("Expected completion endpoint %s, got %s", github_completion_endpoint, c.completionEndpoint)
+	}
+	if c.embeddingsEndpoint != github_embeddings_endpoint {
+		t.Errorf("Expected embeddings endpoint %s, got %s", github_embeddings_endpoint, c.embeddingsEndpoint)
+	}
+	if c.modelsEndpoint != github_models_endpoint {
+		t.Errorf("Expected models endpoint %s, got %s", github_models_endpoint, c.modelsEndpoint)
+	}
+	if c.editorVersion != editor_version {
+		t.Errorf("Expected editor version %s, got %s", editor_version, c.editorVersion)
+	}
+}
+
+func TestClientBaseURLOptions(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/login/device/code":
+			json.NewEncoder(w).Encode(LoginResponse{DeviceCode: "device-code"})
+		case "/login/oauth/access_token":
+			json.NewEncoder(w).Encode(AuthenticationResponse{AccessToken: "access-token"})
+		case "/api/copilot_internal/v2/token":
+			json.NewEncoder(w).Encode(SessionResponse{Token: "session;exp=42"})
+		case "/copilot/chat/completions":
+			json.NewEncoder(w).Encode(CompletionResponse{
+				Choices: []Choice{{Message: &Message{Role: "assistant", Content: "Hi"}}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(
+		WithGitHubURL(server.URL+"/"),
+		WithGitHubAPIURL(server.URL+"/api"),
+		WithCopilotURL(server.URL+"/copilot"),
+	)
+
+	login, err := c.Login()
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if _, err := c.Authenticate(login); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	session, err := c.GetSessionToken("access-token")
+	if err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+	if session.ExpiresAt != 42 {
+		t.Errorf("Expected expires_at: 42, got %d", session.ExpiresAt)
+	}
+	err = c.Chat(session.Token, []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, false, func(CompletionResponse) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+
+	expected := []string{
+		"/login/device/code",
+		"/login/oauth/access_token",
+		"/api/copilot_internal/v2/token",
+		"/copilot/chat/completions",
+	}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %d requests, got %d: %v", len(expected), len(paths), paths)
+	}
+	for i, path := range expected {
+		if paths[i] != path {
+			t.Errorf("Request %d: expected path %s, got %s", i, path, paths[i])
+		}
+	}
+}
+
+func TestClientHeaderOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedHeaders := map[string]string{
+			"editor-version":        "neovim/0.9.5",
+			"editor-plugin-version": "copilot.vim/1.16.0",
+			"user-agent":            "test-agent/1.0",
+		}
+
+		for header, expectedValue := range expectedHeaders {
+			if r.Header.Get(header) != expectedValue {
+				t.Errorf("Expected header %s: %s, got %s", header, expectedValue, r.Header.Get(header))
+			}
+		}
+
+		var req LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if req.ClientID != "test-client-id" {
+			t.Errorf("Expected client_id: test-client-id, got %s", req.ClientID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LoginResponse{DeviceCode: "device-code"})
+	}))
+	defer server.Close()
+
+	c := NewClient(
+		WithGitHubURL(server.URL),
+		WithClientID("test-client-id"),
+		WithEditorVersion("neovim/0.9.5"),
+		WithEditorPluginVersion("copilot.vim/1.16.0"),
+		WithUserAgent("test-agent/1.0"),
+	)
+
+	if _, err := c.Login(); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+}
+
+func TestClientWithTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SessionResponse{Token: "session;exp=1"})
+	}))
+	defer server.Close()
+
+	transport := &recordingTransport{}
+	c := NewClient(WithGitHubAPIURL(server.URL), WithTransport(transport))
+
+	if _, err := c.GetSessionToken("access-token"); err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+	if len(transport.requests) != 1 {
+		t.Fatalf("Expected 1 request through the custom transport, got %d", len(transport.requests))
+	}
+	if transport.requests[0].Header.Get("authorization") != "token access-token" {
+		t.Errorf("Expected authorization: token access-token, got %s", transport.requests[0].Header.Get("authorization"))
+	}
+}
+
+func TestClientsAreIndependent(t *testing.T) {
+	newServer := func(token string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(SessionResponse{Token: token})
+		}))
+	}
+
+	first := newServer("first;exp=1")
+	defer first.Close()
+	second := newServer("second;exp=2")
+	defer second.Close()
+
+	a := NewClient(WithGitHubAPIURL(first.URL))
+	b := NewClient(WithGitHubAPIURL(second.URL))
+
+	sessionA, err := a.GetSessionToken("token")
+	if err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+	sessionB, err := b.GetSessionToken("token")
+	if err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+
+	if sessionA.Token != "first;exp=1" {
+		t.Errorf("Expected first client token first;exp=1, got %s", sessionA.Token)
+	}
+	if sessionB.Token != "second;exp=2" {
+		t.Errorf("Expected second client token second;exp=2, got %s", sessionB.Token)
+	}
+	if github_session_endpoint != "https://api.github.com/copilot_internal/v2/token" {
+		t.Errorf("Package default session endpoint was mutated: %s", github_session_endpoint)
+	}
+}
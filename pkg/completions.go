@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// code_completion_path is the path of the Copilot completions engine below
+// its base URL.
+var code_completion_path = "/v1/engines/copilot-codex/completions"
+
+// CodeCompletionStream reads the chunks of a code completion one at a time.
+// It is used like ChatStream.
+type CodeCompletionStream struct {
+	eventStream
+
+	current CodeCompletionResponse
+	usage   Usage
+}
+
+func CodeCompletion(token string, request CodeCompletionRequest) (CodeCompletionResponse, error) {
+	return defaultClient().CodeCompletion(token, request)
+}
+
+func CodeCompletionContext(ctx context.Context, token string, request CodeCompletionRequest) (CodeCompletionResponse, error) {
+	return defaultClient().CodeCompletionContext(ctx, token, request)
+}
+
+func StreamCodeCompletion(ctx context.Context, token string, request CodeCompletionRequest) (*CodeCompletionStream, error) {
+	return defaultClient().StreamCodeCompletion(ctx, token, request)
+}
+
+func (c *Client) CodeCompletion(token string, request CodeCompletionRequest) (CodeCompletionResponse, error) {
+	return c.CodeCompletionContext(context.Background(), token, request)
+}
+
+// CodeCompletionContext returns the complete code completion, joining the
+// streamed text of every choice.
+func (c *Client) CodeCompletionContext(ctx context.Context, token string, request CodeCompletionRequest) (CodeCompletionResponse, error) {
+	stream, err := c.StreamCodeCompletion(ctx, token, request)
+	if err != nil {
+		return CodeCompletionResponse{}, err
+	}
+
+	defer stream.Close()
+
+	return stream.Collect()
+}
+
+// StreamCodeCompletion sends a fill-in-the-middle request to the Copilot
+// completions engine and returns a stream over its chunks. The engine always
+// streams, so request.Stream is ignored; the caller must Close the returned
+// stream.
+func (c *Client) StreamCodeCompletion(ctx context.Context, token string, request CodeCompletionRequest) (*CodeCompletionStream, error) {
+	request.Stream = true
+
+	req, err := c.newRequest(ctx, http.MethodPost, c.codeCompletionEndpoint, request)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("authorization", "Bearer "+token)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CodeCompletionStream{
+		eventStream: eventStream{
+			ctx:    ctx,
+			body:   resp.Body,
+			events: newSSEReader(resp.Body),
+			logger: c.logger,
+		},
+	}, nil
+}
+
+// Next advances to the next chunk, which is then available through Current.
+// It returns false when the stream is exhausted, an error occurred or the
+// stream was closed; check Err to tell these apart.
+func (s *CodeCompletionStream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	for {
+		data, ok := s.nextData()
+		if !ok {
+			return false
+		}
+
+		var chunk CodeCompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			s.fail(err)
+			return false
+		}
+
+		if chunk.Usage != (Usage{}) {
+			s.usage = chunk.Usage
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		s.current = chunk
+		return true
+	}
+}
+
+// Current returns the chunk read by the last successful call to Next.
+func (s *CodeCompletionStream) Current() CodeCompletionResponse {
+	return s.current
+}
+
+// Usage returns the token usage reported by the upstream so far, if any.
+func (s *CodeCompletionStream) Usage() Usage {
+	return s.usage
+}
+
+// Collect reads the rest of the stream and returns the complete code
+// completion, joining the text of every choice by index.
+func (s *CodeCompletionStream) Collect() (CodeCompletionResponse, error) {
+	var response CodeCompletionResponse
+
+	choices := map[int64]*CodeCompletionChoice{}
+	for s.Next() {
+		chunk := s.Current()
+		if response.ID == "" {
+			response.ID = chunk.ID
+			response.Created = chunk.Created
+			response.Model = chunk.Model
+		}
+
+		for _, choice := range chunk.Choices {
+			merged, ok := choices[choice.Index]
+			if !ok {
+				merged = &CodeCompletionChoice{Index: choice.Index}
+				choices[choice.Index] = merged
+			}
+			merged.Text += choice.Text
+			if choice.FinishReason != "" {
+				merged.FinishReason = choice.FinishReason
+			}
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return CodeCompletionResponse{}, err
+	}
+
+	response.Choices = make([]CodeCompletionChoice, 0, len(choices))
+	for _, choice := range choices {
+		response.Choices = append(response.Choices, *choice)
+	}
+	sort.Slice(response.Choices, func(i, j int) bool {
+		return response.Choices[i].Index < response.Choices[j].Index
+	})
+	response.Usage = s.Usage()
+
+	return response, nil
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newCodeCompletionServer streams two chunks for each of two choices,
+// interleaved, followed by a usage chunk, and records the decoded request.
+func newCodeCompletionServer(t *testing.T, got *CodeCompletionRequest) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != code_completion_path {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("authorization") != "Bearer session-token" {
+			t.Errorf("Expected bearer authorization, got %q", r.Header.Get("authorization"))
+		}
+
+		json.NewDecoder(r.Body).Decode(got)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		chunks := []CodeCompletionResponse{
+			{ID: "cmpl-1", Created: 42, Model: "copilot-codex", Choices: []CodeCompletionChoice{{Text: "return ", Index: 1}}},
+			{ID: "cmpl-1", Created: 42, Model: "copilot-codex", Choices: []CodeCompletionChoice{{Text: "a + ", Index: 0}}},
+			{ID: "cmpl-1", Created: 42, Model: "copilot-codex", Choices: []CodeCompletionChoice{{Text: "b", Index: 0, FinishReason: "stop"}}},
+			{ID: "cmpl-1", Created: 42, Model: "copilot-codex", Choices: []CodeCompletionChoice{{Text: "a - b", Index: 1, FinishReason: "length"}}},
+			{ID: "cmpl-1", Created: 42, Model: "copilot-codex", Usage: Usage{PromptTokens: 5, CompletionTokens: 4, TotalTokens: 9}},
+		}
+		for _, chunk := range chunks {
+			data, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestCodeCompletion(t *testing.T) {
+	var got CodeCompletionRequest
+	server := newCodeCompletionServer(t, &got)
+
+	c := NewClient(WithCopilotProxyURL(server.URL))
+
+	temperature := 0.2
+	resp, err := c.CodeCompletion("session-token", CodeCompletionRequest{
+		Prompt:      "func add(a, b int) int {\n\t",
+		Suffix:      "\n}",
+		MaxTokens:   16,
+		Temperature: &temperature,
+		N:           2,
+		Stop:        []string{"\n\n"},
+		Extra:       &CodeCompletionExtra{Language: "go"},
+	})
+	if err != nil {
+		t.Fatalf("CodeCompletion failed: %v", err)
+	}
+
+	if !got.Stream {
+		t.Errorf("Expected the upstream request to stream")
+	}
+	if got.Suffix != "\n}" || got.MaxTokens != 16 || got.N != 2 {
+		t.Errorf("Unexpected request: %+v", got)
+	}
+	if len(got.Stop) != 1 || got.Stop[0] != "\n\n" {
+		t.Errorf("Expected stop [\"\\n\\n\"], got %q", got.Stop)
+	}
+	if got.Extra == nil || got.Extra.Language != "go" {
+		t.Errorf("Expected language go, got %+v", got.Extra)
+	}
+
+	if resp.ID != "cmpl-1" || resp.Created != 42 || resp.Model != "copilot-codex" {
+		t.Errorf("Unexpected response metadata: %+v", resp)
+	}
+	expected := []CodeCompletionChoice{
+		{Text: "a + b", Index: 0, FinishReason: "stop"},
+		{Text: "return a - b", Index: 1, FinishReason: "length"},
+	}
+	if len(resp.Choices) != len(expected) {
+		t.Fatalf("Expected %d choices, got %d", len(expected), len(resp.Choices))
+	}
+	for i, choice := range expected {
+		if resp.Choices[i] != choice {
+			t.Errorf("Choice %d: expected %+v, got %+v", i, choice, resp.Choices[i])
+		}
+	}
+	if resp.Usage.TotalTokens != 9 {
+		t.Errorf("Expected total tokens: 9, got %d", resp.Usage.TotalTokens)
+	}
+}
+
+func TestStreamCodeCompletion(t *testing.T) {
+	var got CodeCompletionRequest
+	server := newCodeCompletionServer(t, &got)
+
+	c := NewClient(WithCopilotProxyURL(server.URL + "/"))
+
+	stream, err := c.StreamCodeCompletion(context.Background(), "session-token", CodeCompletionRequest{Prompt: "x"})
+	if err != nil {
+		t.Fatalf("StreamCodeCompletion failed: %v", err)
+	}
+	defer stream.Close()
+
+	var texts []string
+	for stream.Next() {
+		for _, choice := range stream.Current().Choices {
+			texts = append(texts, choice.Text)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+
+	if len(texts) != 4 {
+		t.Errorf("Expected 4 chunks with text, got %d: %q", len(texts), texts)
+	}
+	if stream.Usage().PromptTokens != 5 {
+		t.Errorf("Expected prompt tokens: 5, got %d", stream.Usage().PromptTokens)
+	}
+}
+
+func TestCodeCompletionUpstreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"slow down"}}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	_, err := c.CodeCompletion("session-token", CodeCompletionRequest{Prompt: "x"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 APIError, got %v", err)
+	}
+}
@@ -1,15 +1,14 @@
 package pkg
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
-
-	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -19,89 +18,87 @@ var (
 )
 
 var (
-	github_authentication_endpoint = "https://github.com/login/oauth/access_token"
-	github_completion_endpoint     = "https://api.githubcopilot.com/chat/completions"
-	github_login_endpoint          = "https://github.com/login/device/code"
-	github_session_endpoint        = "https://api.github.com/copilot_internal/v2/token"
+	github_authentication_endpoint  = "https://github.com/login/oauth/access_token"
+	github_code_completion_endpoint = "https://copilot-proxy.githubusercontent.com/v1/engines/copilot-codex/completions"
+	github_completion_endpoint      = "https://api.githubcopilot.com/chat/completions"
+	github_embeddings_endpoint      = "https://api.githubcopilot.com/embeddings"
+	github_login_endpoint           = "https://github.com/login/device/code"
+	github_models_endpoint          = "https://api.githubcopilot.com/models"
+	github_session_endpoint         = "https://api.github.com/copilot_internal/v2/token"
+	github_user_endpoint            = "https://api.github.com/user"
 )
 
 var user_agent = "githubCopilot/1.155.0"
 
 func Authenticate(login LoginResponse) (AuthenticationResponse, error) {
+	return defaultClient().Authenticate(login)
+}
+
+func AuthenticateContext(ctx context.Context, login LoginResponse) (AuthenticationResponse, error) {
+	return defaultClient().AuthenticateContext(ctx, login)
+}
+
+func (c *Client) Authenticate(login LoginResponse) (AuthenticationResponse, error) {
+	return c.AuthenticateContext(context.Background(), login)
+}
+
+// AuthenticateContext polls for the access token of a device code once. Until
+// the code is authorized the response carries an OAuth error such as
+// DeviceFlowAuthorizationPending in its Error field rather than an error,
+// whether the server answers with 200 like GitHub or with 400 as in RFC 8628.
+func (c *Client) AuthenticateContext(ctx context.Context, login LoginResponse) (AuthenticationResponse, error) {
 	var authResponse AuthenticationResponse
 
 	body := AuthenticationRequest{
-		ClientID:   editor_client_id,
+		ClientID:   c.clientID,
 		DeviceCode: login.DeviceCode,
 		GrantType:  "urn:ietf:params:oauth:grant-type:device_code",
 	}
 
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		log.Error().Msgf("Error marshaling json: %s", err)
-		return authResponse, err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, github_authentication_endpoint, bytes.NewBuffer(jsonBody))
+	req, err := c.newRequest(ctx, http.MethodPost, c.authenticationEndpoint, body)
 	if err != nil {
-		log.Error().Msgf("Error creating request: %s", err)
 		return authResponse, err
 	}
 
 	req.Header.Set("accept", "application/json")
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("editor-version", editor_version)
-	req.Header.Set("editor-plugin-version", editor_plugin_version)
-	req.Header.Set("user-agent", user_agent)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && apiErr.Code != "" {
+		authResponse.Error = apiErr.Code
+		authResponse.ErrorDescription = apiErr.Message
+		return authResponse, nil
+	}
 	if err != nil {
-		log.Error().Msgf("Error sending request: %s", err)
 		return authResponse, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		var errorResponse struct {
-			Error struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Code    string `json:"code"`
-			} `json:"error"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-			log.Error().
-				Err(err).
-				Int("status_code", resp.StatusCode).
-				Msg("Failed to decode error response")
-			return authResponse, fmt.Errorf("API request failed with status: %d", resp.StatusCode)
-		}
-
-		log.Error().
-			Int("status_code", resp.StatusCode).
-			Str("error_type", errorResponse.Error.Type).
-			Str("error_code", errorResponse.Error.Code).
-			Str("error_message", errorResponse.Error.Message).
-			Msg("API request failed")
-
-		return authResponse, fmt.Errorf("API error: %s (code: %s, type: %s)",
-			errorResponse.Error.Message,
-			errorResponse.Error.Code,
-			errorResponse.Error.Type)
-	}
-
 	err = json.NewDecoder(resp.Body).Decode(&authResponse)
 	if err != nil {
-		log.Error().Msgf("Error decoding response: %s", err)
+		c.logger.Error().Msgf("Error decoding response: %s", err)
 		return authResponse, err
 	}
 	return authResponse, nil
 }
 
 func Chat(token string, messages []Message, model string, temperature float64, top_p float64, completion_n int64, stream bool, callback CompletionResponseHandler) error {
+	return defaultClient().Chat(token, messages, model, temperature, top_p, completion_n, stream, callback)
+}
+
+func ChatContext(ctx context.Context, token string, messages []Message, model string, temperature float64, top_p float64, completion_n int64, stream bool, callback CompletionResponseHandler) error {
+	return defaultClient().ChatContext(ctx, token, messages, model, temperature, top_p, completion_n, stream, callback)
+}
+
+func (c *Client) Chat(token string, messages []Message, model string, temperature float64, top_p float64, completion_n int64, stream bool, callback CompletionResponseHandler) error {
+	return c.ChatContext(context.Background(), token, messages, model, temperature, top_p, completion_n, stream, callback)
+}
+
+// ChatContext is like Chat but aborts the upstream request, including an
+// in-progress stream, as soon as ctx is done. An error returned by callback
+// stops the stream and is returned.
+func (c *Client) ChatContext(ctx context.Context, token string, messages []Message, model string, temperature float64, top_p float64, completion_n int64, stream bool, callback CompletionResponseHandler) error {
 	body := CompletionRequest{
 		Model:       model,
 		Messages:    messages,
@@ -111,174 +108,56 @@ func Chat(token string, messages []Message, model string, temperature float64, t
 		Stream:      stream,
 	}
 
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		log.Error().Msgf("Error marshaling json: %s", err)
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, github_completion_endpoint, bytes.NewBuffer(jsonBody))
-
-	req.Header.Set("editor-version", editor_version)
-	req.Header.Set("editor-plugin-version", editor_plugin_version)
-	req.Header.Set("user-agent", user_agent)
-
+	chatStream, err := c.StreamChat(ctx, token, body)
 	if err != nil {
-		log.Error().Msgf("Error creating request: %s", err)
 		return err
 	}
 
-	req.Header.Set("authorization", "Bearer "+token)
+	defer chatStream.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error().Msgf("Error sending request: %s", err)
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		var errorResponse struct {
-			Error struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Code    string `json:"code"`
-			} `json:"error"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-			log.Error().
-				Err(err).
-				Int("status_code", resp.StatusCode).
-				Msg("Failed to decode error response")
-			return fmt.Errorf("API request failed with status: %d", resp.StatusCode)
+	for chatStream.Next() {
+		if err := callback(chatStream.Current()); err != nil {
+			c.logger.Error().Msgf("Callback error: %s", err)
+			return err
 		}
-
-		log.Error().
-			Int("status_code", resp.StatusCode).
-			Str("error_type", errorResponse.Error.Type).
-			Str("error_code", errorResponse.Error.Code).
-			Str("error_message", errorResponse.Error.Message).
-			Msg("API request failed")
-
-		return fmt.Errorf("API error: %s (code: %s, type: %s)",
-			errorResponse.Error.Message,
-			errorResponse.Error.Code,
-			errorResponse.Error.Type)
 	}
 
-	var completionResponse CompletionResponse
-
-	if stream {
-
-		scn := bufio.NewScanner(resp.Body)
-
-		scnBuf := make([]byte, 0, 4096)
-		scn.Buffer(scnBuf, cap(scnBuf))
-
-		for scn.Scan() {
-			b := scn.Bytes()
-
-			if !bytes.HasPrefix(b, []byte("data:")) {
-				continue
-			}
-
-			b = bytes.TrimSpace(b[5:])
-
-			if bytes.Equal(b, []byte("[DONE]")) {
-				return nil
-			}
-
-			err = json.Unmarshal(b, &completionResponse)
-			if err != nil {
-				log.Error().Msgf("Error decoding response: %s", err)
-				return err
-			}
-
-			if len(completionResponse.Choices) == 0 {
-				continue
-			}
-
-			if err := callback(completionResponse); err != nil {
-				log.Error().Msgf("Callback error: %s", err)
-			}
-		}
+	return chatStream.Err()
+}
 
-		// For streaming mode, we're done processing - don't continue to non-streaming code
-		return nil
-	}
+func GetSessionToken(accessToken string) (SessionResponse, error) {
+	return defaultClient().GetSessionToken(accessToken)
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&completionResponse)
-	if err != nil {
-		log.Error().Msgf("Error decoding response: %s", err)
-		return err
-	}
+func GetSessionTokenContext(ctx context.Context, accessToken string) (SessionResponse, error) {
+	return defaultClient().GetSessionTokenContext(ctx, accessToken)
+}
 
-	if err := callback(completionResponse); err != nil {
-		log.Error().Msgf("Callback error: %s", err)
-	}
-	return nil
+func (c *Client) GetSessionToken(accessToken string) (SessionResponse, error) {
+	return c.GetSessionTokenContext(context.Background(), accessToken)
 }
 
-func GetSessionToken(accessToken string) (SessionResponse, error) {
+func (c *Client) GetSessionTokenContext(ctx context.Context, accessToken string) (SessionResponse, error) {
 	var sessionResponse SessionResponse
 
-	req, err := http.NewRequest(http.MethodGet, github_session_endpoint, nil)
+	req, err := c.newRequest(ctx, http.MethodGet, c.sessionEndpoint, nil)
 	if err != nil {
-		log.Error().Msgf("Error creating request: %s", err)
 		return sessionResponse, err
 	}
 
 	req.Header.Set("accept", "application/json")
 	req.Header.Set("authorization", "token "+accessToken)
-	req.Header.Set("editor-version", editor_version)
-	req.Header.Set("editor-plugin-version", editor_plugin_version)
-	req.Header.Set("user-agent", user_agent)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		log.Error().Msgf("Error sending request: %s", err)
 		return sessionResponse, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		var errorResponse struct {
-			Error struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Code    string `json:"code"`
-			} `json:"error"`
-		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-			log.Error().
-				Err(err).
-				Int("status_code", resp.StatusCode).
-				Msg("Failed to decode error response")
-			return sessionResponse, fmt.Errorf("API request failed with status: %d", resp.StatusCode)
-		}
-
-		log.Error().
-			Int("status_code", resp.StatusCode).
-			Str("error_type", errorResponse.Error.Type).
-			Str("error_code", errorResponse.Error.Code).
-			Str("error_message", errorResponse.Error.Message).
-			Msg("API request failed")
-
-		return sessionResponse, fmt.Errorf("API error: %s (code: %s, type: %s)",
-			errorResponse.Error.Message,
-			errorResponse.Error.Code,
-			errorResponse.Error.Type)
-	}
-
 	err = json.NewDecoder(resp.Body).Decode(&sessionResponse)
 	if err != nil {
-		log.Error().Msgf("Error decoding response: %s", err)
+		c.logger.Error().Msgf("Error decoding response: %s", err)
 		return sessionResponse, err
 	}
 
@@ -286,13 +165,13 @@ func GetSessionToken(accessToken string) (SessionResponse, error) {
 	matches := re.FindStringSubmatch(sessionResponse.Token)
 
 	if len(matches) < 2 {
-		log.Error().Msgf("Error parsing token: %s", err)
-		return sessionResponse, err
+		c.logger.Error().Msg("Error parsing token: no expiry found")
+		return sessionResponse, nil
 	}
 
 	exp, err := strconv.ParseInt(matches[1], 10, 64)
 	if err != nil {
-		log.Error().Msgf("Error parsing token: %s", err)
+		c.logger.Error().Msgf("Error parsing token: %s", err)
 		return sessionResponse, err
 	}
 
@@ -301,72 +180,149 @@ func GetSessionToken(accessToken string) (SessionResponse, error) {
 	return sessionResponse, nil
 }
 
+func GetUser(accessToken string) (User, error) {
+	return defaultClient().GetUser(accessToken)
+}
+
+func GetUserContext(ctx context.Context, accessToken string) (User, error) {
+	return defaultClient().GetUserContext(ctx, accessToken)
+}
+
+func (c *Client) GetUser(accessToken string) (User, error) {
+	return c.GetUserContext(context.Background(), accessToken)
+}
+
+// GetUserContext returns the GitHub user the OAuth token belongs to.
+func (c *Client) GetUserContext(ctx context.Context, accessToken string) (User, error) {
+	var user User
+
+	req, err := c.newRequest(ctx, http.MethodGet, c.userEndpoint, nil)
+	if err != nil {
+		return user, err
+	}
+
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("authorization", "token "+accessToken)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return user, err
+	}
+
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err != nil {
+		c.logger.Error().Msgf("Error decoding response: %s", err)
+		return user, err
+	}
+
+	return user, nil
+}
+
 func Login() (LoginResponse, error) {
+	return defaultClient().Login()
+}
+
+func LoginContext(ctx context.Context) (LoginResponse, error) {
+	return defaultClient().LoginContext(ctx)
+}
+
+func (c *Client) Login() (LoginResponse, error) {
+	return c.LoginContext(context.Background())
+}
+
+func (c *Client) LoginContext(ctx context.Context) (LoginResponse, error) {
 	var loginResponse LoginResponse
 
 	body := LoginRequest{
-		ClientID: editor_client_id,
+		ClientID: c.clientID,
 		Scopes:   "read:user",
 	}
 
-	jsonBody, err := json.Marshal(body)
+	req, err := c.newRequest(ctx, http.MethodPost, c.loginEndpoint, body)
 	if err != nil {
 		return loginResponse, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, github_login_endpoint, bytes.NewBuffer(jsonBody))
+	req.Header.Set("accept", "application/json")
+
+	resp, err := c.do(req)
 	if err != nil {
 		return loginResponse, err
 	}
 
-	req.Header.Set("accept", "application/json")
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("editor-version", editor_version)
-	req.Header.Set("editor-plugin-version", editor_plugin_version)
-	req.Header.Set("user-agent", user_agent)
+	defer resp.Body.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = json.NewDecoder(resp.Body).Decode(&loginResponse)
 	if err != nil {
 		return loginResponse, err
 	}
 
-	defer resp.Body.Close()
+	return loginResponse, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		var errorResponse struct {
-			Error struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Code    string `json:"code"`
-			} `json:"error"`
+// newRequest builds a request bound to ctx carrying the editor headers. A
+// non-nil body is encoded as JSON.
+func (c *Client) newRequest(ctx context.Context, method, url string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonBody, err := json.Marshal(body)
+		if err != nil {
+			c.logger.Error().Msgf("Error marshaling json: %s", err)
+			return nil, err
 		}
+		reader = bytes.NewBuffer(jsonBody)
+	}
 
-		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-			log.Error().
-				Err(err).
-				Int("status_code", resp.StatusCode).
-				Msg("Failed to decode error response")
-			return loginResponse, fmt.Errorf("API request failed with status: %d", resp.StatusCode)
-		}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		c.logger.Error().Msgf("Error creating request: %s", err)
+		return nil, err
+	}
 
-		log.Error().
-			Int("status_code", resp.StatusCode).
-			Str("error_type", errorResponse.Error.Type).
-			Str("error_code", errorResponse.Error.Code).
-			Str("error_message", errorResponse.Error.Message).
-			Msg("API request failed")
-
-		return loginResponse, fmt.Errorf("API error: %s (code: %s, type: %s)",
-			errorResponse.Error.Message,
-			errorResponse.Error.Code,
-			errorResponse.Error.Type)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
 	}
+	req.Header.Set("editor-version", c.editorVersion)
+	req.Header.Set("editor-plugin-version", c.editorPluginVersion)
+	req.Header.Set("user-agent", c.userAgent)
 
-	err = json.NewDecoder(resp.Body).Decode(&loginResponse)
+	return req, nil
+}
+
+// do sends the request, retrying transient failures, and turns any non-200
+// response into an error. On success the caller owns the response body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	return c.sendWithRetry(req)
+}
+
+// send makes a single attempt at the request.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return loginResponse, err
+		c.logger.Error().Msgf("Error sending request: %s", err)
+		return nil, err
 	}
 
-	return loginResponse, nil
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, c.errorFromResponse(resp)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) errorFromResponse(resp *http.Response) error {
+	apiErr := newAPIError(resp)
+
+	c.logger.Error().
+		Int("status_code", apiErr.StatusCode).
+		Str("error_type", apiErr.Type).
+		Str("error_code", apiErr.Code).
+		Str("error_message", apiErr.Message).
+		Dur("retry_after", apiErr.RetryAfter).
+		Msg("API request failed")
+
+	return apiErr
 }
@@ -1,7 +1,10 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -172,6 +175,44 @@ func TestAuthenticate(t *testing.T) {
 	}
 }
 
+func TestAuthenticateDeviceFlowErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{name: "GitHub style", status: http.StatusOK},
+		{name: "RFC 8628 style", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"error":"slow_down","error_description":"Too many requests have been made in the same timeframe.","interval":10}`))
+			}))
+			defer server.Close()
+
+			client := NewClient(WithGitHubURL(server.URL))
+
+			authResp, err := client.Authenticate(LoginResponse{DeviceCode: "test-device-code"})
+			if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+
+			if authResp.Error != DeviceFlowSlowDown {
+				t.Errorf("Expected error: %s, got %s", DeviceFlowSlowDown, authResp.Error)
+			}
+			if authResp.ErrorDescription != "Too many requests have been made in the same timeframe." {
+				t.Errorf("Expected error description, got %q", authResp.ErrorDescription)
+			}
+			if authResp.AccessToken != "" {
+				t.Errorf("Expected no access token, got %s", authResp.AccessToken)
+			}
+		})
+	}
+}
+
 func TestGetSessionToken(t *testing.T) {
 	// Mock server for GitHub session endpoint
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -217,6 +258,32 @@ func TestGetSessionToken(t *testing.T) {
 	}
 }
 
+func TestGetUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" {
+			t.Errorf("Expected path /user, got %s", r.URL.Path)
+		}
+		if r.Header.Get("authorization") != "token test-access-token" {
+			t.Errorf("Expected authorization: token test-access-token, got %s", r.Header.Get("authorization"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"login":"octocat","id":583231,"name":"The Octocat","type":"User"}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubAPIURL(server.URL))
+
+	user, err := c.GetUser("test-access-token")
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+
+	if user.Login != "octocat" || user.ID != 583231 || user.Name != "The Octocat" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+}
+
 func TestChat(t *testing.T) {
 	// Mock server for GitHub chat completion endpoint
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -436,3 +503,95 @@ func BenchmarkLoginRequest(b *testing.B) {
 		}
 	}
 }
+
+func TestChatContextCancelsStream(t *testing.T) {
+	upstreamDone := make(chan struct{})
+
+	// Mock server that keeps streaming until the client goes away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+
+		for {
+			chunk := CompletionResponse{
+				Choices: []Choice{{Delta: &Message{Role: "assistant", Content: "tick"}}},
+			}
+			data, _ := json.Marshal(chunk)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunks := 0
+	err := c.ChatContext(ctx, "test-session-token", []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, true, func(response CompletionResponse) error {
+		chunks++
+		if chunks == 3 {
+			cancel()
+		}
+		return nil
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if chunks != 3 {
+		t.Errorf("Expected 3 chunks before cancellation, got %d", chunks)
+	}
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream request was not aborted after cancellation")
+	}
+}
+
+func TestContextVariantsHonorCancellation(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubURL(server.URL), WithGitHubAPIURL(server.URL), WithCopilotURL(server.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.LoginContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("LoginContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := c.AuthenticateContext(ctx, LoginResponse{DeviceCode: "device-code"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("AuthenticateContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := c.GetSessionTokenContext(ctx, "access-token"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetSessionTokenContext: expected context.Canceled, got %v", err)
+	}
+	err := c.ChatContext(ctx, "session-token", []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, false, func(CompletionResponse) error {
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ChatContext: expected context.Canceled, got %v", err)
+	}
+
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests with a cancelled context, got %d", requests)
+	}
+}
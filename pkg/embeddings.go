@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// embeddings_batch_size is the largest number of inputs sent to the Copilot
+// embeddings API in one request.
+var embeddings_batch_size = 512
+
+// WithEmbeddingsBatchSize sets the largest number of inputs sent upstream in
+// a single embeddings request. Larger requests are split into batches.
+func WithEmbeddingsBatchSize(size int) Option {
+	return func(c *Client) {
+		c.embeddingsBatchSize = size
+	}
+}
+
+func Embeddings(token string, request EmbeddingRequest) (EmbeddingResponse, error) {
+	return defaultClient().Embeddings(token, request)
+}
+
+func EmbeddingsContext(ctx context.Context, token string, request EmbeddingRequest) (EmbeddingResponse, error) {
+	return defaultClient().EmbeddingsContext(ctx, token, request)
+}
+
+func (c *Client) Embeddings(token string, request EmbeddingRequest) (EmbeddingResponse, error) {
+	return c.EmbeddingsContext(context.Background(), token, request)
+}
+
+// EmbeddingsContext returns the embeddings of request.Input. Inputs beyond
+// the batch size are sent in several upstream requests whose results are
+// merged in input order.
+func (c *Client) EmbeddingsContext(ctx context.Context, token string, request EmbeddingRequest) (EmbeddingResponse, error) {
+	response := EmbeddingResponse{
+		Object: "list",
+		Data:   make([]Embedding, 0, len(request.Input)),
+		Model:  request.Model,
+	}
+
+	batchSize := c.embeddingsBatchSize
+	if batchSize <= 0 {
+		batchSize = len(request.Input)
+	}
+
+	for start := 0; start < len(request.Input); start += batchSize {
+		end := start + batchSize
+		if end > len(request.Input) {
+			end = len(request.Input)
+		}
+
+		batch := request
+		batch.Input = request.Input[start:end]
+
+		batchResponse, err := c.embeddingsBatch(ctx, token, batch)
+		if err != nil {
+			return EmbeddingResponse{}, err
+		}
+
+		for _, embedding := range batchResponse.Data {
+			embedding.Index += start
+			if embedding.Object == "" {
+				embedding.Object = "embedding"
+			}
+			response.Data = append(response.Data, embedding)
+		}
+
+		if batchResponse.Model != "" {
+			response.Model = batchResponse.Model
+		}
+		response.Usage.PromptTokens += batchResponse.Usage.PromptTokens
+		response.Usage.TotalTokens += batchResponse.Usage.TotalTokens
+	}
+
+	sort.SliceStable(response.Data, func(i, j int) bool {
+		return response.Data[i].Index < response.Data[j].Index
+	})
+
+	return response, nil
+}
+
+func (c *Client) embeddingsBatch(ctx context.Context, token string, request EmbeddingRequest) (EmbeddingResponse, error) {
+	var embeddingResponse EmbeddingResponse
+
+	req, err := c.newRequest(ctx, http.MethodPost, c.embeddingsEndpoint, request)
+	if err != nil {
+		return embeddingResponse, err
+	}
+
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("authorization", "Bearer "+token)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return embeddingResponse, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&embeddingResponse); err != nil {
+		c.logger.Error().Msgf("Error decoding response: %s", err)
+		return embeddingResponse, err
+	}
+
+	return embeddingResponse, nil
+}
+
+// Base64 returns the embedding in the OpenAI base64 encoding format: the
+// vector as little-endian float32 values, base64 encoded.
+func (e Embedding) Base64() string {
+	buf := make([]byte, 4*len(e.Embedding))
+	for i, v := range e.Embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
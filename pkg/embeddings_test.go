@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newEmbeddingsServer answers every input with a one-dimensional embedding
+// holding the input's length and records the inputs of each request.
+func newEmbeddingsServer(t *testing.T, batches *[][]string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/embeddings" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("authorization") != "Bearer session-token" {
+			t.Errorf("Expected bearer authorization, got %q", r.Header.Get("authorization"))
+		}
+
+		var req EmbeddingRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		*batches = append(*batches, req.Input)
+
+		// Answer in reverse order to check that results are ordered by index
+		resp := EmbeddingResponse{Model: req.Model + "-upstream"}
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			resp.Data = append(resp.Data, Embedding{
+				Object:    "embedding",
+				Embedding: []float64{float64(len(req.Input[i]))},
+				Index:     i,
+			})
+		}
+		resp.Usage = EmbeddingUsage{PromptTokens: int64(len(req.Input)), TotalTokens: int64(len(req.Input))}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestEmbeddings(t *testing.T) {
+	var batches [][]string
+	server := newEmbeddingsServer(t, &batches)
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	resp, err := c.Embeddings("session-token", EmbeddingRequest{
+		Model: "text-embedding-3-small",
+		Input: []string{"a", "bb"},
+	})
+	if err != nil {
+		t.Fatalf("Embeddings failed: %v", err)
+	}
+
+	if len(batches) != 1 {
+		t.Errorf("Expected a single upstream request, got %d", len(batches))
+	}
+	if resp.Object != "list" || resp.Model != "text-embedding-3-small-upstream" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+	if len(resp.Data) != 2 || resp.Data[0].Embedding[0] != 1 || resp.Data[1].Embedding[0] != 2 {
+		t.Errorf("Expected embeddings in input order, got %+v", resp.Data)
+	}
+}
+
+func TestEmbeddingsBatching(t *testing.T) {
+	var batches [][]string
+	server := newEmbeddingsServer(t, &batches)
+
+	c := NewClient(WithCopilotURL(server.URL), WithEmbeddingsBatchSize(2))
+
+	input := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+	resp, err := c.EmbeddingsContext(context.Background(), "session-token", EmbeddingRequest{
+		Model: "text-embedding-3-small",
+		Input: input,
+	})
+	if err != nil {
+		t.Fatalf("Embeddings failed: %v", err)
+	}
+
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 {
+		t.Errorf("Expected batches of 2, 2 and 1 inputs, got %v", batches)
+	}
+
+	if len(resp.Data) != len(input) {
+		t.Fatalf("Expected %d embeddings, got %d", len(input), len(resp.Data))
+	}
+	for i, embedding := range resp.Data {
+		if embedding.Index != i || embedding.Embedding[0] != float64(len(input[i])) {
+			t.Errorf("Embedding %d does not match its input: %+v", i, embedding)
+		}
+	}
+
+	if resp.Usage.PromptTokens != 5 || resp.Usage.TotalTokens != 5 {
+		t.Errorf("Expected usage summed over batches, got %+v", resp.Usage)
+	}
+}
+
+func TestEmbeddingBase64(t *testing.T) {
+	embedding := Embedding{Embedding: []float64{0.5, -1, 0.25}}
+
+	data, err := base64.StdEncoding.DecodeString(embedding.Base64())
+	if err != nil {
+		t.Fatalf("Invalid base64: %v", err)
+	}
+	if len(data) != 12 {
+		t.Fatalf("Expected 12 bytes, got %d", len(data))
+	}
+
+	for i, want := range embedding.Embedding {
+		got := math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		if float64(got) != want {
+			t.Errorf("Value %d: expected %v, got %v", i, want, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError is returned when the GitHub or Copilot API answers with a non-200
+// status. Use errors.As to inspect it.
+type APIError struct {
+	// StatusCode is the HTTP status returned by the upstream API.
+	StatusCode int
+	// Type, Code and Message are taken from the upstream error object when
+	// one could be decoded.
+	Type    string
+	Code    string
+	Message string
+	// RetryAfter is the delay requested by the Retry-After header, or zero
+	// when the header is absent.
+	RetryAfter time.Duration
+	// Body holds the raw response body.
+	Body []byte
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" && e.Code == "" && e.Type == "" {
+		return fmt.Sprintf("API request failed with status: %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("API error: %s (code: %s, type: %s)", e.Message, e.Code, e.Type)
+}
+
+// Retryable reports whether the request may succeed if sent again, i.e. the
+// upstream was rate limited or temporarily unavailable.
+func (e *APIError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newAPIError reads resp and builds an APIError from it. It understands the
+// OpenAI style {"error": {...}} object, the OAuth {"error": "...",
+// "error_description": "..."} form and the GitHub REST {"message": "..."} form.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return apiErr
+	}
+
+	apiErr.parseBody(body)
+	return apiErr
+}
+
+// parseBody stores body and fills in the type, code and message from it.
+func (e *APIError) parseBody(body []byte) {
+	e.Body = body
+
+	var errorResponse struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+		Message          string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return
+	}
+
+	var errorObject struct {
+		Message string          `json:"message"`
+		Type    string          `json:"type"`
+		Code    json.RawMessage `json:"code"`
+	}
+	var errorString string
+
+	switch {
+	case json.Unmarshal(errorResponse.Error, &errorObject) == nil:
+		e.Message = errorObject.Message
+		e.Type = errorObject.Type
+		e.Code = rawString(errorObject.Code)
+	case json.Unmarshal(errorResponse.Error, &errorString) == nil:
+		e.Code = errorString
+		e.Message = errorResponse.ErrorDescription
+	default:
+		e.Message = errorResponse.Message
+	}
+}
+
+// rawString returns a JSON string or number as a plain string.
+func rawString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+
+	return ""
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header: a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
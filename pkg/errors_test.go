@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewAPIErrorFormats(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		expectedType    string
+		expectedCode    string
+		expectedMessage string
+		expectedError   string
+	}{
+		{
+			name:            "OpenAI error object",
+			body:            `{"error":{"message":"Rate limit exceeded","type":"rate_limit_error","code":"rate_limited"}}`,
+			expectedType:    "rate_limit_error",
+			expectedCode:    "rate_limited",
+			expectedMessage: "Rate limit exceeded",
+			expectedError:   "API error: Rate limit exceeded (code: rate_limited, type: rate_limit_error)",
+		},
+		{
+			name:            "Numeric code",
+			body:            `{"error":{"message":"Bad request","type":"invalid_request_error","code":400}}`,
+			expectedType:    "invalid_request_error",
+			expectedCode:    "400",
+			expectedMessage: "Bad request",
+			expectedError:   "API error: Bad request (code: 400, type: invalid_request_error)",
+		},
+		{
+			name:            "OAuth error",
+			body:            `{"error":"incorrect_client_credentials","error_description":"The client_id is incorrect."}`,
+			expectedCode:    "incorrect_client_credentials",
+			expectedMessage: "The client_id is incorrect.",
+			expectedError:   "API error: The client_id is incorrect. (code: incorrect_client_credentials, type: )",
+		},
+		{
+			name:            "GitHub REST error",
+			body:            `{"message":"Bad credentials","documentation_url":"https://docs.github.com/rest"}`,
+			expectedMessage: "Bad credentials",
+			expectedError:   "API error: Bad credentials (code: , type: )",
+		},
+		{
+			name:          "Unparseable body",
+			body:          `upstream connect error`,
+			expectedError: "API request failed with status: 503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(http.StatusServiceUnavailable)
+			recorder.WriteString(tt.body)
+
+			apiErr := newAPIError(recorder.Result())
+
+			if apiErr.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("Expected status 503, got %d", apiErr.StatusCode)
+			}
+			if apiErr.Type != tt.expectedType {
+				t.Errorf("Expected type %q, got %q", tt.expectedType, apiErr.Type)
+			}
+			if apiErr.Code != tt.expectedCode {
+				t.Errorf("Expected code %q, got %q", tt.expectedCode, apiErr.Code)
+			}
+			if apiErr.Message != tt.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectedMessage, apiErr.Message)
+			}
+			if apiErr.Error() != tt.expectedError {
+				t.Errorf("Expected error %q, got %q", tt.expectedError, apiErr.Error())
+			}
+			if string(apiErr.Body) != tt.body {
+				t.Errorf("Expected raw body %q, got %q", tt.body, string(apiErr.Body))
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("Expected 0 for empty header, got %s", d)
+	}
+	if d := parseRetryAfter("30"); d != 30*time.Second {
+		t.Errorf("Expected 30s, got %s", d)
+	}
+	if d := parseRetryAfter("-5"); d != 0 {
+		t.Errorf("Expected 0 for negative seconds, got %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("Expected 0 for invalid header, got %s", d)
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d <= 0 || d > time.Minute {
+		t.Errorf("Expected a delay of up to one minute for %s, got %s", date, d)
+	}
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	retryable := map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	}
+
+	for status, expected := range retryable {
+		apiErr := &APIError{StatusCode: status}
+		if apiErr.Retryable() != expected {
+			t.Errorf("Status %d: expected Retryable() %t, got %t", status, expected, apiErr.Retryable())
+		}
+	}
+}
+
+func TestChatReturnsAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"Too many requests","type":"rate_limit_error","code":"rate_limited"}}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	err := c.Chat("session-token", []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, false, func(CompletionResponse) error {
+		return nil
+	})
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected an *APIError, got %T: %v", err, err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", apiErr.StatusCode)
+	}
+	if apiErr.RetryAfter != 12*time.Second {
+		t.Errorf("Expected RetryAfter 12s, got %s", apiErr.RetryAfter)
+	}
+	if apiErr.Code != "rate_limited" {
+		t.Errorf("Expected code rate_limited, got %s", apiErr.Code)
+	}
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaxImageSize is the largest decoded image ResolveImages accepts by
+// default, matching the OpenAI limit of 20 MB.
+const DefaultMaxImageSize = 20 << 20
+
+var image_mime_types = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// ErrInvalidImageURL is returned for a file:// image URL that is not allowed
+// or cannot be read. It names no path, so that a caller cannot probe the file
+// system with it.
+var ErrInvalidImageURL = errors.New("invalid image_url")
+
+// ResolveImages validates the image parts of messages before they are sent
+// upstream. Base64 data URLs must hold a supported image no larger than
+// maxSize bytes. http(s) URLs are left for the upstream to fetch, and file://
+// URLs are rejected.
+func ResolveImages(messages []Message, maxSize int64) error {
+	return ResolveImagesFrom(messages, maxSize, "")
+}
+
+// ResolveImagesFrom is like ResolveImages, but file:// URLs of images inside
+// dir are read, validated the same way and replaced by a data URL. Any other
+// file:// URL fails with ErrInvalidImageURL. With an empty dir, every file://
+// URL is rejected.
+func ResolveImagesFrom(messages []Message, maxSize int64, dir string) error {
+	for i := range messages {
+		for j := range messages[i].MultiContent {
+			part := &messages[i].MultiContent[j]
+			if part.ImageURL == nil {
+				continue
+			}
+
+			resolved, err := resolveImageURL(part.ImageURL.URL, maxSize, dir)
+			if err != nil {
+				return fmt.Errorf("messages[%d].content[%d]: %w", i, j, err)
+			}
+			part.ImageURL.URL = resolved
+		}
+	}
+
+	return nil
+}
+
+// HasImages reports whether any of the messages contains an image part.
+func HasImages(messages []Message) bool {
+	for _, message := range messages {
+		if message.HasImages() {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveImageURL(rawURL string, maxSize int64, dir string) (string, error) {
+	scheme, _, _ := strings.Cut(rawURL, ":")
+
+	switch strings.ToLower(scheme) {
+	case "http", "https":
+		return rawURL, nil
+	case "data":
+		if err := validateDataURL(rawURL, maxSize); err != nil {
+			return "", err
+		}
+		return rawURL, nil
+	case "file":
+		return readImageFile(rawURL, maxSize, dir)
+	}
+
+	return "", fmt.Errorf("unsupported image URL scheme %q", scheme)
+}
+
+func validateDataURL(rawURL string, maxSize int64) error {
+	_, rest, _ := strings.Cut(rawURL, ":")
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return fmt.Errorf("malformed data URL")
+	}
+
+	params := strings.Split(header, ";")
+	if !strings.EqualFold(params[len(params)-1], "base64") {
+		return fmt.Errorf("data URL must be base64 encoded")
+	}
+
+	mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+	if !image_mime_types[mimeType] {
+		return fmt.Errorf("unsupported image type %q", mimeType)
+	}
+
+	if int64(base64.StdEncoding.DecodedLen(len(payload))) > maxSize+2 {
+		return fmt.Errorf("image exceeds %d bytes", maxSize)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("invalid base64 image data: %w", err)
+	}
+
+	return validateImage(data, mimeType, maxSize)
+}
+
+// readImageFile reads the image of a file:// URL inside dir. Every failure to
+// get at the file is reported as ErrInvalidImageURL.
+func readImageFile(rawURL string, maxSize int64, dir string) (string, error) {
+	if dir == "" {
+		return "", ErrInvalidImageURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Host != "" && u.Host != "localhost") {
+		return "", ErrInvalidImageURL
+	}
+
+	path, err := resolveInDir(dir, u.Path)
+	if err != nil {
+		return "", ErrInvalidImageURL
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", ErrInvalidImageURL
+	}
+	defer file.Close()
+
+	// Read one byte past the limit to detect oversized files without loading
+	// them entirely
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return "", ErrInvalidImageURL
+	}
+
+	mimeType := http.DetectContentType(data)
+	if err := validateImage(data, mimeType, maxSize); err != nil {
+		return "", err
+	}
+
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// resolveInDir returns path with symlinks resolved, or an error when it does
+// not lie inside dir.
+func resolveInDir(dir string, path string) (string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", err
+	}
+
+	path, err = filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", errors.New("outside of the image directory")
+	}
+	return path, nil
+}
+
+// validateImage checks the size of data and that its content matches the
+// declared MIME type.
+func validateImage(data []byte, mimeType string, maxSize int64) error {
+	if int64(len(data)) > maxSize {
+		return fmt.Errorf("image exceeds %d bytes", maxSize)
+	}
+
+	detected := http.DetectContentType(data)
+	if !image_mime_types[detected] {
+		return fmt.Errorf("unsupported image type %q", detected)
+	}
+	if detected != mimeType {
+		return fmt.Errorf("image content is %q but was declared as %q", detected, mimeType)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A 1x1 transparent PNG
+const testPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+func imageMessage(url string) []Message {
+	return []Message{
+		{
+			Role: "user",
+			MultiContent: []ContentPart{
+				{Type: "text", Text: "What is this?"},
+				{Type: "image_url", ImageURL: &ImageURL{URL: url}},
+			},
+		},
+	}
+}
+
+func TestResolveImagesDataURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		maxSize int64
+		wantErr string
+	}{
+		{"valid png", "data:image/png;base64," + testPNG, DefaultMaxImageSize, ""},
+		{"uppercase mime", "data:IMAGE/PNG;base64," + testPNG, DefaultMaxImageSize, ""},
+		{"unsupported mime", "data:image/svg+xml;base64," + testPNG, DefaultMaxImageSize, "unsupported image type"},
+		{"mismatched mime", "data:image/jpeg;base64," + testPNG, DefaultMaxImageSize, "declared as"},
+		{"not an image", "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("hello world")), DefaultMaxImageSize, "unsupported image type"},
+		{"not base64 encoded", "data:image/png," + testPNG, DefaultMaxImageSize, "base64"},
+		{"invalid base64", "data:image/png;base64,!!!!", DefaultMaxImageSize, "invalid base64"},
+		{"malformed", "data:image/png;base64", DefaultMaxImageSize, "malformed"},
+		{"too large", "data:image/png;base64," + testPNG, 10, "exceeds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := imageMessage(tt.url)
+			err := ResolveImages(messages, tt.maxSize)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if messages[0].MultiContent[1].ImageURL.URL != tt.url {
+					t.Errorf("Expected data URL to be unchanged, got %s", messages[0].MultiContent[1].ImageURL.URL)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if !strings.HasPrefix(err.Error(), "messages[0].content[1]") {
+				t.Errorf("Expected error to name the offending part, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveImagesFileURL(t *testing.T) {
+	dir := t.TempDir()
+
+	png, _ := base64.StdEncoding.DecodeString(testPNG)
+	imagePath := filepath.Join(dir, "pixel.png")
+	if err := os.WriteFile(imagePath, png, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	textPath := filepath.Join(dir, "notes.png")
+	if err := os.WriteFile(textPath, []byte("not an image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local images inside the image directory are inlined as data URLs
+	messages := imageMessage("file://" + imagePath)
+	if err := ResolveImagesFrom(messages, DefaultMaxImageSize, dir); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := messages[0].MultiContent[1].ImageURL.URL; got != "data:image/png;base64,"+testPNG {
+		t.Errorf("Expected file to be inlined as a data URL, got %s", got)
+	}
+
+	if err := ResolveImagesFrom(imageMessage("file://"+textPath), DefaultMaxImageSize, dir); err == nil {
+		t.Error("Expected an error for a file that is not an image")
+	}
+	if err := ResolveImagesFrom(imageMessage("file://"+imagePath), 10, dir); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected a size error, got %v", err)
+	}
+
+	// A symlink out of the image directory does not escape it
+	outside := t.TempDir()
+	secretPath := filepath.Join(outside, "secret.png")
+	if err := os.WriteFile(secretPath, png, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	linkPath := filepath.Join(dir, "link.png")
+	if err := os.Symlink(secretPath, linkPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tt := range map[string]struct {
+		url string
+		dir string
+	}{
+		"no image directory": {url: "file://" + imagePath},
+		"missing":            {url: "file://" + filepath.Join(dir, "missing.png"), dir: dir},
+		"remote host":        {url: "file://example.com" + imagePath, dir: dir},
+		"outside":            {url: "file://" + secretPath, dir: dir},
+		"dot dot":            {url: "file://" + dir + "/../" + filepath.Base(outside) + "/secret.png", dir: dir},
+		"symlink":            {url: "file://" + linkPath, dir: dir},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := ResolveImagesFrom(imageMessage(tt.url), DefaultMaxImageSize, tt.dir)
+			if !errors.Is(err, ErrInvalidImageURL) {
+				t.Fatalf("Expected ErrInvalidImageURL for %s, got %v", tt.url, err)
+			}
+			if strings.Contains(err.Error(), dir) || strings.Contains(err.Error(), outside) {
+				t.Errorf("Expected the error not to name the path, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveImagesLeavesRemoteURLs(t *testing.T) {
+	messages := imageMessage("https://example.com/cat.png")
+	if err := ResolveImages(messages, DefaultMaxImageSize); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := messages[0].MultiContent[1].ImageURL.URL; got != "https://example.com/cat.png" {
+		t.Errorf("Expected remote URL to be unchanged, got %s", got)
+	}
+
+	if err := ResolveImages(imageMessage("ftp://example.com/cat.png"), DefaultMaxImageSize); err == nil {
+		t.Error("Expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+func ListModels(token string) ([]Model, error) {
+	return defaultClient().ListModels(token)
+}
+
+func ListModelsContext(ctx context.Context, token string) ([]Model, error) {
+	return defaultClient().ListModelsContext(ctx, token)
+}
+
+func (c *Client) ListModels(token string) ([]Model, error) {
+	return c.ListModelsContext(context.Background(), token)
+}
+
+// ListModelsContext returns the models available to the Copilot session
+// token.
+func (c *Client) ListModelsContext(ctx context.Context, token string) ([]Model, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.modelsEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("authorization", "Bearer "+token)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var modelsResponse ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modelsResponse); err != nil {
+		c.logger.Error().Msgf("Error decoding response: %s", err)
+		return nil, err
+	}
+
+	return modelsResponse.Data, nil
+}
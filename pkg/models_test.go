@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testModelCatalog = `{
+	"object": "list",
+	"data": [
+		{
+			"id": "gpt-4o",
+			"name": "GPT-4o",
+			"object": "model",
+			"vendor": "Azure OpenAI",
+			"version": "gpt-4o-2024-11-20",
+			"preview": false,
+			"model_picker_enabled": true,
+			"capabilities": {
+				"family": "gpt-4o",
+				"type": "chat",
+				"tokenizer": "o200k_base",
+				"limits": {"max_context_window_tokens": 128000, "max_output_tokens": 16384, "max_prompt_tokens": 64000},
+				"supports": {"streaming": true, "tool_calls": true, "parallel_tool_calls": true, "vision": true}
+			}
+		},
+		{
+			"id": "text-embedding-3-small",
+			"name": "Embedding V3 small",
+			"object": "model",
+			"vendor": "Azure OpenAI",
+			"version": "text-embedding-3-small",
+			"capabilities": {"family": "text-embedding-3-small", "type": "embeddings", "tokenizer": "cl100k_base", "limits": {"max_inputs": 512}, "supports": {}}
+		}
+	]
+}`
+
+func TestListModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/models" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("authorization") != "Bearer session-token" {
+			t.Errorf("Expected bearer authorization, got %q", r.Header.Get("authorization"))
+		}
+		if r.Header.Get("editor-version") == "" {
+			t.Error("Expected editor-version header")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, testModelCatalog)
+	}))
+	defer server.Close()
+
+	models, err := NewClient(WithCopilotURL(server.URL)).ListModels("session-token")
+	if err != nil {
+		t.Fatalf("ListModels failed: %v", err)
+	}
+
+	if len(models) != 2 {
+		t.Fatalf("Expected 2 models, got %d", len(models))
+	}
+
+	model := models[0]
+	if model.ID != "gpt-4o" || model.Vendor != "Azure OpenAI" || model.Capabilities.Type != "chat" {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	if model.Capabilities.Limits.MaxContextWindowTokens != 128000 || model.Capabilities.Limits.MaxOutputTokens != 16384 {
+		t.Errorf("Unexpected limits: %+v", model.Capabilities.Limits)
+	}
+	supports := model.Capabilities.Supports
+	if supports.Vision == nil || !*supports.Vision || supports.ToolCalls == nil || !*supports.ToolCalls {
+		t.Errorf("Expected vision and tool call support, got %+v", supports)
+	}
+	if supports.StructuredOutputs != nil {
+		t.Errorf("Expected unreported structured outputs to be nil, got %v", *supports.StructuredOutputs)
+	}
+
+	if models[1].Capabilities.Supports != (ModelSupports{}) {
+		t.Errorf("Expected no reported features for the embedding model, got %+v", models[1].Capabilities.Supports)
+	}
+}
+
+func TestListModelsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"message":"unauthorized: token expired","code":"unauthorized"}}`)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(WithCopilotURL(server.URL)).ListModels("expired-token")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 APIError, got %v", err)
+	}
+}
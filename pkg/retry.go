@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how a Client retries requests that failed because the
+// upstream was rate limited, temporarily unavailable or dropped the
+// connection. Retries only happen before a response body is handed to the
+// caller, so no part of a streamed response is ever delivered twice.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. A Retry-After hint longer
+	// than MaxBackoff is not waited for and the error is returned instead.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after every attempt.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either
+	// direction, e.g. 0.2 for +/-20%.
+	Jitter float64
+	// FailFast lists status codes that are returned at once even though they
+	// would otherwise be retried, e.g. 429 when the caller fails over to
+	// another account instead.
+	FailFast []int
+}
+
+// DefaultRetryPolicy returns the policy used by the proxy: three attempts
+// with exponential backoff starting at half a second.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// WithRetryPolicy enables retries of transient upstream failures.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retryPolicy = policy
+	}
+}
+
+// Retries returns the number of retries the client has made so far.
+func (c *Client) Retries() int64 {
+	return c.retries.Load()
+}
+
+// backoff returns the delay before the given retry (1 for the first retry),
+// or false if the error should not be retried at all.
+func (p RetryPolicy) backoff(retry int, err error) (time.Duration, bool) {
+	if retry >= p.MaxAttempts {
+		return 0, false
+	}
+
+	var retryAfter time.Duration
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if !apiErr.Retryable() || p.failsFast(apiErr.StatusCode) {
+			return 0, false
+		}
+		retryAfter = apiErr.RetryAfter
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+
+	if p.MaxBackoff > 0 && retryAfter > p.MaxBackoff {
+		return 0, false
+	}
+
+	if d := p.delay(retry); d > retryAfter {
+		return d, true
+	}
+	return retryAfter, true
+}
+
+// failsFast reports whether status is listed in FailFast.
+func (p RetryPolicy) failsFast(status int) bool {
+	for _, s := range p.FailFast {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the jittered exponential delay before the given retry (1 for
+// the first retry), capped at MaxBackoff.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(math.Max(p.Multiplier, 1), float64(retry-1))
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1) //nolint:gosec // jitter does not need a secure source
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	return time.Duration(delay)
+}
+
+// sendWithRetry sends req, retrying transient failures according to the
+// client's retry policy. The request body is rewound before every retry.
+func (c *Client) sendWithRetry(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(req)
+		if err == nil {
+			return resp, nil
+		}
+
+		delay, ok := c.retryPolicy.backoff(attempt, err)
+		if !ok || (req.Body != nil && req.GetBody == nil) {
+			return nil, err
+		}
+
+		total := c.retries.Add(1)
+		c.logger.Warn().
+			Err(err).
+			Str("url", req.URL.String()).
+			Int("attempt", attempt).
+			Int("max_attempts", c.retryPolicy.MaxAttempts).
+			Dur("backoff", delay).
+			Int64("total_retries", total).
+			Msg("Retrying upstream request")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+	}
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	var attempts atomic.Int32
+	var bodies []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(CompletionResponse{
+				Choices: []Choice{{Message: &Message{Role: "assistant", Content: "Hi"}}},
+			})
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL), WithRetryPolicy(testRetryPolicy()))
+
+	err := c.Chat("session-token", []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, false, func(CompletionResponse) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+	if c.Retries() != 2 {
+		t.Errorf("Expected 2 retries to be counted, got %d", c.Retries())
+	}
+	for i, body := range bodies {
+		if body != bodies[0] {
+			t.Errorf("Attempt %d sent a different body: %s", i+1, body)
+		}
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubAPIURL(server.URL), WithRetryPolicy(testRetryPolicy()))
+
+	_, err := c.GetSessionToken("access-token")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 APIError, got %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestRetrySkipsPermanentErrors(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubAPIURL(server.URL), WithRetryPolicy(testRetryPolicy()))
+
+	if _, err := c.GetSessionToken("access-token"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected a single attempt for a 401, got %d", attempts.Load())
+	}
+	if c.Retries() != 0 {
+		t.Errorf("Expected no retries to be counted, got %d", c.Retries())
+	}
+}
+
+func TestRetryDroppedConnection(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack connection: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SessionResponse{Token: "session;exp=1"})
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubAPIURL(server.URL), WithRetryPolicy(testRetryPolicy()))
+
+	if _, err := c.GetSessionToken("access-token"); err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestRetryDisabledByDefault(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := NewClient(WithGitHubAPIURL(server.URL))
+
+	if _, err := c.GetSessionToken("access-token"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected a single attempt without a retry policy, got %d", attempts.Load())
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicy()
+	policy.InitialBackoff = time.Minute
+	policy.MaxBackoff = time.Minute
+	c := NewClient(WithGitHubAPIURL(server.URL), WithRetryPolicy(policy))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.GetSessionTokenContext(ctx, "access-token")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Backoff did not stop when the context was done")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	unavailable := &APIError{StatusCode: http.StatusServiceUnavailable}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+	for i, want := range expected {
+		got, ok := policy.backoff(i+1, unavailable)
+		if !ok || got != want {
+			t.Errorf("Retry %d: expected %s, got %s (retry %t)", i+1, want, got, ok)
+		}
+	}
+
+	if _, ok := policy.backoff(5, unavailable); ok {
+		t.Error("Expected no retry once MaxAttempts is reached")
+	}
+
+	rateLimited := &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 700 * time.Millisecond}
+	if got, ok := policy.backoff(1, rateLimited); !ok || got != 700*time.Millisecond {
+		t.Errorf("Expected Retry-After of 700ms to be honored, got %s (retry %t)", got, ok)
+	}
+
+	tooLong := &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	if _, ok := policy.backoff(1, tooLong); ok {
+		t.Error("Expected no retry when Retry-After exceeds MaxBackoff")
+	}
+
+	failFast := policy
+	failFast.FailFast = []int{http.StatusTooManyRequests}
+	if _, ok := failFast.backoff(1, rateLimited); ok {
+		t.Error("Expected no retry of a status listed in FailFast")
+	}
+	if _, ok := failFast.backoff(1, unavailable); !ok {
+		t.Error("Expected statuses not listed in FailFast to be retried")
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got, _ := policy.backoff(1, unavailable)
+		if got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("Jittered backoff %s out of range", got)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// default_refresh_ahead is how long before its expiry a session token is
+	// refreshed.
+	default_refresh_ahead = 5 * time.Minute
+	// default_session_lifetime is assumed for session tokens that carry no
+	// expiry.
+	default_session_lifetime = 25 * time.Minute
+	// session_refresh_timeout bounds a single session token request.
+	session_refresh_timeout = 30 * time.Second
+)
+
+// TokenManager keeps the Copilot session token of an access token fresh. It
+// refreshes the token ahead of its expiry, retries failed refreshes with
+// backoff and refreshes on demand once the upstream has rejected the token.
+// It is safe for concurrent use.
+type TokenManager struct {
+	client       *Client
+	accessToken  string
+	refreshAhead time.Duration
+	backoff      RetryPolicy
+
+	mu        sync.Mutex
+	session   SessionResponse
+	expiresAt time.Time
+	refreshAt time.Time
+	inflight  *sessionRefresh
+	// refreshed is signalled after every successful refresh so that the
+	// background loop reschedules.
+	refreshed chan struct{}
+}
+
+// TokenManagerOption configures a TokenManager.
+type TokenManagerOption func(*TokenManager)
+
+// sessionRefresh is a session token request shared by every caller that
+// needs a new token while it is in flight.
+type sessionRefresh struct {
+	done    chan struct{}
+	session SessionResponse
+	err     error
+}
+
+// NewTokenManager returns a TokenManager that exchanges accessToken for
+// session tokens with client. No request is made until a token is needed or
+// the manager is started.
+func NewTokenManager(client *Client, accessToken string, options ...TokenManagerOption) *TokenManager {
+	m := &TokenManager{
+		client:       client,
+		accessToken:  accessToken,
+		refreshAhead: default_refresh_ahead,
+		backoff: RetryPolicy{
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+			Multiplier:     2,
+			Jitter:         0.2,
+		},
+		refreshed: make(chan struct{}, 1),
+	}
+
+	for _, option := range options {
+		option(m)
+	}
+
+	if m.session.Token != "" {
+		m.setSession(m.session, time.Now())
+	}
+
+	return m
+}
+
+// WithRefreshAhead sets how long before its expiry the session token is
+// refreshed (five minutes by default). Tokens that live shorter than twice
+// this are refreshed halfway through their lifetime.
+func WithRefreshAhead(d time.Duration) TokenManagerOption {
+	return func(m *TokenManager) {
+		m.refreshAhead = d
+	}
+}
+
+// WithRefreshBackoff sets the delays between failed background refreshes.
+// MaxAttempts is ignored: the manager keeps trying until it is stopped.
+func WithRefreshBackoff(policy RetryPolicy) TokenManagerOption {
+	return func(m *TokenManager) {
+		m.backoff = policy
+	}
+}
+
+// WithSession seeds the manager with a session token obtained earlier, which
+// is used until it is due for a refresh.
+func WithSession(session SessionResponse) TokenManagerOption {
+	return func(m *TokenManager) {
+		m.session = session
+	}
+}
+
+// Start fetches a session token unless the manager already holds a valid one
+// and keeps refreshing it in the background until ctx is cancelled.
+func (m *TokenManager) Start(ctx context.Context) error {
+	if _, err := m.Token(ctx); err != nil {
+		return err
+	}
+
+	go m.run(ctx)
+	return nil
+}
+
+// Token returns the current session token, fetching a new one when there is
+// none or it has expired.
+func (m *TokenManager) Token(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	if m.session.Token != "" && time.Now().Before(m.expiresAt) {
+		token := m.session.Token
+		m.mu.Unlock()
+		return token, nil
+	}
+	m.mu.Unlock()
+
+	session, err := m.refresh(ctx)
+	return session.Token, err
+}
+
+// Session returns the current session, which is empty before the first
+// successful refresh.
+func (m *TokenManager) Session() SessionResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.session
+}
+
+// Invalidate discards token after the upstream rejected it, so that the next
+// call to Token fetches a new one. Tokens other than the current one are
+// ignored, which lets concurrent requests that were rejected with the same
+// token cause a single refresh.
+func (m *TokenManager) Invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if token != "" && token == m.session.Token {
+		m.session = SessionResponse{}
+	}
+}
+
+// run refreshes the session token whenever it is due, backing off after
+// failures, until ctx is cancelled.
+func (m *TokenManager) run(ctx context.Context) {
+	failures := 0
+	for {
+		var wait time.Duration
+		if failures > 0 {
+			wait = m.backoff.delay(failures)
+		} else {
+			m.mu.Lock()
+			wait = time.Until(m.refreshAt)
+			m.mu.Unlock()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-m.refreshed:
+			// Refreshed on demand, so the schedule has moved
+			timer.Stop()
+			failures = 0
+			continue
+		case <-timer.C:
+		}
+
+		if _, err := m.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			failures++
+			m.client.logger.Error().
+				Err(err).
+				Int("failures", failures).
+				Dur("backoff", m.backoff.delay(failures)).
+				Msg("Failed to refresh session token")
+			continue
+		}
+
+		// Drain the signal of the refresh that just happened
+		select {
+		case <-m.refreshed:
+		default:
+		}
+		failures = 0
+	}
+}
+
+// refresh fetches a new session token, or waits for the refresh already in
+// flight. The request itself is not bound to ctx, so that a caller giving up
+// does not fail the refresh for everyone else.
+func (m *TokenManager) refresh(ctx context.Context) (SessionResponse, error) {
+	m.mu.Lock()
+	call := m.inflight
+	if call == nil {
+		call = &sessionRefresh{done: make(chan struct{})}
+		m.inflight = call
+		go m.fetch(call)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.session, call.err
+	case <-ctx.Done():
+		return SessionResponse{}, ctx.Err()
+	}
+}
+
+func (m *TokenManager) fetch(call *sessionRefresh) {
+	ctx, cancel := context.WithTimeout(context.Background(), session_refresh_timeout)
+	defer cancel()
+
+	session, err := m.client.GetSessionTokenContext(ctx, m.accessToken)
+	if err == nil && session.Token == "" {
+		err = errors.New("no session token in response")
+	}
+
+	m.mu.Lock()
+	if err == nil {
+		m.setSession(session, time.Now())
+	}
+	m.inflight = nil
+	m.mu.Unlock()
+
+	if err == nil {
+		m.client.logger.Info().
+			Time("expires_at", time.Unix(session.ExpiresAt, 0)).
+			Msg("Refreshed session token")
+
+		select {
+		case m.refreshed <- struct{}{}:
+		default:
+		}
+	}
+
+	call.session, call.err = session, err
+	close(call.done)
+}
+
+// setSession stores session and schedules its refresh. The caller must hold
+// m.mu unless the manager is still being constructed.
+func (m *TokenManager) setSession(session SessionResponse, now time.Time) {
+	m.session = session
+
+	m.expiresAt = now.Add(default_session_lifetime)
+	if session.ExpiresAt > 0 {
+		m.expiresAt = time.Unix(session.ExpiresAt, 0)
+	}
+
+	ahead := m.refreshAhead
+	if lifetime := m.expiresAt.Sub(now); ahead > lifetime/2 {
+		ahead = max(lifetime/2, 0)
+	}
+	m.refreshAt = m.expiresAt.Add(-ahead)
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSessionServer hands out the session tokens session-1, session-2, ...
+// that expire after lifetime. Requests for which fail returns true are
+// answered with a 500 instead.
+func newSessionServer(t *testing.T, lifetime time.Duration, fail func(request int64) bool) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "token access-token" {
+			t.Errorf("Expected the access token, got %q", r.Header.Get("authorization"))
+		}
+
+		n := requests.Add(1)
+		if fail != nil && fail(n) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SessionResponse{
+			Token: fmt.Sprintf("session-%d;exp=%d", n, time.Now().Add(lifetime).Unix()),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+// waitFor polls condition until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenManagerCachesToken(t *testing.T) {
+	server, requests := newSessionServer(t, time.Hour, nil)
+	m := NewTokenManager(NewClient(WithGitHubAPIURL(server.URL)), "access-token")
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := m.Token(context.Background())
+			if err != nil {
+				t.Errorf("Token failed: %v", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	if requests.Load() != 1 {
+		t.Errorf("Expected concurrent callers to share 1 request, got %d", requests.Load())
+	}
+	for i, token := range tokens {
+		if token != tokens[0] || token == "" {
+			t.Errorf("Token %d: expected %q, got %q", i, tokens[0], token)
+		}
+	}
+	if m.Session().ExpiresAt == 0 {
+		t.Error("Expected the session to carry its expiry")
+	}
+}
+
+func TestTokenManagerInvalidate(t *testing.T) {
+	server, requests := newSessionServer(t, time.Hour, nil)
+	m := NewTokenManager(NewClient(WithGitHubAPIURL(server.URL)), "access-token")
+
+	first, err := m.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+
+	// A stale token does not cause a refresh
+	m.Invalidate("session-0")
+	if token, _ := m.Token(context.Background()); token != first {
+		t.Errorf("Expected %q after invalidating another token, got %q", first, token)
+	}
+
+	m.Invalidate(first)
+	second, err := m.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if second == first {
+		t.Errorf("Expected a new token after invalidating %q", first)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests.Load())
+	}
+}
+
+func TestTokenManagerRefreshesAheadOfExpiry(t *testing.T) {
+	// Tokens live two seconds, so they are refreshed after about one
+	server, requests := newSessionServer(t, 2*time.Second, nil)
+	m := NewTokenManager(NewClient(WithGitHubAPIURL(server.URL)), "access-token", WithRefreshAhead(time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return strings.HasPrefix(m.Session().Token, "session-2") })
+
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests.Load())
+	}
+}
+
+func TestTokenManagerBacksOffAfterFailures(t *testing.T) {
+	// The first background refresh and the one after it fail
+	server, requests := newSessionServer(t, 2*time.Second, func(n int64) bool { return n == 2 || n == 3 })
+	m := NewTokenManager(
+		NewClient(WithGitHubAPIURL(server.URL)),
+		"access-token",
+		WithRefreshBackoff(RetryPolicy{InitialBackoff: 10 * time.Millisecond, Multiplier: 2}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	waitFor(t, 5*time.Second, func() bool { return requests.Load() >= 4 })
+
+	waitFor(t, time.Second, func() bool { return strings.HasPrefix(m.Session().Token, "session-4") })
+}
+
+func TestTokenManagerSeededSession(t *testing.T) {
+	server, requests := newSessionServer(t, time.Hour, nil)
+	m := NewTokenManager(
+		NewClient(WithGitHubAPIURL(server.URL)),
+		"access-token",
+		WithSession(SessionResponse{Token: "seeded", ExpiresAt: time.Now().Add(time.Hour).Unix()}),
+	)
+
+	if token, err := m.Token(context.Background()); err != nil || token != "seeded" {
+		t.Errorf("Expected the seeded token, got %q, %v", token, err)
+	}
+	if requests.Load() != 0 {
+		t.Errorf("Expected no requests, got %d", requests.Load())
+	}
+}
+
+func TestTokenManagerStartFails(t *testing.T) {
+	server, _ := newSessionServer(t, time.Hour, func(int64) bool { return true })
+	m := NewTokenManager(NewClient(WithGitHubAPIURL(server.URL)), "access-token")
+
+	err := m.Start(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected a 500 APIError, got %v", err)
+	}
+}
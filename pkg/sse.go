@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// sseEvent is a single dispatched Server-Sent Event.
+type sseEvent struct {
+	// Event is the event type, "message" unless an event field was sent.
+	Event string
+	// Data is the concatenation of all data fields, joined by newlines.
+	Data string
+	// ID is the last event ID seen on the stream so far.
+	ID string
+	// Retry is the reconnection time in milliseconds, or -1 if the event did
+	// not set one.
+	Retry int
+}
+
+// sseReader decodes a text/event-stream body as specified by the WHATWG
+// HTML standard. Lines may end in CRLF, LF or CR and have no length limit.
+type sseReader struct {
+	r      *bufio.Reader
+	line   []byte
+	skipLF bool
+	bom    bool
+
+	lastID string
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next complete event. It returns io.EOF once the stream
+// ends; an event that is not terminated by a blank line before the end of
+// the stream is discarded.
+func (d *sseReader) Next() (sseEvent, error) {
+	var (
+		eventType string
+		data      bytes.Buffer
+		hasData   bool
+		retry     = -1
+	)
+
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return sseEvent{}, err
+		}
+
+		// A blank line dispatches the event
+		if len(line) == 0 {
+			if !hasData {
+				eventType = ""
+				retry = -1
+				continue
+			}
+
+			if eventType == "" {
+				eventType = "message"
+			}
+
+			return sseEvent{
+				Event: eventType,
+				Data:  string(bytes.TrimSuffix(data.Bytes(), []byte("\n"))),
+				ID:    d.lastID,
+				Retry: retry,
+			}, nil
+		}
+
+		// Lines starting with a colon are comments, e.g. keep-alives
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, []byte(nil)
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], line[i+1:]
+			value = bytes.TrimPrefix(value, []byte(" "))
+		}
+
+		switch string(field) {
+		case "event":
+			eventType = string(value)
+		case "data":
+			data.Write(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if bytes.IndexByte(value, 0) < 0 {
+				d.lastID = string(value)
+			}
+		case "retry":
+			if !isDigits(value) {
+				continue
+			}
+			if n, err := strconv.Atoi(string(value)); err == nil {
+				retry = n
+			}
+		}
+	}
+}
+
+// readLine returns the next line without its terminator. The returned slice
+// is only valid until the next call.
+func (d *sseReader) readLine() ([]byte, error) {
+	d.line = d.line[:0]
+
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if d.skipLF {
+			d.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+
+		switch b {
+		case '\n':
+			return d.stripBOM(d.line), nil
+		case '\r':
+			// A CR may be followed by an LF belonging to the same line ending;
+			// skip it lazily so that a CR-terminated line is not held back
+			// waiting for the next byte.
+			d.skipLF = true
+			return d.stripBOM(d.line), nil
+		}
+
+		d.line = append(d.line, b)
+	}
+}
+
+// stripBOM removes a UTF-8 byte order mark from the very first line.
+func (d *sseReader) stripBOM(line []byte) []byte {
+	if d.bom {
+		return line
+	}
+
+	d.bom = true
+	return bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func readAllEvents(t *testing.T, r io.Reader) []sseEvent {
+	t.Helper()
+
+	d := newSSEReader(r)
+	var events []sseEvent
+	for {
+		event, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestSSEReaderFields(t *testing.T) {
+	input := ": keep-alive comment\n" +
+		"event: delta\n" +
+		"id: 42\n" +
+		"retry: 1500\n" +
+		"data: first line\n" +
+		"data:second line\n" +
+		"data\n" +
+		"\n" +
+		"data: plain\n" +
+		"\n"
+
+	events := readAllEvents(t, strings.NewReader(input))
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %+v", len(events), events)
+	}
+
+	first := events[0]
+	if first.Event != "delta" {
+		t.Errorf("Expected event type delta, got %q", first.Event)
+	}
+	if first.ID != "42" {
+		t.Errorf("Expected id 42, got %q", first.ID)
+	}
+	if first.Retry != 1500 {
+		t.Errorf("Expected retry 1500, got %d", first.Retry)
+	}
+	if first.Data != "first line\nsecond line\n" {
+		t.Errorf("Expected multi-line data, got %q", first.Data)
+	}
+
+	second := events[1]
+	if second.Event != "message" {
+		t.Errorf("Expected default event type message, got %q", second.Event)
+	}
+	if second.ID != "42" {
+		t.Errorf("Expected the last event id to carry over, got %q", second.ID)
+	}
+	if second.Retry != -1 {
+		t.Errorf("Expected no retry, got %d", second.Retry)
+	}
+	if second.Data != "plain" {
+		t.Errorf("Expected data plain, got %q", second.Data)
+	}
+}
+
+func TestSSEReaderLineEndings(t *testing.T) {
+	inputs := map[string]string{
+		"LF":   "data: a\ndata: b\n\ndata: c\n\n",
+		"CRLF": "data: a\r\ndata: b\r\n\r\ndata: c\r\n\r\n",
+		"CR":   "data: a\rdata: b\r\rdata: c\r\r",
+		"BOM":  "\xef\xbb\xbfdata: a\ndata: b\n\ndata: c\n\n",
+	}
+
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			events := readAllEvents(t, strings.NewReader(input))
+			if len(events) != 2 {
+				t.Fatalf("Expected 2 events, got %d: %+v", len(events), events)
+			}
+			if events[0].Data != "a\nb" {
+				t.Errorf("Expected first data a\\nb, got %q", events[0].Data)
+			}
+			if events[1].Data != "c" {
+				t.Errorf("Expected second data c, got %q", events[1].Data)
+			}
+		})
+	}
+}
+
+func TestSSEReaderSplitFrames(t *testing.T) {
+	input := "event: chunk\r\ndata: {\"a\":1}\r\n\r\ndata: {\"b\":2}\n\n"
+
+	// Deliver the stream one byte at a time so every frame is split
+	events := readAllEvents(t, iotest.OneByteReader(strings.NewReader(input)))
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %+v", len(events), events)
+	}
+	if events[0].Event != "chunk" || events[0].Data != `{"a":1}` {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if events[1].Event != "message" || events[1].Data != `{"b":2}` {
+		t.Errorf("Unexpected second event: %+v", events[1])
+	}
+}
+
+func TestSSEReaderOversizedEvent(t *testing.T) {
+	large := strings.Repeat("x", 1<<20)
+	input := "data: " + large + "\n\n"
+
+	events := readAllEvents(t, strings.NewReader(input))
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	if events[0].Data != large {
+		t.Errorf("Expected %d bytes of data, got %d", len(large), len(events[0].Data))
+	}
+}
+
+func TestSSEReaderMalformedFrames(t *testing.T) {
+	input := "retry: soon\n" +
+		"retry: +5\n" +
+		"unknown: field\n" +
+		"id: with\x00null\n" +
+		"data: ok\n" +
+		"\n" +
+		"event: ignored\n" +
+		"\n" +
+		"data: truncated"
+
+	events := readAllEvents(t, strings.NewReader(input))
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d: %+v", len(events), events)
+	}
+	if events[0].Data != "ok" {
+		t.Errorf("Expected data ok, got %q", events[0].Data)
+	}
+	if events[0].Retry != -1 {
+		t.Errorf("Expected invalid retry values to be ignored, got %d", events[0].Retry)
+	}
+	if events[0].ID != "" {
+		t.Errorf("Expected an id containing NULL to be ignored, got %q", events[0].ID)
+	}
+}
+
+func TestChatStreamLargeChunk(t *testing.T) {
+	large := strings.Repeat("y", 256*1024)
+	server := newStreamServer(t, chunkJSON(large), "[DONE]")
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Stream: true})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	if !stream.Next() {
+		t.Fatalf("Expected a chunk, got none (err: %v)", stream.Err())
+	}
+	if got := stream.Current().Choices[0].Delta.Content; got != large {
+		t.Errorf("Expected %d bytes of content, got %d", len(large), len(got))
+	}
+}
+
+func TestChatStreamErrorEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", chunkJSON("partial"))
+		fmt.Fprint(w, "event: error\ndata: {\"error\":{\"message\":\"upstream overloaded\",\"type\":\"server_error\",\"code\":\"overloaded\"}}\n\n")
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Stream: true})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	chunks := 0
+	for stream.Next() {
+		chunks++
+	}
+
+	if chunks != 1 {
+		t.Errorf("Expected 1 chunk before the error, got %d", chunks)
+	}
+
+	var apiErr *APIError
+	if !errors.As(stream.Err(), &apiErr) {
+		t.Fatalf("Expected an *APIError, got %v", stream.Err())
+	}
+	if apiErr.Code != "overloaded" || apiErr.Message != "upstream overloaded" {
+		t.Errorf("Unexpected error details: %+v", apiErr)
+	}
+}
@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// ChatStream reads the responses of a chat completion one at a time:
+//
+//	stream, err := client.StreamChat(ctx, token, request)
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//
+//	for stream.Next() {
+//		chunk := stream.Current()
+//		// ...
+//	}
+//	return stream.Err()
+//
+// For a streaming request every call to Next yields one chunk. For a
+// non-streaming request Next yields the complete response once.
+type ChatStream struct {
+	eventStream
+	streaming bool
+
+	current CompletionResponse
+	usage   Usage
+}
+
+// eventStream holds the state shared by the streams read from an upstream
+// response.
+type eventStream struct {
+	ctx    context.Context
+	body   io.ReadCloser
+	events *sseReader
+	logger zerolog.Logger
+
+	err  error
+	done bool
+
+	closed    atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func StreamChat(ctx context.Context, token string, request CompletionRequest) (*ChatStream, error) {
+	return defaultClient().StreamChat(ctx, token, request)
+}
+
+// StreamChat sends a chat completion request and returns a ChatStream over
+// its responses. Upstream failures are reported here, before any response is
+// read; the caller must Close the returned stream.
+func (c *Client) StreamChat(ctx context.Context, token string, request CompletionRequest) (*ChatStream, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, c.completionEndpoint, request)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("authorization", "Bearer "+token)
+
+	// Copilot rejects image parts unless the request is flagged as a vision
+	// request
+	if HasImages(request.Messages) {
+		req.Header.Set("Copilot-Vision-Request", "true")
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ChatStream{
+		eventStream: eventStream{
+			ctx:    ctx,
+			body:   resp.Body,
+			logger: c.logger,
+		},
+		streaming: request.Stream,
+	}
+
+	if s.streaming {
+		s.events = newSSEReader(resp.Body)
+	}
+
+	return s, nil
+}
+
+// Next advances to the next response, which is then available through
+// Current. It returns false when the stream is exhausted, an error occurred
+// or the stream was closed; check Err to tell these apart.
+func (s *ChatStream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	if !s.streaming {
+		s.done = true
+		if err := json.NewDecoder(s.body).Decode(&s.current); err != nil {
+			s.fail(err)
+			return false
+		}
+		s.usage = s.current.Usage
+		return true
+	}
+
+	for {
+		data, ok := s.nextData()
+		if !ok {
+			return false
+		}
+
+		var chunk CompletionResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			s.fail(err)
+			return false
+		}
+
+		// Usage may arrive on a chunk of its own, without any choices
+		if chunk.Usage != (Usage{}) {
+			s.usage = chunk.Usage
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		s.current = chunk
+		return true
+	}
+}
+
+// Current returns the response read by the last successful call to Next.
+func (s *ChatStream) Current() CompletionResponse {
+	return s.current
+}
+
+// Usage returns the token usage reported by the upstream so far. It is zero
+// until a response carrying usage has been read; streamed responses usually
+// report it on the last chunk.
+func (s *ChatStream) Usage() Usage {
+	return s.usage
+}
+
+// nextData returns the data of the next event. It returns false when the
+// stream ended with [DONE], failed or was closed. Errors raised mid-stream
+// arrive as an error event or as data carrying an error object; they fail
+// the stream.
+func (s *eventStream) nextData() ([]byte, bool) {
+	event, err := s.events.Next()
+	if err != nil {
+		s.done = true
+		if errors.Is(err, io.EOF) {
+			// The upstream closed the stream without sending [DONE]
+			s.err = s.ctx.Err()
+			return nil, false
+		}
+		s.fail(err)
+		return nil, false
+	}
+
+	data := []byte(event.Data)
+
+	if bytes.Equal(bytes.TrimSpace(data), []byte("[DONE]")) {
+		s.done = true
+		return nil, false
+	}
+
+	var errorChunk struct {
+		Error json.RawMessage `json:"error"`
+	}
+	err = json.Unmarshal(data, &errorChunk)
+	if event.Event == "error" || (err == nil && len(errorChunk.Error) > 0 && !bytes.Equal(errorChunk.Error, []byte("null"))) {
+		apiErr := &APIError{StatusCode: http.StatusOK}
+		apiErr.parseBody(data)
+		s.fail(apiErr)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// Err returns the error that stopped the stream, if any. It is nil when the
+// stream ended normally or was closed by the caller.
+func (s *eventStream) Err() error {
+	return s.err
+}
+
+// Close releases the upstream connection. Closing a stream before it is
+// exhausted aborts the upstream request. It is safe to call Close more than
+// once.
+func (s *eventStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.closed.Store(true)
+		s.closeErr = s.body.Close()
+	})
+	return s.closeErr
+}
+
+func (s *eventStream) fail(err error) {
+	s.done = true
+
+	// Reads fail once the context is done; report why rather than how.
+	if ctxErr := s.ctx.Err(); ctxErr != nil {
+		s.err = ctxErr
+		return
+	}
+
+	// Reads fail once the caller has closed the stream; that is not an error.
+	if s.closed.Load() {
+		return
+	}
+
+	s.logger.Error().Msgf("Error reading stream: %s", err)
+	s.err = err
+}
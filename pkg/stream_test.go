@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newStreamServer(t *testing.T, events ...string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func chunkJSON(content string) string {
+	data, _ := json.Marshal(CompletionResponse{
+		Choices: []Choice{{Delta: &Message{Role: "assistant", Content: content}}},
+	})
+	return string(data)
+}
+
+func TestChatStreamNext(t *testing.T) {
+	server := newStreamServer(t,
+		`{"choices":[],"prompt_filter_results":[]}`,
+		chunkJSON("Hello"),
+		chunkJSON(", "),
+		chunkJSON("world"),
+		"[DONE]",
+	)
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Model: "test-model", Stream: true})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	var content string
+	for stream.Next() {
+		content += stream.Current().Choices[0].Delta.Content
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+	if content != "Hello, world" {
+		t.Errorf("Expected content 'Hello, world', got %q", content)
+	}
+	if stream.Next() {
+		t.Error("Next should keep returning false once the stream is exhausted")
+	}
+}
+
+func TestChatStreamNonStreaming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			t.Error("Expected a non-streaming request")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CompletionResponse{
+			ID:      "chatcmpl-test",
+			Choices: []Choice{{Message: &Message{Role: "assistant", Content: "Hi"}}},
+		})
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Model: "test-model"})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	if !stream.Next() {
+		t.Fatalf("Expected one response, got none (err: %v)", stream.Err())
+	}
+	if stream.Current().ID != "chatcmpl-test" {
+		t.Errorf("Expected ID chatcmpl-test, got %s", stream.Current().ID)
+	}
+	if stream.Next() {
+		t.Error("Expected exactly one response for a non-streaming request")
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Unexpected stream error: %v", err)
+	}
+}
+
+func TestStreamChatVisionHeader(t *testing.T) {
+	var visionHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visionHeaders = append(visionHeaders, r.Header.Get("Copilot-Vision-Request"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"A cat"}}]}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	requests := []CompletionRequest{
+		{Messages: []Message{{Role: "user", Content: "Hello"}}},
+		{Messages: imageMessage("https://example.com/cat.png")},
+	}
+	for _, request := range requests {
+		stream, err := c.StreamChat(context.Background(), "session-token", request)
+		if err != nil {
+			t.Fatalf("StreamChat failed: %v", err)
+		}
+		stream.Close()
+	}
+
+	if len(visionHeaders) != 2 || visionHeaders[0] != "" || visionHeaders[1] != "true" {
+		t.Errorf("Expected the vision header only on the image request, got %q", visionHeaders)
+	}
+}
+
+func TestChatStreamUsage(t *testing.T) {
+	server := newStreamServer(t,
+		chunkJSON("Hello"),
+		`{"choices":[],"usage":{"prompt_tokens":5,"completion_tokens":1,"total_tokens":6}}`,
+		"[DONE]",
+	)
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{
+		Stream:        true,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	chunks := 0
+	for stream.Next() {
+		chunks++
+		if stream.Usage() != (Usage{}) {
+			t.Error("Expected no usage before the usage chunk")
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+
+	// The usage-only chunk is not yielded, but its usage is recorded
+	if chunks != 1 {
+		t.Errorf("Expected 1 chunk, got %d", chunks)
+	}
+	if want := (Usage{PromptTokens: 5, CompletionTokens: 1, TotalTokens: 6}); stream.Usage() != want {
+		t.Errorf("Expected usage %+v, got %+v", want, stream.Usage())
+	}
+}
+
+func TestChatStreamMalformedChunk(t *testing.T) {
+	server := newStreamServer(t, chunkJSON("Hello"), `{"choices": [`)
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Stream: true})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+	defer stream.Close()
+
+	chunks := 0
+	for stream.Next() {
+		chunks++
+	}
+
+	if chunks != 1 {
+		t.Errorf("Expected 1 chunk before the malformed one, got %d", chunks)
+	}
+	var syntaxErr *json.SyntaxError
+	if !errors.As(stream.Err(), &syntaxErr) {
+		t.Errorf("Expected a JSON syntax error, got %v", stream.Err())
+	}
+}
+
+func TestChatStreamCloseStopsEarly(t *testing.T) {
+	upstreamDone := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", chunkJSON("tick")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	stream, err := c.StreamChat(context.Background(), "session-token", CompletionRequest{Stream: true})
+	if err != nil {
+		t.Fatalf("StreamChat failed: %v", err)
+	}
+
+	if !stream.Next() {
+		t.Fatalf("Expected a first chunk (err: %v)", stream.Err())
+	}
+	if err := stream.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+
+	if stream.Next() {
+		t.Error("Next should return false after Close")
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Closing the stream should not be reported as an error, got %v", err)
+	}
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream request was not aborted after Close")
+	}
+}
+
+func TestChatStopsOnCallbackError(t *testing.T) {
+	server := newStreamServer(t, chunkJSON("one"), chunkJSON("two"), chunkJSON("three"), "[DONE]")
+
+	c := NewClient(WithCopilotURL(server.URL))
+
+	callbackErr := errors.New("stop here")
+	calls := 0
+	err := c.Chat("session-token", []Message{{Role: "user", Content: "Hello"}}, "test-model", 0.7, 0.9, 1, true, func(CompletionResponse) error {
+		calls++
+		if calls == 2 {
+			return callbackErr
+		}
+		return nil
+	})
+
+	if !errors.Is(err, callbackErr) {
+		t.Errorf("Expected the callback error to be returned, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the stream to stop after 2 callbacks, got %d", calls)
+	}
+}
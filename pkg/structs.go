@@ -1,8 +1,26 @@
 package pkg
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 // FinishReason constants for OpenAI API compatibility.
 const (
-	FinishReasonStop = "stop"
+	FinishReasonStop          = "stop"
+	FinishReasonLength        = "length"
+	FinishReasonContentFilter = "content_filter"
+	FinishReasonToolCalls     = "tool_calls"
+	FinishReasonFunctionCall  = "function_call"
+)
+
+// Errors of the OAuth device flow (RFC 8628, section 3.5), reported in
+// AuthenticationResponse.Error.
+const (
+	DeviceFlowAuthorizationPending = "authorization_pending"
+	DeviceFlowSlowDown             = "slow_down"
+	DeviceFlowExpiredToken         = "expired_token"
+	DeviceFlowAccessDenied         = "access_denied"
 )
 
 type AuthenticationRequest struct {
@@ -16,15 +34,54 @@ type AuthenticationResponse struct {
 	Interval    int    `json:"interval"`
 	TokenType   string `json:"token_type"`
 	Scope       string `json:"scope"`
+	// Error is set instead of AccessToken while the device code has not been
+	// authorized, e.g. to DeviceFlowAuthorizationPending.
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorURI         string `json:"error_uri,omitempty"`
 }
 
 type Choice struct {
 	FinishReason string   `json:"finish_reason,omitempty"`
-	Index        int64    `json:"index,omitempty"`
+	Index        int64    `json:"index"`
 	Message      *Message `json:"message,omitempty"`
 	Delta        *Message `json:"delta,omitempty"`
 }
 
+type CodeCompletionChoice struct {
+	Text         string `json:"text"`
+	Index        int64  `json:"index"`
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// CodeCompletionExtra carries the editor context the completions engine uses
+// to shape its suggestions.
+type CodeCompletionExtra struct {
+	Language string `json:"language,omitempty"`
+}
+
+// CodeCompletionRequest is a fill-in-the-middle request: the engine completes
+// the code between Prompt and Suffix.
+type CodeCompletionRequest struct {
+	Prompt      string               `json:"prompt"`
+	Suffix      string               `json:"suffix,omitempty"`
+	MaxTokens   int64                `json:"max_tokens,omitempty"`
+	Temperature *float64             `json:"temperature,omitempty"`
+	TopP        *float64             `json:"top_p,omitempty"`
+	N           int64                `json:"n,omitempty"`
+	Stop        []string             `json:"stop,omitempty"`
+	Stream      bool                 `json:"stream"`
+	Extra       *CodeCompletionExtra `json:"extra,omitempty"`
+}
+
+type CodeCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []CodeCompletionChoice `json:"choices"`
+	Usage   Usage                  `json:"usage"`
+}
+
 type CompletionRequest struct {
 	Model       string    `json:"model"`
 	Messages    []Message `json:"messages"`
@@ -32,6 +89,31 @@ type CompletionRequest struct {
 	Temperature float64   `json:"temperature"`
 	TopP        float64   `json:"top_p"`
 	N           int64     `json:"n"`
+
+	Tools []Tool `json:"tools,omitempty"`
+	// ToolChoice is either a string ("none", "auto", "required") or an
+	// object selecting a specific function.
+	ToolChoice        interface{} `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool       `json:"parallel_tool_calls,omitempty"`
+
+	// Functions and FunctionCall are the deprecated predecessors of Tools
+	// and ToolChoice.
+	Functions    []FunctionDefinition `json:"functions,omitempty"`
+	FunctionCall interface{}          `json:"function_call,omitempty"`
+
+	MaxTokens           *int64   `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int64   `json:"max_completion_tokens,omitempty"`
+	PresencePenalty     *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64 `json:"frequency_penalty,omitempty"`
+	Seed                *int64   `json:"seed,omitempty"`
+	// Stop is either a single string or an array of up to four strings.
+	Stop            interface{}        `json:"stop,omitempty"`
+	LogitBias       map[string]float64 `json:"logit_bias,omitempty"`
+	User            string             `json:"user,omitempty"`
+	ResponseFormat  *ResponseFormat    `json:"response_format,omitempty"`
+	ReasoningEffort string             `json:"reasoning_effort,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
 }
 
 type CompletionResponse struct {
@@ -45,21 +127,195 @@ type CompletionResponse struct {
 
 type CompletionResponseHandler func(CompletionResponse) error
 
+// ContentPart is one element of a multimodal message content array.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// Embedding is the embedding of a single input.
+type Embedding struct {
+	Object    string    `json:"object"`
+	Embedding []float64 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type EmbeddingRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions *int64   `json:"dimensions,omitempty"`
+	User       string   `json:"user,omitempty"`
+}
+
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int64 `json:"prompt_tokens"`
+	TotalTokens  int64 `json:"total_tokens"`
+}
+
+type FunctionCall struct {
+	Name string `json:"name,omitempty"`
+	// Arguments is a JSON encoded object. In streamed deltas it holds the
+	// next fragment of the arguments.
+	Arguments string `json:"arguments"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ImageURL struct {
+	// URL is an http(s) URL, a base64 data URL or, for local use, a file://
+	// URL that ResolveImages turns into a data URL.
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
 type LoginRequest struct {
 	ClientID string `json:"client_id"`
 	Scopes   string `json:"scopes"`
 }
 
 type LoginResponse struct {
-	DeviceCode      string `json:"device_code"`
+	DeviceCode string `json:"device_code"`
+	// ExpiresIn is the lifetime of the device code in seconds.
+	ExpiresIn       int    `json:"expires_in"`
 	Interval        int    `json:"interval"`
 	UserCode        string `json:"user_code"`
 	VerificationURI string `json:"verification_uri"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
+	Role    string `json:"role,omitempty"`
 	Content string `json:"content"`
+	// MultiContent holds the parts of a content array. When set it is sent
+	// instead of Content.
+	MultiContent []ContentPart `json:"-"`
+	Name         string        `json:"name,omitempty"`
+
+	// ToolCalls are the calls requested by an assistant message.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a "tool" role message to the call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// FunctionCall is the deprecated predecessor of ToolCalls.
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+}
+
+// MarshalJSON sends MultiContent as a content array when set, and an empty
+// content as null when the message carries tool or function calls, as OpenAI
+// does.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+
+	var content interface{} = m.Content
+	if len(m.MultiContent) > 0 {
+		content = m.MultiContent
+	} else if m.Content == "" && (len(m.ToolCalls) > 0 || m.FunctionCall != nil) {
+		content = nil
+	}
+
+	return json.Marshal(struct {
+		message
+		Content interface{} `json:"content"`
+	}{message(m), content})
+}
+
+// UnmarshalJSON accepts content as a string, null or an array of parts.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+
+	aux := struct {
+		*message
+		Content json.RawMessage `json:"content"`
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Content = ""
+	m.MultiContent = nil
+
+	content := bytes.TrimSpace(aux.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+	case content[0] == '[':
+		return json.Unmarshal(content, &m.MultiContent)
+	default:
+		return json.Unmarshal(content, &m.Content)
+	}
+
+	return nil
+}
+
+// HasImages reports whether the message contains an image part.
+func (m Message) HasImages() bool {
+	for _, part := range m.MultiContent {
+		if part.ImageURL != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseFormat selects plain text, JSON mode ("json_object") or structured
+// outputs ("json_schema", described by JSONSchema).
+type ResponseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+}
+
+// Model describes a model in the Copilot catalog.
+type Model struct {
+	ID                 string            `json:"id"`
+	Name               string            `json:"name"`
+	Object             string            `json:"object"`
+	Vendor             string            `json:"vendor"`
+	Version            string            `json:"version"`
+	Preview            bool              `json:"preview"`
+	ModelPickerEnabled bool              `json:"model_picker_enabled"`
+	Capabilities       ModelCapabilities `json:"capabilities"`
+}
+
+type ModelCapabilities struct {
+	Family    string        `json:"family"`
+	Type      string        `json:"type"`
+	Tokenizer string        `json:"tokenizer"`
+	Limits    ModelLimits   `json:"limits"`
+	Supports  ModelSupports `json:"supports"`
+}
+
+// ModelLimits holds the token limits of a model; a zero value means the
+// limit was not reported.
+type ModelLimits struct {
+	MaxContextWindowTokens int64 `json:"max_context_window_tokens,omitempty"`
+	MaxOutputTokens        int64 `json:"max_output_tokens,omitempty"`
+	MaxPromptTokens        int64 `json:"max_prompt_tokens,omitempty"`
+}
+
+// ModelSupports lists the features of a model; a nil value means the feature
+// was not reported.
+type ModelSupports struct {
+	Streaming         *bool `json:"streaming,omitempty"`
+	ToolCalls         *bool `json:"tool_calls,omitempty"`
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	StructuredOutputs *bool `json:"structured_outputs,omitempty"`
+	Vision            *bool `json:"vision,omitempty"`
+}
+
+type ModelsResponse struct {
+	Data   []Model `json:"data"`
+	Object string  `json:"object"`
 }
 
 type SessionResponse struct {
@@ -67,8 +323,34 @@ type SessionResponse struct {
 	ExpiresAt int64  `json:"expires_at,omitempty"`
 }
 
+// StreamOptions configures a streaming request. With IncludeUsage set, a
+// final chunk with no choices reports the token usage of the whole request.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type ToolCall struct {
+	// Index identifies the call a streamed delta belongs to.
+	Index    *int64       `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
 type Usage struct {
 	CompletionTokens int64 `json:"completion_tokens"`
 	PromptTokens     int64 `json:"prompt_tokens"`
 	TotalTokens      int64 `json:"total_tokens"`
 }
+
+// User is the GitHub account an OAuth token belongs to.
+type User struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name,omitempty"`
+}
@@ -2,6 +2,8 @@ package pkg
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -418,3 +420,250 @@ func TestSessionResponseSerialization(t *testing.T) {
 		t.Errorf("ExpiresAt mismatch: expected %d, got %d", resp.ExpiresAt, unmarshaled.ExpiresAt)
 	}
 }
+
+func TestMessageToolCallsSerialization(t *testing.T) {
+	index := int64(0)
+	msg := Message{
+		Role: "assistant",
+		ToolCalls: []ToolCall{
+			{
+				Index: &index,
+				ID:    "call_123",
+				Type:  "function",
+				Function: FunctionCall{
+					Name:      "get_weather",
+					Arguments: `{"city":"Ottawa"}`,
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+
+	var jsonObj map[string]interface{}
+	if err := json.Unmarshal(data, &jsonObj); err != nil {
+		t.Fatalf("Failed to unmarshal to map: %v", err)
+	}
+
+	// OpenAI sends a null content alongside tool calls
+	if content, exists := jsonObj["content"]; !exists || content != nil {
+		t.Errorf("Expected content to be null, got %v", jsonObj["content"])
+	}
+
+	var unmarshaled Message
+	if err := json.Unmarshal(data, &unmarshaled); err != nil {
+		t.Fatalf("Failed to unmarshal Message: %v", err)
+	}
+
+	if len(unmarshaled.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(unmarshaled.ToolCalls))
+	}
+	call := unmarshaled.ToolCalls[0]
+	if call.ID != "call_123" || call.Type != "function" {
+		t.Errorf("Tool call mismatch: %+v", call)
+	}
+	if call.Index == nil || *call.Index != 0 {
+		t.Errorf("Expected tool call index 0, got %v", call.Index)
+	}
+	if call.Function.Name != "get_weather" || call.Function.Arguments != `{"city":"Ottawa"}` {
+		t.Errorf("Function mismatch: %+v", call.Function)
+	}
+}
+
+func TestToolMessageSerialization(t *testing.T) {
+	msg := Message{
+		Role:       "tool",
+		Content:    `{"temperature":21}`,
+		ToolCallID: "call_123",
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+
+	var jsonObj map[string]interface{}
+	if err := json.Unmarshal(data, &jsonObj); err != nil {
+		t.Fatalf("Failed to unmarshal to map: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"role":         "tool",
+		"content":      `{"temperature":21}`,
+		"tool_call_id": "call_123",
+	}
+	if len(jsonObj) != len(expected) {
+		t.Errorf("Expected fields %v, got %v", expected, jsonObj)
+	}
+	for field, value := range expected {
+		if jsonObj[field] != value {
+			t.Errorf("Field %s mismatch: expected %v, got %v", field, value, jsonObj[field])
+		}
+	}
+
+	// Plain messages keep their previous shape
+	data, err = json.Marshal(Message{Role: "user", Content: "Hello"})
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+	if string(data) != `{"role":"user","content":"Hello"}` {
+		t.Errorf("Unexpected plain message JSON: %s", string(data))
+	}
+}
+
+func TestCompletionRequestToolsSerialization(t *testing.T) {
+	parallel := false
+	req := CompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []Message{{Role: "user", Content: "Weather in Ottawa?"}},
+		Tools: []Tool{
+			{
+				Type: "function",
+				Function: FunctionDefinition{
+					Name:        "get_weather",
+					Description: "Get the current weather",
+					Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`),
+				},
+			},
+		},
+		ToolChoice: map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": "get_weather"},
+		},
+		ParallelToolCalls: &parallel,
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to marshal CompletionRequest: %v", err)
+	}
+
+	var unmarshaled CompletionRequest
+	if err := json.Unmarshal(data, &unmarshaled); err != nil {
+		t.Fatalf("Failed to unmarshal CompletionRequest: %v", err)
+	}
+
+	if len(unmarshaled.Tools) != 1 || unmarshaled.Tools[0].Function.Name != "get_weather" {
+		t.Fatalf("Tools mismatch: %+v", unmarshaled.Tools)
+	}
+	if string(unmarshaled.Tools[0].Function.Parameters) != `{"type":"object","properties":{"city":{"type":"string"}}}` {
+		t.Errorf("Parameters mismatch: %s", string(unmarshaled.Tools[0].Function.Parameters))
+	}
+	toolChoice, ok := unmarshaled.ToolChoice.(map[string]interface{})
+	if !ok || toolChoice["type"] != "function" {
+		t.Errorf("ToolChoice mismatch: %v", unmarshaled.ToolChoice)
+	}
+	if unmarshaled.ParallelToolCalls == nil || *unmarshaled.ParallelToolCalls {
+		t.Errorf("ParallelToolCalls mismatch: %v", unmarshaled.ParallelToolCalls)
+	}
+
+	// Requests without tools do not send any tool fields
+	data, err = json.Marshal(CompletionRequest{Model: "gpt-4o"})
+	if err != nil {
+		t.Fatalf("Failed to marshal CompletionRequest: %v", err)
+	}
+	for _, field := range []string{"tools", "tool_choice", "parallel_tool_calls", "functions", "function_call"} {
+		if strings.Contains(string(data), `"`+field+`"`) {
+			t.Errorf("Expected %s to be omitted, got %s", field, string(data))
+		}
+	}
+}
+
+func TestMessageMultiContentSerialization(t *testing.T) {
+	input := `{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"https://example.com/cat.png","detail":"low"}}]}`
+
+	var message Message
+	if err := json.Unmarshal([]byte(input), &message); err != nil {
+		t.Fatalf("Failed to unmarshal Message: %v", err)
+	}
+
+	if message.Content != "" {
+		t.Errorf("Expected empty Content, got %q", message.Content)
+	}
+	if len(message.MultiContent) != 2 {
+		t.Fatalf("Expected 2 content parts, got %+v", message.MultiContent)
+	}
+	if message.MultiContent[0].Type != "text" || message.MultiContent[0].Text != "What is this?" {
+		t.Errorf("Text part mismatch: %+v", message.MultiContent[0])
+	}
+	image := message.MultiContent[1].ImageURL
+	if image == nil || image.URL != "https://example.com/cat.png" || image.Detail != "low" {
+		t.Errorf("Image part mismatch: %+v", message.MultiContent[1])
+	}
+	if !message.HasImages() {
+		t.Error("Expected HasImages to be true")
+	}
+
+	// The parts are sent back unchanged
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+
+	var got, want interface{}
+	json.Unmarshal(data, &got)
+	json.Unmarshal([]byte(input), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip mismatch.\nExpected: %s\nGot: %s", input, string(data))
+	}
+}
+
+func TestMessageContentForms(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		content string
+		parts   int
+	}{
+		{"string", `{"role":"user","content":"Hello"}`, "Hello", 0},
+		{"null", `{"role":"assistant","content":null}`, "", 0},
+		{"missing", `{"role":"assistant"}`, "", 0},
+		{"array", `{"role":"user","content":[{"type":"text","text":"Hello"}]}`, "", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message Message
+			if err := json.Unmarshal([]byte(tt.input), &message); err != nil {
+				t.Fatalf("Failed to unmarshal Message: %v", err)
+			}
+			if message.Content != tt.content {
+				t.Errorf("Expected content %q, got %q", tt.content, message.Content)
+			}
+			if len(message.MultiContent) != tt.parts {
+				t.Errorf("Expected %d parts, got %d", tt.parts, len(message.MultiContent))
+			}
+		})
+	}
+
+	var message Message
+	if err := json.Unmarshal([]byte(`{"role":"user","content":42}`), &message); err == nil {
+		t.Error("Expected an error for numeric content")
+	}
+}
+
+func TestCompletionRequestOmitsUnsetSamplingParameters(t *testing.T) {
+	data, err := json.Marshal(CompletionRequest{Model: "gpt-4o"})
+	if err != nil {
+		t.Fatalf("Failed to marshal CompletionRequest: %v", err)
+	}
+
+	for _, field := range []string{"max_tokens", "max_completion_tokens", "stop", "presence_penalty", "frequency_penalty", "seed", "logit_bias", "user", "response_format", "reasoning_effort"} {
+		if strings.Contains(string(data), `"`+field+`"`) {
+			t.Errorf("Expected %s to be omitted, got %s", field, string(data))
+		}
+	}
+
+	// Zero values that were explicitly set are still sent
+	zero := 0.0
+	data, err = json.Marshal(CompletionRequest{Model: "gpt-4o", PresencePenalty: &zero})
+	if err != nil {
+		t.Fatalf("Failed to marshal CompletionRequest: %v", err)
+	}
+	if !strings.Contains(string(data), `"presence_penalty":0`) {
+		t.Errorf("Expected presence_penalty 0 to be sent, got %s", string(data))
+	}
+}
@@ -0,0 +1,153 @@
+// Package tokenizer counts tokens offline with the BPE vocabularies used by
+// OpenAI models. The vocabularies are embedded in the binary, so no network
+// access is needed.
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Encodings supported by the tokenizer.
+const (
+	CL100KBase = "cl100k_base"
+	O200KBase  = "o200k_base"
+)
+
+// OpenAI chat formatting overhead: every message is wrapped in
+// <|start|>{role}\n{content}<|end|>\n, a name replaces the role at the cost
+// of one more token and every reply is primed with <|start|>assistant.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// tokensPerImage is the base cost of an image part. The full cost of a high
+// detail image depends on its dimensions, which are not known here.
+const tokensPerImage = 85
+
+// o200k_prefixes lists the model families tokenized with o200k_base; all
+// other models, including those without a public tokenizer such as Claude
+// and Gemini, are approximated with cl100k_base.
+var o200k_prefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+var (
+	encodings = map[string]*Tokenizer{}
+	mu        sync.Mutex
+)
+
+func init() {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Tokenizer encodes text with a single BPE encoding. It is safe for
+// concurrent use.
+type Tokenizer struct {
+	encoding string
+	bpe      *tiktoken.Tiktoken
+}
+
+// New returns the Tokenizer for the named encoding. Encodings are loaded on
+// first use and shared afterwards.
+func New(encoding string) (*Tokenizer, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t, ok := encodings[encoding]; ok {
+		return t, nil
+	}
+
+	bpe, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tokenizer{encoding: encoding, bpe: bpe}
+	encodings[encoding] = t
+	return t, nil
+}
+
+// Preload loads every supported encoding so that the first count does not pay
+// for it.
+func Preload() error {
+	for _, encoding := range []string{CL100KBase, O200KBase} {
+		if _, err := New(encoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForModel returns the Tokenizer for the encoding used by model.
+func ForModel(model string) (*Tokenizer, error) {
+	return New(EncodingForModel(model))
+}
+
+// EncodingForModel returns the name of the encoding used by the family of
+// model.
+func EncodingForModel(model string) string {
+	model = strings.ToLower(model)
+	for _, prefix := range o200k_prefixes {
+		if strings.HasPrefix(model, prefix) {
+			return O200KBase
+		}
+	}
+	return CL100KBase
+}
+
+// Encoding returns the name of the encoding.
+func (t *Tokenizer) Encoding() string {
+	return t.encoding
+}
+
+// Encode returns the tokens of text. Special tokens are encoded as plain
+// text.
+func (t *Tokenizer) Encode(text string) []int {
+	return t.bpe.Encode(text, nil, nil)
+}
+
+// Count returns the number of tokens in text.
+func (t *Tokenizer) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	return len(t.Encode(text))
+}
+
+// CountMessages returns the number of prompt tokens used by messages,
+// including the per-message overhead of the chat format.
+func (t *Tokenizer) CountMessages(messages []pkg.Message) int {
+	count := tokensPerReply
+
+	for _, message := range messages {
+		count += tokensPerMessage
+		count += t.Count(message.Role)
+		count += t.Count(message.Content)
+
+		for _, part := range message.MultiContent {
+			count += t.Count(part.Text)
+			if part.ImageURL != nil {
+				count += tokensPerImage
+			}
+		}
+
+		if message.Name != "" {
+			count += t.Count(message.Name) + tokensPerName
+		}
+
+		for _, toolCall := range message.ToolCalls {
+			count += t.Count(toolCall.Function.Name) + t.Count(toolCall.Function.Arguments)
+		}
+		if message.FunctionCall != nil {
+			count += t.Count(message.FunctionCall.Name) + t.Count(message.FunctionCall.Arguments)
+		}
+		count += t.Count(message.ToolCallID)
+	}
+
+	return count
+}
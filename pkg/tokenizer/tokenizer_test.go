@@ -0,0 +1,133 @@
+package tokenizer
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/maxneuvians/go-copilot-proxy/pkg"
+)
+
+func TestEncodingForModel(t *testing.T) {
+	tests := map[string]string{
+		"gpt-4o":            O200KBase,
+		"gpt-4o-mini":       O200KBase,
+		"gpt-4.1":           O200KBase,
+		"gpt-5":             O200KBase,
+		"o3-mini":           O200KBase,
+		"GPT-4o":            O200KBase,
+		"gpt-4":             CL100KBase,
+		"gpt-4-0613":        CL100KBase,
+		"gpt-3.5-turbo":     CL100KBase,
+		"claude-3.7-sonnet": CL100KBase,
+		"gemini-2.0-flash":  CL100KBase,
+	}
+
+	for model, want := range tests {
+		if got := EncodingForModel(model); got != want {
+			t.Errorf("EncodingForModel(%q) = %s, expected %s", model, got, want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		want     []int
+	}{
+		{CL100KBase, "hello world", []int{15339, 1917}},
+		{O200KBase, "hello world", []int{24912, 2375}},
+		// Special tokens are plain text
+		{CL100KBase, "<|endoftext|>", []int{27, 91, 8862, 728, 428, 91, 29}},
+	}
+
+	for _, tt := range tests {
+		tokenizer, err := New(tt.encoding)
+		if err != nil {
+			t.Fatalf("New(%s) failed: %v", tt.encoding, err)
+		}
+
+		if got := tokenizer.Encode(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Encode(%q) = %v, expected %v", tt.encoding, tt.text, got, tt.want)
+		}
+		if got := tokenizer.Count(tt.text); got != len(tt.want) {
+			t.Errorf("%s: Count(%q) = %d, expected %d", tt.encoding, tt.text, got, len(tt.want))
+		}
+	}
+
+	if _, err := New("unknown_base"); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+}
+
+// The expected counts are those reported by the OpenAI API for this prompt, as
+// published in the OpenAI cookbook.
+func TestCountMessages(t *testing.T) {
+	messages := []pkg.Message{
+		{Role: "system", Content: "You are a helpful, pattern-following assistant that translates corporate jargon into plain English."},
+		{Role: "system", Name: "example_user", Content: "New synergies will help drive top-line growth."},
+		{Role: "system", Name: "example_assistant", Content: "Things working well together will increase revenue."},
+		{Role: "system", Name: "example_user", Content: "Let's circle back when we have more bandwidth to touch base on opportunities for increased leverage."},
+		{Role: "system", Name: "example_assistant", Content: "Let's talk later when we're less busy about how to do better."},
+		{Role: "user", Content: "This late pivot means we don't have time to boil the ocean for the client deliverable."},
+	}
+
+	tests := map[string]int{
+		"gpt-4-0613":    129,
+		"gpt-3.5-turbo": 129,
+		"gpt-4o":        124,
+		"gpt-4o-mini":   124,
+	}
+
+	for model, want := range tests {
+		tokenizer, err := ForModel(model)
+		if err != nil {
+			t.Fatalf("ForModel(%s) failed: %v", model, err)
+		}
+		if got := tokenizer.CountMessages(messages); got != want {
+			t.Errorf("%s: CountMessages = %d, expected %d", model, got, want)
+		}
+	}
+}
+
+func TestCountMessagesMultiContent(t *testing.T) {
+	tokenizer, err := New(O200KBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := tokenizer.CountMessages([]pkg.Message{{Role: "user", Content: "What is this?"}})
+	withImage := tokenizer.CountMessages([]pkg.Message{
+		{
+			Role: "user",
+			MultiContent: []pkg.ContentPart{
+				{Type: "text", Text: "What is this?"},
+				{Type: "image_url", ImageURL: &pkg.ImageURL{URL: "https://example.com/cat.png"}},
+			},
+		},
+	})
+
+	if withImage != text+tokensPerImage {
+		t.Errorf("Expected the image to add %d tokens to %d, got %d", tokensPerImage, text, withImage)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokenizer, err := ForModel("gpt-4o")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := tokenizer.Count("hello world"); got != 2 {
+				t.Errorf("Expected 2 tokens, got %d", got)
+			}
+		}()
+	}
+	wg.Wait()
+}
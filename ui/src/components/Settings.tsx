@@ -1,7 +1,18 @@
+import { useEffect, useState } from 'react';
 import { useDisclosure } from '@mantine/hooks';
 import { Drawer, Button, Stack, Select, NumberInput } from '@mantine/core';
 import { useSettings, AVAILABLE_MODELS, ModelOption } from '../context/SettingsContext';
 
+interface ModelListResponse {
+    data: Array<{
+        id: string;
+        name?: string;
+        type?: string;
+    }>;
+}
+
+const MODELS_URL = 'http://127.0.0.1:3000/v1/models';
+
 interface SettingsDrawerProps {
     opened: boolean;
     onClose: () => void;
@@ -9,6 +20,30 @@ interface SettingsDrawerProps {
 
 export function SettingsDrawer({ opened, onClose }: SettingsDrawerProps) {
     const { settings, setSettings } = useSettings();
+    const [models, setModels] = useState<ModelOption[]>(AVAILABLE_MODELS);
+
+    // Load the chat models from the proxy, keeping the built-in list if that fails
+    useEffect(() => {
+        fetch(MODELS_URL)
+            .then((response) => {
+                if (!response.ok) {
+                    throw new Error(`API request failed with status: ${response.status}`);
+                }
+                return response.json() as Promise<ModelListResponse>;
+            })
+            .then((list) => {
+                const chatModels = list.data
+                    .filter((model) => !model.type || model.type === 'chat')
+                    .map((model) => ({ label: model.name || model.id, value: model.id }));
+                if (chatModels.length > 0) {
+                    setModels(chatModels);
+                }
+            })
+            .catch((error) => {
+                console.error('Failed to load models:', error);
+            });
+    }, []);
+
     const handleModelChange = (value: string | null) => {
         if (value) {
             setSettings({
@@ -38,7 +73,7 @@ export function SettingsDrawer({ opened, onClose }: SettingsDrawerProps) {
                 <Select
                     label="AI MODEL"
                     placeholder="Pick value"
-                    data={AVAILABLE_MODELS}
+                    data={models}
                     onChange={handleModelChange}
                     value={settings.model}
                     styles={{ label: { fontWeight: 900 } }}
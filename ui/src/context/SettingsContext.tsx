@@ -5,6 +5,7 @@ export interface ModelOption {
   value: string;
 }
 
+// Fallback used when the proxy's /v1/models endpoint cannot be reached
 export const AVAILABLE_MODELS: ModelOption[] = [
   // Existing models
 //   { label: 'Claude 3.5', value: 'claude-3.5' },